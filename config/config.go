@@ -2,10 +2,13 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"gemini-antiblock/logger"
 )
 
 // Config holds all configuration values
@@ -14,26 +17,111 @@ type Config struct {
 	MaxConsecutiveRetries      int
 	DebugMode                  bool
 	RetryDelayMs               time.Duration
+	RetryBackoffStrategy       string
+	RetryBackoffMultiplier     float64
+	RetryMaxDelayMs            time.Duration
+	RetryJitter                string
+	HonorRetryAfter            bool
+	RetryAfterMaxMs            time.Duration
 	SwallowThoughtsAfterRetry  bool
+	NonStreamingAntiblock      bool
+	SSEMaxEventBytes           int
+	ResumeThoughtSignatures    bool
+	ResumeThoughtText          bool
+	ResumeOverlapWindow        int
+	ResumeOverlapMinChars      int
+	ResumePreambleWindow       int
+	ResumePreamblePatterns     []string
+	ResumeStrategy             string
+	ResumeStrategyModels       map[string]string
+	ResumePromptTemplate       string
+	ResumePromptTailChars      int
+	HedgedRetryRequests        int
+	HedgedRetryMaxExtra        int
+	HedgedRetryAPIKeys         []string
+	HedgedRetryModels          []string
+	ModelFallbackChains        map[string][]string
+	ModelFallbackAfter         map[string]int
+	UsageAttemptBreakdown      bool
 	Port                       string
 	EnableRateLimit            bool
 	RateLimitCount             int
 	RateLimitWindowSeconds     int
 	EnablePunctuationHeuristic bool
+	JSONModeValidateSchema     bool
+	CompletionDetector         string
+	CompletionDetectorModels   map[string]string
+	CompletionToken            string
+	CompletionInstruction      string
+	CompletionTemplates        map[string]string
+	CompletionSentinelModels   map[string]SentinelConfig
 	GeminiModelMaxTokens       map[string]int
+	TokenCountMode             string
+	TokenCountTimeoutMs        time.Duration
+	TokenCountCacheSize        int
+	EstimatorMediaCosts        MediaCosts
 	TokenLimitExceededCode     int
 	TokenLimitExceededMessage  string
 	NoRetryErrorCodes          []int
+	RetryPolicy                RetryPolicyConfig
+}
+
+// RetryRule describes how a single class of failure is handled
+type RetryRule struct {
+	Action  string `json:"action"`
+	DelayMs *int   `json:"delayMs,omitempty"`
+}
+
+// RetryPolicyConfig holds user-defined retry rules keyed by HTTP status code,
+// upstream error status string (e.g. RESOURCE_EXHAUSTED) and interruption reason (e.g. BLOCK)
+type RetryPolicyConfig struct {
+	HTTPStatus     map[string]RetryRule `json:"httpStatus"`
+	UpstreamStatus map[string]RetryRule `json:"upstreamStatus"`
+	Interruption   map[string]RetryRule `json:"interruption"`
+}
+
+// SentinelConfig overrides the completion sentinel token and its instruction for a model.
+// Instruction may contain the {token} placeholder.
+type SentinelConfig struct {
+	Token       string `json:"token"`
+	Instruction string `json:"instruction"`
+}
+
+// MediaCosts are the token costs the local estimator assigns to media parts. Media whose length
+// the request does not tell are assumed to be as long as the defaults.
+type MediaCosts struct {
+	ImageTokens          int     `json:"imageTokens"`
+	AudioTokensPerSecond int     `json:"audioTokensPerSecond"`
+	VideoTokensPerSecond int     `json:"videoTokensPerSecond"`
+	VideoFramesPerSecond float64 `json:"videoFramesPerSecond"`
+	DocumentPageTokens   int     `json:"documentPageTokens"`
+	DefaultAudioSeconds  float64 `json:"defaultAudioSeconds"`
+	DefaultVideoSeconds  float64 `json:"defaultVideoSeconds"`
+	DefaultDocumentPages int     `json:"defaultDocumentPages"`
+}
+
+// DefaultMediaCosts follow the published Gemini rates: 258 tokens per image and document page,
+// 32 tokens per second of audio and 263 per second of video (sampled at 1 fps, with its audio)
+var DefaultMediaCosts = MediaCosts{
+	ImageTokens:          258,
+	AudioTokensPerSecond: 32,
+	VideoTokensPerSecond: 263,
+	VideoFramesPerSecond: 1,
+	DocumentPageTokens:   258,
+	DefaultAudioSeconds:  60,
+	DefaultVideoSeconds:  60,
+	DefaultDocumentPages: 1,
 }
 
+// defaultNoRetryErrorCodes is used when NO_RETRY_ERROR_CODES is not set
+var defaultNoRetryErrorCodes = []int{400, 401, 403, 404}
+
 // LoadConfig loads configuration from environment variables
 func LoadConfig() *Config {
-	// Parse model max tokens JSON
-	modelMaxTokens := make(map[string]int)
-	if jsonStr := os.Getenv("GEMINI_MODEL_MAX_TOKENS_JSON"); jsonStr != "" {
-		if err := json.Unmarshal([]byte(jsonStr), &modelMaxTokens); err != nil {
-			// Log error but continue with empty map
-		}
+	// Parse media costs; members left out keep their defaults
+	mediaCosts := DefaultMediaCosts
+	if !decodeEnvJSON("ESTIMATOR_MEDIA_COSTS_JSON", &mediaCosts) {
+		mediaCosts = DefaultMediaCosts
 	}
 
 	// Parse no retry error codes
@@ -45,6 +133,8 @@ func LoadConfig() *Config {
 				noRetryCodes = append(noRetryCodes, code)
 			}
 		}
+	} else {
+		noRetryCodes = append(noRetryCodes, defaultNoRetryErrorCodes...)
 	}
 
 	return &Config{
@@ -53,15 +143,52 @@ func LoadConfig() *Config {
 		DebugMode:                  getEnvBool("DEBUG_MODE", true),
 		MaxConsecutiveRetries:      getEnvInt("MAX_CONSECUTIVE_RETRIES", 100),
 		RetryDelayMs:               time.Duration(getEnvInt("RETRY_DELAY_MS", 750)) * time.Millisecond,
+		RetryBackoffStrategy:       getEnvChoice("RETRY_BACKOFF_STRATEGY", "exponential", "constant", "exponential"),
+		RetryBackoffMultiplier:     getEnvFloat("RETRY_BACKOFF_MULTIPLIER", 2),
+		RetryMaxDelayMs:            time.Duration(getEnvInt("RETRY_MAX_DELAY_MS", 30000)) * time.Millisecond,
+		RetryJitter:                getEnvChoice("RETRY_JITTER", "full", "none", "full", "decorrelated"),
+		HonorRetryAfter:            getEnvBool("HONOR_RETRY_AFTER", true),
+		RetryAfterMaxMs:            time.Duration(getEnvInt("RETRY_AFTER_MAX_MS", 60000)) * time.Millisecond,
 		SwallowThoughtsAfterRetry:  getEnvBool("SWALLOW_THOUGHTS_AFTER_RETRY", true),
+		NonStreamingAntiblock:      getEnvBool("NON_STREAMING_ANTIBLOCK", true),
+		SSEMaxEventBytes:           getEnvInt("SSE_MAX_EVENT_BYTES", 16<<20),
+		ResumeThoughtSignatures:    getEnvBool("RESUME_THOUGHT_SIGNATURES", true),
+		ResumeThoughtText:          getEnvBool("RESUME_THOUGHT_TEXT", false),
+		ResumeOverlapWindow:        getEnvInt("RESUME_OVERLAP_WINDOW", 2000),
+		ResumeOverlapMinChars:      getEnvInt("RESUME_OVERLAP_MIN_CHARS", 16),
+		ResumePreambleWindow:       getEnvInt("RESUME_PREAMBLE_WINDOW", 120),
+		ResumePreamblePatterns:     getEnvJSON("RESUME_PREAMBLE_PATTERNS_JSON", []string{}),
+		ResumeStrategy:             getEnvString("RESUME_STRATEGY", "two-turn"),
+		ResumeStrategyModels:       getEnvJSON("RESUME_STRATEGY_MODELS_JSON", map[string]string{}),
+		ResumePromptTemplate:       getEnvString("RESUME_PROMPT_TEMPLATE", ""),
+		ResumePromptTailChars:      getEnvInt("RESUME_PROMPT_TAIL_CHARS", 200),
+		HedgedRetryRequests:        getEnvInt("HEDGED_RETRY_REQUESTS", 1),
+		HedgedRetryMaxExtra:        getEnvInt("HEDGED_RETRY_MAX_EXTRA", 4),
+		HedgedRetryAPIKeys:         getEnvJSON("HEDGED_RETRY_API_KEYS_JSON", []string{}),
+		HedgedRetryModels:          getEnvJSON("HEDGED_RETRY_MODELS_JSON", []string{}),
+		ModelFallbackChains:        getEnvJSON("MODEL_FALLBACK_CHAINS_JSON", map[string][]string{}),
+		ModelFallbackAfter:         getEnvJSON("MODEL_FALLBACK_AFTER_JSON", map[string]int{"BLOCK": 3, "FINISH_ABNORMAL": 3}),
+		UsageAttemptBreakdown:      getEnvBool("USAGE_ATTEMPT_BREAKDOWN", false),
 		EnableRateLimit:            getEnvBool("ENABLE_RATE_LIMIT", false),
 		RateLimitCount:             getEnvInt("RATE_LIMIT_COUNT", 10),
 		RateLimitWindowSeconds:     getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
 		EnablePunctuationHeuristic: getEnvBool("ENABLE_PUNCTUATION_HEURISTIC", true),
-		GeminiModelMaxTokens:       modelMaxTokens,
+		JSONModeValidateSchema:     getEnvBool("JSON_MODE_VALIDATE_SCHEMA", true),
+		CompletionDetector:         getEnvString("COMPLETION_DETECTOR", "sentinel"),
+		CompletionDetectorModels:   getEnvJSON("COMPLETION_DETECTOR_MODELS_JSON", map[string]string{}),
+		CompletionToken:            getEnvString("COMPLETION_TOKEN", "[done]"),
+		CompletionInstruction:      getEnvString("COMPLETION_INSTRUCTION", ""),
+		CompletionTemplates:        getEnvJSON("COMPLETION_INSTRUCTION_TEMPLATES_JSON", map[string]string{}),
+		CompletionSentinelModels:   getEnvJSON("COMPLETION_SENTINEL_MODELS_JSON", map[string]SentinelConfig{}),
+		GeminiModelMaxTokens:       getEnvJSON("GEMINI_MODEL_MAX_TOKENS_JSON", map[string]int{}),
+		TokenCountMode:             getEnvChoice("TOKEN_COUNT_MODE", "local", "local", "upstream"),
+		TokenCountTimeoutMs:        time.Duration(getEnvInt("TOKEN_COUNT_TIMEOUT_MS", 5000)) * time.Millisecond,
+		TokenCountCacheSize:        getEnvInt("TOKEN_COUNT_CACHE_SIZE", 1024),
+		EstimatorMediaCosts:        mediaCosts,
 		TokenLimitExceededCode:     getEnvInt("TOKEN_LIMIT_EXCEEDED_CODE", 413),
 		TokenLimitExceededMessage:  getEnvString("TOKEN_LIMIT_EXCEEDED_MESSAGE", "Request payload is too large: token count exceeds model limit."),
 		NoRetryErrorCodes:          noRetryCodes,
+		RetryPolicy:                getEnvJSON("RETRY_POLICY_JSON", RetryPolicyConfig{}),
 	}
 }
 
@@ -72,6 +199,22 @@ func getEnvString(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvChoice reads a variable that takes one of a fixed set of values, case-insensitively.
+// An unknown value is reported and replaced by defaultValue.
+func getEnvChoice(key, defaultValue string, choices ...string) string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	if value == "" {
+		return defaultValue
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	logger.LogError(fmt.Sprintf("Unknown %s '%s' (expected %s). Using %s.", key, os.Getenv(key), strings.Join(choices, ", "), defaultValue))
+	return defaultValue
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -81,6 +224,39 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvJSON decodes a JSON-valued environment variable, falling back to defaultValue
+// when the variable is unset or malformed. A malformed value is reported.
+func getEnvJSON[T any](key string, defaultValue T) T {
+	var parsed T
+	if !decodeEnvJSON(key, &parsed) {
+		return defaultValue
+	}
+	return parsed
+}
+
+// decodeEnvJSON decodes a JSON-valued environment variable into target and reports whether it
+// did. A malformed value is reported; target may be partly overwritten then.
+func decodeEnvJSON(key string, target interface{}) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return false
+	}
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		logger.LogError(fmt.Sprintf("Ignoring malformed %s: %v", key, err))
+		return false
+	}
+	return true
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
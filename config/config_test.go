@@ -0,0 +1,162 @@
+package config
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadConfig loads the configuration with the environment set to env and returns it with what
+// was logged meanwhile
+func loadConfig(t *testing.T, env map[string]string) (*Config, string) {
+	t.Helper()
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	var logged bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(output)
+	return LoadConfig(), logged.String()
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		get     func(*Config) interface{}
+		want    interface{}
+		wantLog string
+	}{
+		{
+			name:  "model max tokens",
+			key:   "GEMINI_MODEL_MAX_TOKENS_JSON",
+			value: `{"gemini-2.5-pro": 1048576}`,
+			get:   func(c *Config) interface{} { return c.GeminiModelMaxTokens },
+			want:  map[string]int{"gemini-2.5-pro": 1048576},
+		},
+		{
+			name:    "malformed model max tokens",
+			key:     "GEMINI_MODEL_MAX_TOKENS_JSON",
+			value:   `{"gemini-2.5-pro": "a lot"}`,
+			get:     func(c *Config) interface{} { return c.GeminiModelMaxTokens },
+			want:    map[string]int{},
+			wantLog: "Ignoring malformed GEMINI_MODEL_MAX_TOKENS_JSON",
+		},
+		{
+			name:  "partial media costs",
+			key:   "ESTIMATOR_MEDIA_COSTS_JSON",
+			value: `{"imageTokens": 300}`,
+			get:   func(c *Config) interface{} { return c.EstimatorMediaCosts },
+			want: func() MediaCosts {
+				costs := DefaultMediaCosts
+				costs.ImageTokens = 300
+				return costs
+			}(),
+		},
+		{
+			name:    "malformed media costs",
+			key:     "ESTIMATOR_MEDIA_COSTS_JSON",
+			value:   `{"imageTokens": 300, "audioTokensPerSecond": "32"}`,
+			get:     func(c *Config) interface{} { return c.EstimatorMediaCosts },
+			want:    DefaultMediaCosts,
+			wantLog: "Ignoring malformed ESTIMATOR_MEDIA_COSTS_JSON",
+		},
+		{
+			name:  "fallback after replaces the defaults",
+			key:   "MODEL_FALLBACK_AFTER_JSON",
+			value: `{"429": 2}`,
+			get:   func(c *Config) interface{} { return c.ModelFallbackAfter },
+			want:  map[string]int{"429": 2},
+		},
+		{
+			name:    "malformed fallback after",
+			key:     "MODEL_FALLBACK_AFTER_JSON",
+			value:   `{"429": 2`,
+			get:     func(c *Config) interface{} { return c.ModelFallbackAfter },
+			want:    map[string]int{"BLOCK": 3, "FINISH_ABNORMAL": 3},
+			wantLog: "Ignoring malformed MODEL_FALLBACK_AFTER_JSON",
+		},
+		{
+			name:    "malformed retry policy",
+			key:     "RETRY_POLICY_JSON",
+			value:   `{"httpStatus": []}`,
+			get:     func(c *Config) interface{} { return c.RetryPolicy },
+			want:    RetryPolicyConfig{},
+			wantLog: "Ignoring malformed RETRY_POLICY_JSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, logged := loadConfig(t, map[string]string{tt.key: tt.value})
+			if got := tt.get(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %+v, want %+v", tt.key, got, tt.want)
+			}
+			checkLogged(t, logged, tt.wantLog)
+		})
+	}
+}
+
+func TestLoadConfigChoices(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		get     func(*Config) string
+		want    string
+		wantLog string
+	}{
+		{"token count mode unset", "TOKEN_COUNT_MODE", "", func(c *Config) string { return c.TokenCountMode }, "local", ""},
+		{"token count mode", "TOKEN_COUNT_MODE", " Upstream ", func(c *Config) string { return c.TokenCountMode }, "upstream", ""},
+		{"unknown token count mode", "TOKEN_COUNT_MODE", "remote", func(c *Config) string { return c.TokenCountMode }, "local", "Unknown TOKEN_COUNT_MODE 'remote'"},
+		{"backoff strategy", "RETRY_BACKOFF_STRATEGY", "CONSTANT", func(c *Config) string { return c.RetryBackoffStrategy }, "constant", ""},
+		{"unknown backoff strategy", "RETRY_BACKOFF_STRATEGY", "linear", func(c *Config) string { return c.RetryBackoffStrategy }, "exponential", "Unknown RETRY_BACKOFF_STRATEGY 'linear'"},
+		{"jitter", "RETRY_JITTER", "decorrelated", func(c *Config) string { return c.RetryJitter }, "decorrelated", ""},
+		{"unknown jitter", "RETRY_JITTER", "equal", func(c *Config) string { return c.RetryJitter }, "full", "Unknown RETRY_JITTER 'equal'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, logged := loadConfig(t, map[string]string{tt.key: tt.value})
+			if got := tt.get(cfg); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+			}
+			checkLogged(t, logged, tt.wantLog)
+		})
+	}
+}
+
+func TestLoadConfigNoRetryErrorCodes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{"", []int{400, 401, 403, 404}},
+		{"400, 429", []int{400, 429}},
+		{"400,teapot,418", []int{400, 418}},
+	}
+	for _, tt := range tests {
+		cfg, _ := loadConfig(t, map[string]string{"NO_RETRY_ERROR_CODES": tt.value})
+		if !reflect.DeepEqual(cfg.NoRetryErrorCodes, tt.want) {
+			t.Errorf("NO_RETRY_ERROR_CODES=%q: codes = %v, want %v", tt.value, cfg.NoRetryErrorCodes, tt.want)
+		}
+	}
+}
+
+// checkLogged checks that the log contains want, or that nothing was logged when want is empty
+func checkLogged(t *testing.T, logged, want string) {
+	t.Helper()
+	if want == "" {
+		if logged != "" {
+			t.Errorf("unexpected log output: %s", logged)
+		}
+		return
+	}
+	if !strings.Contains(logged, want) {
+		t.Errorf("log output %q does not mention %q", logged, want)
+	}
+}
@@ -0,0 +1,238 @@
+// Package estimator estimates the prompt tokens of a request without asking upstream.
+//
+// Text is estimated per rune: a CJK character is about one token, other text about one token
+// per four characters. The system instruction, tools and untyped parts (function calls and
+// responses, code) are counted as text; media parts cost a configurable number of tokens per
+// image, second of audio or video and document page. The media costs default to the published
+// rates; the text rules are a rough heuristic, not fitted to countTokens results.
+package estimator
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+// charsPerToken is the average number of characters of a token of non-CJK text
+const charsPerToken = 4
+
+// Estimator estimates the size of requests
+type Estimator struct {
+	costs config.MediaCosts
+}
+
+// New creates an estimator charging media at the given costs
+func New(costs config.MediaCosts) *Estimator {
+	return &Estimator{costs: costs}
+}
+
+// Request estimates the prompt tokens of a request: its contents, system instruction and tools
+func (e *Estimator) Request(request *gemini.GenerateContentRequest) int {
+	tokens := e.content(request.SystemInstruction)
+	for _, content := range request.Contents {
+		tokens += e.content(content)
+	}
+	if tools, ok := request.Extra["tools"]; ok {
+		tokens += JSON(tools)
+	}
+	return tokens
+}
+
+// Text estimates the tokens of a text: one per CJK character, one per charsPerToken other
+// characters
+func Text(text string) int {
+	cjk, other := 0, 0
+	for _, r := range text {
+		if isCJK(r) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	return cjk + (other+charsPerToken-1)/charsPerToken
+}
+
+// isCJK reports whether r is a Chinese, Japanese or Korean character
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// JSON estimates the tokens of a JSON value, e.g. function declarations, from its keys and
+// values counted as text. The punctuation of the encoding is left out.
+func JSON(raw json.RawMessage) int {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return Text(string(raw))
+	}
+	return jsonValue(value)
+}
+
+func jsonValue(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return Text(v)
+	case map[string]interface{}:
+		tokens := 0
+		for key, member := range v {
+			tokens += Text(key) + jsonValue(member)
+		}
+		return tokens
+	case []interface{}:
+		tokens := 0
+		for _, element := range v {
+			tokens += jsonValue(element)
+		}
+		return tokens
+	case nil:
+		return 0
+	default:
+		encoded, _ := json.Marshal(v)
+		return Text(string(encoded))
+	}
+}
+
+func (e *Estimator) content(content *gemini.Content) int {
+	if content == nil {
+		return 0
+	}
+	tokens := 0
+	for _, part := range content.Parts {
+		if part != nil {
+			tokens += e.part(part)
+		}
+	}
+	return tokens
+}
+
+func (e *Estimator) part(part *gemini.Part) int {
+	tokens := Text(part.TextValue())
+	if part.IsFunctionCall() {
+		tokens += JSON(part.FunctionCall)
+	}
+
+	video, _ := member(part.Extra, "videoMetadata", "video_metadata")
+	for key, raw := range part.Extra {
+		switch key {
+		case "inlineData", "inline_data":
+			tokens += e.inlineData(raw, video)
+		case "fileData", "file_data":
+			tokens += e.fileData(raw, video)
+		case "videoMetadata", "video_metadata":
+		default:
+			// functionResponse, executableCode, codeExecutionResult, ...
+			tokens += JSON(raw)
+		}
+	}
+	return tokens
+}
+
+// inlineData estimates embedded media. Inline text documents are counted as their text.
+func (e *Estimator) inlineData(raw, video json.RawMessage) int {
+	mimeType, data := mediaOf(raw)
+	if strings.HasPrefix(mimeType, "text/") {
+		if decoded, err := base64.StdEncoding.DecodeString(data); err == nil {
+			return Text(string(decoded))
+		}
+	}
+	return e.media(mimeType, video)
+}
+
+// fileData estimates uploaded media, which are only known by their MIME type
+func (e *Estimator) fileData(raw, video json.RawMessage) int {
+	mimeType, _ := mediaOf(raw)
+	return e.media(mimeType, video)
+}
+
+// mediaOf returns the lowercased MIME type and the inline data of an inlineData or fileData member
+func mediaOf(raw json.RawMessage) (mimeType, data string) {
+	var members map[string]json.RawMessage
+	json.Unmarshal(raw, &members)
+	if rawType, ok := member(members, "mimeType", "mime_type"); ok {
+		json.Unmarshal(rawType, &mimeType)
+	}
+	if rawData, ok := members["data"]; ok {
+		json.Unmarshal(rawData, &data)
+	}
+	return strings.ToLower(mimeType), data
+}
+
+// media charges one media part by its kind. Video length and frame rate are read from the
+// videoMetadata of the part when set.
+func (e *Estimator) media(mimeType string, video json.RawMessage) int {
+	costs := e.costs
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return costs.ImageTokens
+	case strings.HasPrefix(mimeType, "audio/"):
+		return roundUp(costs.DefaultAudioSeconds * float64(costs.AudioTokensPerSecond))
+	case strings.HasPrefix(mimeType, "video/"):
+		seconds, fps := videoClip(video)
+		if seconds <= 0 {
+			seconds = costs.DefaultVideoSeconds
+		}
+		// The rate covers the frames sampled at the default frame rate and the audio track; the
+		// cost of another frame rate is scaled from it
+		rate := float64(costs.VideoTokensPerSecond)
+		if fps > 0 && costs.VideoFramesPerSecond > 0 {
+			rate *= fps / costs.VideoFramesPerSecond
+		}
+		return roundUp(seconds * rate)
+	default:
+		// PDFs and other documents are rendered page by page
+		return costs.DefaultDocumentPages * costs.DocumentPageTokens
+	}
+}
+
+// videoClip returns the length in seconds and the frame rate set by a videoMetadata member,
+// or 0 for what it leaves out
+func videoClip(raw json.RawMessage) (seconds, fps float64) {
+	if raw == nil {
+		return 0, 0
+	}
+	var metadata map[string]json.RawMessage
+	if json.Unmarshal(raw, &metadata) != nil {
+		return 0, 0
+	}
+
+	if rawFPS, ok := metadata["fps"]; ok {
+		json.Unmarshal(rawFPS, &fps)
+	}
+	start, startOK := member(metadata, "startOffset", "start_offset")
+	end, endOK := member(metadata, "endOffset", "end_offset")
+	if startOK && endOK {
+		seconds = duration(end) - duration(start)
+	}
+	return seconds, fps
+}
+
+// duration parses a protobuf Duration in its JSON form, e.g. "1.5s"
+func duration(raw json.RawMessage) float64 {
+	var text string
+	if json.Unmarshal(raw, &text) != nil {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSuffix(text, "s"), 64)
+	if err != nil {
+		return 0
+	}
+	return seconds
+}
+
+// member looks up a member sent in camelCase or snake_case
+func member(members map[string]json.RawMessage, camel, snake string) (json.RawMessage, bool) {
+	if raw, ok := members[camel]; ok {
+		return raw, true
+	}
+	raw, ok := members[snake]
+	return raw, ok
+}
+
+func roundUp(tokens float64) int {
+	return int(math.Ceil(tokens))
+}
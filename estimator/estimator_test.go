@@ -0,0 +1,98 @@
+package estimator
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"你好世界", 4},
+		{"こんにちは", 5},
+		{"カタカナ", 4},
+		{"안녕하세요", 5},
+		// CJK runes count one each, the rest is rounded up by four
+		{"Go 语言", 2 + 1},
+		{"。，！", 1},
+	}
+
+	for _, tt := range tests {
+		if got := Text(tt.text); got != tt.want {
+			t.Errorf("Text(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{`"abcdefgh"`, 2},
+		{`{"name":"get"}`, 1 + 1},
+		{`{"n":[1,true,null]}`, 1 + 1 + 1},
+		{`not json`, 2},
+	}
+
+	for _, tt := range tests {
+		if got := JSON(json.RawMessage(tt.raw)); got != tt.want {
+			t.Errorf("JSON(%s) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	costs := config.MediaCosts{
+		ImageTokens:          100,
+		AudioTokensPerSecond: 10,
+		VideoTokensPerSecond: 110,
+		VideoFramesPerSecond: 1,
+		DocumentPageTokens:   50,
+		DefaultAudioSeconds:  30,
+		DefaultVideoSeconds:  20,
+		DefaultDocumentPages: 2,
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    int
+	}{
+		{"text", `{"contents":[{"parts":[{"text":"你好"},{"text":"abcd"}]}]}`, 3},
+		{"system instruction", `{"systemInstruction":{"parts":[{"text":"abcd"}]},"contents":[{"parts":[{"text":"abcd"}]}]}`, 2},
+		// functionDeclarations, name and abcd
+		{"tools", `{"contents":[{"parts":[{"text":"abcd"}]}],"tools":[{"functionDeclarations":[{"name":"abcd"}]}]}`, 1 + 7},
+		{"function call", `{"contents":[{"role":"model","parts":[{"functionCall":{"name":"abcd"}}]}]}`, 2},
+		{"function response", `{"contents":[{"parts":[{"functionResponse":{"name":"abcd"}}]}]}`, 2},
+		{"image", `{"contents":[{"parts":[{"inline_data":{"mime_type":"image/PNG","data":"AA=="}}]}]}`, 100},
+		{"inline text document", `{"contents":[{"parts":[{"inlineData":{"mimeType":"text/plain","data":"5L2g5aW9"}}]}]}`, 2},
+		{"audio", `{"contents":[{"parts":[{"fileData":{"mimeType":"audio/mp3","fileUri":"f"}}]}]}`, 300},
+		{"video", `{"contents":[{"parts":[{"fileData":{"mimeType":"video/mp4","fileUri":"f"}}]}]}`, 20 * 110},
+		// 2.5 seconds at twice the default frame rate
+		{"video clip", `{"contents":[{"parts":[{"fileData":{"mimeType":"video/mp4","fileUri":"f"},"videoMetadata":{"startOffset":"1.5s","endOffset":"4s","fps":2}}]}]}`, 550},
+		{"document", `{"contents":[{"parts":[{"fileData":{"mimeType":"application/pdf","fileUri":"f"}}]}]}`, 100},
+	}
+
+	estimator := New(costs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := gemini.ParseRequest([]byte(tt.request))
+			if err != nil {
+				t.Fatalf("invalid request: %v", err)
+			}
+			if got := estimator.Request(request); got != tt.want {
+				t.Errorf("Request() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
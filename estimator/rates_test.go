@@ -0,0 +1,43 @@
+package estimator
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+// rateFixture is a media request with the prompt tokens the published Gemini rates give it
+type rateFixture struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Request     json.RawMessage `json:"request"`
+	Tokens      int             `json:"tokens"`
+	Source      string          `json:"source"`
+}
+
+func TestPublishedRates(t *testing.T) {
+	data, err := os.ReadFile("testdata/rates.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []rateFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatalf("invalid testdata/rates.json: %v", err)
+	}
+
+	estimator := New(config.DefaultMediaCosts)
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			request, err := gemini.ParseRequest(f.Request)
+			if err != nil {
+				t.Fatalf("invalid request: %v", err)
+			}
+			if got := estimator.Request(request); got != f.Tokens {
+				t.Errorf("%s: estimate %d, want %d (%s)", f.Description, got, f.Tokens, f.Source)
+			}
+		})
+	}
+}
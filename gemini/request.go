@@ -0,0 +1,482 @@
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GenerateContentRequest is the body of a generateContent or streamGenerateContent request
+type GenerateContentRequest struct {
+	Contents          []*Content
+	SystemInstruction *Content
+	GenerationConfig  *GenerationConfig
+	// Extra holds the members the proxy does not model (tools, toolConfig, safetySettings,
+	// cachedContent, ...)
+	Extra map[string]json.RawMessage
+}
+
+// GenerationConfig holds the generation settings the proxy reads or rewrites
+type GenerationConfig struct {
+	CandidateCount   int
+	MaxOutputTokens  int
+	ResponseMimeType string
+	// ResponseSchema is the OpenAPI-style response schema, kept as sent
+	ResponseSchema json.RawMessage
+	// ResponseJSONSchema is the JSON Schema response schema, kept as sent
+	ResponseJSONSchema json.RawMessage
+	Extra              map[string]json.RawMessage
+}
+
+// FieldViolation describes one invalid field of a request, as in google.rpc.BadRequest
+type FieldViolation struct {
+	// Field is the path of the field, e.g. contents[2].parts[0].text
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// ValidationError reports the invalid fields of a request
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, violation := range e.Violations {
+		if violation.Field == "" {
+			messages = append(messages, violation.Description)
+			continue
+		}
+		messages = append(messages, violation.Field+": "+violation.Description)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Violations = append(e.Violations, FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)})
+}
+
+// invalidField is the error of a field that does not decode
+func invalidField(field, format string, args ...interface{}) *ValidationError {
+	err := &ValidationError{}
+	err.add(field, format, args...)
+	return err
+}
+
+// ParseRequest decodes a request body. Like the API, it accepts the snake_case spelling of every
+// typed member; system_instruction is merged into systemInstruction. A body that does not have
+// the structure of a request yields a *ValidationError naming the offending field.
+func ParseRequest(data []byte) (*GenerateContentRequest, error) {
+	members, err := requestObject(data, "")
+	if err != nil {
+		return nil, err
+	}
+
+	request := &GenerateContentRequest{}
+	if raw, ok := members.takeOnly("contents"); ok {
+		var contents []json.RawMessage
+		if err := json.Unmarshal(raw, &contents); err != nil {
+			return nil, invalidField("contents", "must be an array of contents")
+		}
+		for i, rawContent := range contents {
+			content, err := parseContent(rawContent, fmt.Sprintf("contents[%d]", i))
+			if err != nil {
+				return nil, err
+			}
+			request.Contents = append(request.Contents, content)
+		}
+	}
+
+	// system_instruction is folded into systemInstruction, its parts first
+	for _, name := range []string{"system_instruction", "systemInstruction"} {
+		raw, ok := members.takeOnly(name)
+		if !ok {
+			continue
+		}
+		instruction, err := parseContent(raw, name)
+		if err != nil {
+			return nil, err
+		}
+		if instruction == nil {
+			continue
+		}
+		if request.SystemInstruction == nil {
+			request.SystemInstruction = instruction
+			continue
+		}
+		request.SystemInstruction.Parts = append(request.SystemInstruction.Parts, instruction.Parts...)
+		for key, value := range instruction.Extra {
+			if request.SystemInstruction.Extra == nil {
+				request.SystemInstruction.Extra = make(map[string]json.RawMessage)
+			}
+			request.SystemInstruction.Extra[key] = value
+		}
+	}
+
+	if raw, name, ok, err := members.take("generationConfig", "generation_config"); err != nil {
+		return nil, err
+	} else if ok && !isNull(raw) {
+		request.GenerationConfig, err = parseGenerationConfig(raw, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request.Extra = members.extra()
+	return request, nil
+}
+
+func parseContent(data json.RawMessage, path string) (*Content, error) {
+	if isNull(data) {
+		return nil, nil
+	}
+	members, err := requestObject(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &Content{}
+	if raw, ok := members.takeOnly("role"); ok {
+		if json.Unmarshal(raw, &content.Role) != nil {
+			return nil, invalidField(path+".role", "must be a string")
+		}
+	}
+	if raw, ok := members.takeOnly("parts"); ok {
+		var parts []json.RawMessage
+		if json.Unmarshal(raw, &parts) != nil {
+			return nil, invalidField(path+".parts", "must be an array of parts")
+		}
+		content.Parts = make([]*Part, 0, len(parts))
+		for i, rawPart := range parts {
+			part, err := parsePart(rawPart, fmt.Sprintf("%s.parts[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			content.Parts = append(content.Parts, part)
+		}
+	}
+	content.Extra = members.extra()
+	return content, nil
+}
+
+func parsePart(data json.RawMessage, path string) (*Part, error) {
+	if isNull(data) {
+		return nil, nil
+	}
+	members, err := requestObject(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &Part{}
+	if raw, ok := members.takeOnly("text"); ok {
+		var text string
+		if json.Unmarshal(raw, &text) != nil {
+			return nil, invalidField(path+".text", "must be a string")
+		}
+		part.Text = &text
+	}
+	if raw, ok := members.takeOnly("thought"); ok {
+		if json.Unmarshal(raw, &part.Thought) != nil {
+			return nil, invalidField(path+".thought", "must be a boolean")
+		}
+	}
+	if raw, name, ok, err := members.take("thoughtSignature", "thought_signature"); err != nil {
+		return nil, prefixed(err, path)
+	} else if ok {
+		if json.Unmarshal(raw, &part.ThoughtSignature) != nil {
+			return nil, invalidField(path+"."+name, "must be a string")
+		}
+	}
+	if raw, _, ok, err := members.take("functionCall", "function_call"); err != nil {
+		return nil, prefixed(err, path)
+	} else if ok && !isNull(raw) {
+		part.FunctionCall = raw
+	}
+	part.Extra = members.extra()
+	return part, nil
+}
+
+func parseGenerationConfig(data json.RawMessage, path string) (*GenerationConfig, error) {
+	members, err := requestObject(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &GenerationConfig{}
+	for _, field := range []struct {
+		camel, snake string
+		target       interface{}
+		kind         string
+	}{
+		{"candidateCount", "candidate_count", &config.CandidateCount, "an integer"},
+		{"maxOutputTokens", "max_output_tokens", &config.MaxOutputTokens, "an integer"},
+		{"responseMimeType", "response_mime_type", &config.ResponseMimeType, "a string"},
+	} {
+		raw, name, ok, err := members.take(field.camel, field.snake)
+		if err != nil {
+			return nil, prefixed(err, path)
+		}
+		if ok && json.Unmarshal(raw, field.target) != nil {
+			return nil, invalidField(path+"."+name, "must be %s", field.kind)
+		}
+	}
+
+	for _, field := range []struct {
+		camel, snake string
+		target       *json.RawMessage
+	}{
+		{"responseSchema", "response_schema", &config.ResponseSchema},
+		{"responseJsonSchema", "response_json_schema", &config.ResponseJSONSchema},
+	} {
+		raw, name, ok, err := members.take(field.camel, field.snake)
+		if err != nil {
+			return nil, prefixed(err, path)
+		}
+		if !ok || isNull(raw) {
+			continue
+		}
+		if raw[0] != '{' {
+			return nil, invalidField(path+"."+name, "must be an object")
+		}
+		*field.target = raw
+	}
+
+	config.Extra = members.extra()
+	return config, nil
+}
+
+// requestObject splits the JSON object at path into its members
+func requestObject(data json.RawMessage, path string) (object, error) {
+	var members object
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, invalidField(path, "invalid JSON payload: %v", err)
+		case path == "":
+			return nil, invalidField(path, "request body must be a JSON object")
+		}
+		return nil, invalidField(path, "must be an object")
+	}
+	return members, nil
+}
+
+// takeOnly removes the member key and returns it
+func (o object) takeOnly(key string) (json.RawMessage, bool) {
+	raw, ok := o[key]
+	delete(o, key)
+	return raw, ok
+}
+
+// take removes a member the API accepts in camelCase and in snake_case and returns it with the
+// spelling used. Setting both is an error, as the API would reject it.
+func (o object) take(camel, snake string) (json.RawMessage, string, bool, error) {
+	camelRaw, hasCamel := o.takeOnly(camel)
+	snakeRaw, hasSnake := o.takeOnly(snake)
+	switch {
+	case hasCamel && hasSnake:
+		return nil, "", false, invalidField(snake, "duplicates %s", camel)
+	case hasSnake:
+		return snakeRaw, snake, true, nil
+	default:
+		return camelRaw, camel, hasCamel, nil
+	}
+}
+
+// extra returns the remaining members, or nil when there are none
+func (o object) extra() map[string]json.RawMessage {
+	if len(o) == 0 {
+		return nil
+	}
+	return o
+}
+
+// prefixed qualifies the field paths of err with the path of the enclosing object
+func prefixed(err error, path string) error {
+	if validationErr, ok := err.(*ValidationError); ok && path != "" {
+		for i := range validationErr.Violations {
+			validationErr.Violations[i].Field = path + "." + validationErr.Violations[i].Field
+		}
+	}
+	return err
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// Validate checks the request the way the API would before any model call, so a malformed
+// request is rejected up front rather than failing every retry
+func (r *GenerateContentRequest) Validate() error {
+	err := &ValidationError{}
+
+	if len(r.Contents) == 0 {
+		err.add("contents", "must contain at least one message")
+	}
+	for i, content := range r.Contents {
+		path := fmt.Sprintf("contents[%d]", i)
+		if content == nil {
+			err.add(path, "must not be null")
+			continue
+		}
+		switch content.Role {
+		case "", "user", "model", "function":
+		default:
+			err.add(path+".role", "must be user, model or function, got %q", content.Role)
+		}
+		validateParts(err, content.Parts, path)
+	}
+
+	if r.SystemInstruction != nil {
+		validateParts(err, r.SystemInstruction.Parts, "systemInstruction")
+	}
+
+	if config := r.GenerationConfig; config != nil {
+		if config.CandidateCount < 0 {
+			err.add("generationConfig.candidateCount", "must not be negative")
+		}
+		if config.MaxOutputTokens < 0 {
+			err.add("generationConfig.maxOutputTokens", "must not be negative")
+		}
+	}
+
+	if len(err.Violations) > 0 {
+		return err
+	}
+	return nil
+}
+
+func validateParts(err *ValidationError, parts []*Part, path string) {
+	if len(parts) == 0 {
+		err.add(path+".parts", "must contain at least one part")
+	}
+	for i, part := range parts {
+		if part == nil {
+			err.add(fmt.Sprintf("%s.parts[%d]", path, i), "must not be null")
+		}
+	}
+}
+
+// Clone returns a deep copy of the request, so a retry body can be rewritten without touching
+// the original
+func (r *GenerateContentRequest) Clone() *GenerateContentRequest {
+	clone := &GenerateContentRequest{
+		SystemInstruction: r.SystemInstruction.Clone(),
+		Extra:             cloneMembers(r.Extra),
+	}
+	if r.Contents != nil {
+		clone.Contents = make([]*Content, len(r.Contents))
+		for i, content := range r.Contents {
+			clone.Contents[i] = content.Clone()
+		}
+	}
+	if r.GenerationConfig != nil {
+		config := *r.GenerationConfig
+		config.ResponseSchema = cloneRaw(config.ResponseSchema)
+		config.ResponseJSONSchema = cloneRaw(config.ResponseJSONSchema)
+		config.Extra = cloneMembers(config.Extra)
+		clone.GenerationConfig = &config
+	}
+	return clone
+}
+
+// Clone returns a deep copy of the content
+func (c *Content) Clone() *Content {
+	if c == nil {
+		return nil
+	}
+	clone := *c
+	clone.Extra = cloneMembers(c.Extra)
+	if c.Parts != nil {
+		clone.Parts = make([]*Part, len(c.Parts))
+		for i, part := range c.Parts {
+			clone.Parts[i] = part.Clone()
+		}
+	}
+	return &clone
+}
+
+// Clone returns a deep copy of the part
+func (p *Part) Clone() *Part {
+	if p == nil {
+		return nil
+	}
+	clone := *p
+	if p.Text != nil {
+		clone.SetText(*p.Text)
+	}
+	clone.FunctionCall = cloneRaw(p.FunctionCall)
+	clone.Extra = cloneMembers(p.Extra)
+	return &clone
+}
+
+func cloneRaw(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	return append(json.RawMessage(nil), raw...)
+}
+
+func cloneMembers(members map[string]json.RawMessage) map[string]json.RawMessage {
+	if members == nil {
+		return nil
+	}
+	clone := make(map[string]json.RawMessage, len(members))
+	for key, raw := range members {
+		clone[key] = cloneRaw(raw)
+	}
+	return clone
+}
+
+// MarshalJSON encodes the request together with Extra
+func (r GenerateContentRequest) MarshalJSON() ([]byte, error) {
+	e := newEncoder(r.Extra, "contents", "systemInstruction", "generationConfig")
+	if r.Contents != nil {
+		e.set("contents", r.Contents)
+	}
+	if r.SystemInstruction != nil {
+		e.set("systemInstruction", r.SystemInstruction)
+	}
+	if r.GenerationConfig != nil {
+		e.set("generationConfig", r.GenerationConfig)
+	}
+	return e.encode()
+}
+
+// MarshalJSON encodes the generation config together with Extra
+func (c GenerationConfig) MarshalJSON() ([]byte, error) {
+	e := newEncoder(c.Extra, "candidateCount", "maxOutputTokens", "responseMimeType", "responseSchema", "responseJsonSchema")
+	if c.CandidateCount != 0 {
+		e.set("candidateCount", c.CandidateCount)
+	}
+	if c.MaxOutputTokens != 0 {
+		e.set("maxOutputTokens", c.MaxOutputTokens)
+	}
+	if c.ResponseMimeType != "" {
+		e.set("responseMimeType", c.ResponseMimeType)
+	}
+	if c.ResponseSchema != nil {
+		e.set("responseSchema", c.ResponseSchema)
+	}
+	if c.ResponseJSONSchema != nil {
+		e.set("responseJsonSchema", c.ResponseJSONSchema)
+	}
+	return e.encode()
+}
+
+// AddSystemInstruction appends a text part to the system instruction, creating it if needed
+func (r *GenerateContentRequest) AddSystemInstruction(text string) {
+	if r.SystemInstruction == nil {
+		r.SystemInstruction = &Content{}
+	}
+	r.SystemInstruction.Parts = append(r.SystemInstruction.Parts, TextPart(text))
+}
+
+// TextPart creates a part holding text
+func TextPart(text string) *Part {
+	part := &Part{}
+	part.SetText(text)
+	return part
+}
@@ -0,0 +1,273 @@
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// jsonEqual reports whether two JSON documents hold the same value
+func jsonEqual(t *testing.T, got, want []byte) bool {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &wantValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	return reflect.DeepEqual(gotValue, wantValue)
+}
+
+func TestParseRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		// want is the body encoded again, when it differs from body
+		want string
+	}{
+		{
+			name: "unknown top-level members",
+			body: `{
+				"contents": [{"role": "user", "parts": [{"text": "Hi"}]}],
+				"tools": [{"functionDeclarations": [{"name": "lookup", "parameters": {"type": "OBJECT"}}]}],
+				"toolConfig": {"functionCallingConfig": {"mode": "AUTO"}},
+				"safetySettings": [{"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_NONE"}],
+				"cachedContent": "cachedContents/abc",
+				"labels": {"team": "search"}
+			}`,
+		},
+		{
+			name: "unknown content members",
+			body: `{
+				"contents": [{"role": "user", "parts": [{"text": "Hi"}], "futureContentField": {"nested": [1, 2]}}],
+				"systemInstruction": {"parts": [{"text": "Be brief."}], "role": "system"}
+			}`,
+		},
+		{
+			name: "unknown part members",
+			body: `{
+				"contents": [
+					{"role": "user", "parts": [
+						{"inlineData": {"mimeType": "image/png", "data": "AA=="}},
+						{"fileData": {"mimeType": "video/mp4", "fileUri": "files/v"}, "videoMetadata": {"startOffset": "1s"}},
+						{"text": "Describe these.", "futurePartField": true}
+					]},
+					{"role": "model", "parts": [
+						{"text": "Thinking", "thought": true, "thoughtSignature": "c2ln"},
+						{"functionCall": {"name": "lookup", "args": {"q": "x"}}},
+						{"executableCode": {"language": "PYTHON", "code": "print(1)"}},
+						{"codeExecutionResult": {"outcome": "OUTCOME_OK", "output": "1"}}
+					]},
+					{"role": "user", "parts": [{"functionResponse": {"name": "lookup", "response": {"ok": true}}}]}
+				]
+			}`,
+		},
+		{
+			name: "unknown generation config members",
+			body: `{
+				"contents": [{"parts": [{"text": "Hi"}]}],
+				"generationConfig": {
+					"candidateCount": 2, "maxOutputTokens": 100, "temperature": 0.2, "topK": 40,
+					"thinkingConfig": {"thinkingBudget": 1024}, "responseMimeType": "application/json",
+					"responseSchema": {"type": "OBJECT"}, "responseJsonSchema": {"type": "object"}
+				}
+			}`,
+		},
+		{
+			name: "snake_case members",
+			body: `{
+				"contents": [{"parts": [{"text": "Hi", "thought_signature": "c2ln"}, {"function_call": {"name": "f"}}]}],
+				"system_instruction": {"parts": [{"text": "First"}]},
+				"systemInstruction": {"parts": [{"text": "Second"}]},
+				"generation_config": {"max_output_tokens": 10, "response_mime_type": "text/plain", "top_p": 0.5},
+				"safety_settings": []
+			}`,
+			want: `{
+				"contents": [{"parts": [{"text": "Hi", "thoughtSignature": "c2ln"}, {"functionCall": {"name": "f"}}]}],
+				"systemInstruction": {"parts": [{"text": "First"}, {"text": "Second"}]},
+				"generationConfig": {"maxOutputTokens": 10, "responseMimeType": "text/plain", "top_p": 0.5},
+				"safety_settings": []
+			}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := ParseRequest([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("ParseRequest: %v", err)
+			}
+			encoded, err := json.Marshal(request)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.body
+			}
+			if !jsonEqual(t, encoded, []byte(want)) {
+				t.Errorf("encoded request:\n%s\nwant:\n%s", encoded, want)
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	body := `{
+		"contents": [
+			{"role": "user", "parts": [{"text": "Hi"}, {"inlineData": {"mimeType": "image/png", "data": "AA=="}}], "extra": {"a": 1}},
+			{"role": "model", "parts": [{"text": "Hello", "thoughtSignature": "c2ln"}, {"functionCall": {"name": "f", "args": {"x": 1}}}]}
+		],
+		"systemInstruction": {"parts": [{"text": "Be brief."}]},
+		"generationConfig": {"maxOutputTokens": 10, "responseSchema": {"type": "OBJECT"}, "temperature": 0.5},
+		"tools": [{"functionDeclarations": [{"name": "f"}]}]
+	}`
+	request, err := ParseRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := json.Marshal(request)
+
+	clone := request.Clone()
+	if encoded, _ := json.Marshal(clone); string(encoded) != string(before) {
+		t.Fatalf("clone encodes as\n%s\nwant\n%s", encoded, before)
+	}
+
+	// Change every level of the clone, in place where the types allow it
+	clone.Contents[0].Role = "model"
+	clone.Contents[0].Parts[0].SetText("Changed")
+	*clone.Contents[1].Parts[0].Text = "Changed in place"
+	clone.Contents[1].Parts[0].ThoughtSignature = ""
+	clone.Contents[1].Parts[1].FunctionCall[2] = 'X'
+	clone.Contents[0].Parts[1].Extra["inlineData"][2] = 'X'
+	clone.Contents[0].Parts = append(clone.Contents[0].Parts[:1], TextPart("Added"))
+	clone.Contents[0].Extra["extra"][1] = 'X'
+	clone.Contents = append(clone.Contents, &Content{Role: "user", Parts: []*Part{TextPart("More")}})
+	clone.SystemInstruction.Parts[0].SetText("Changed")
+	clone.AddSystemInstruction("Added")
+	clone.GenerationConfig.MaxOutputTokens = 5
+	clone.GenerationConfig.ResponseSchema[2] = 'X'
+	clone.GenerationConfig.Extra["temperature"] = json.RawMessage("1")
+	clone.Extra["tools"][1] = 'X'
+	delete(clone.Extra, "tools")
+
+	if after, _ := json.Marshal(request); string(after) != string(before) {
+		t.Errorf("changing the clone changed the original:\n%s\nwas\n%s", after, before)
+	}
+}
+
+func TestParseRequestErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		want  string
+	}{
+		{"not an object", `[]`, "", "request body must be a JSON object"},
+		{"contents not an array", `{"contents": {}}`, "contents", "must be an array of contents"},
+		{"content not an object", `{"contents": [{"parts": [{"text": "a"}]}, "b"]}`, "contents[1]", "must be an object"},
+		{"role not a string", `{"contents": [{"role": 1}]}`, "contents[0].role", "must be a string"},
+		{"parts not an array", `{"contents": [{"parts": "a"}]}`, "contents[0].parts", "must be an array of parts"},
+		{"part not an object", `{"contents": [{"parts": [{"text": "a"}]}, {"parts": ["b"]}]}`, "contents[1].parts[0]", "must be an object"},
+		{"text not a string", `{"contents": [{"parts": [{"text": "a"}, {"text": 1}]}]}`, "contents[0].parts[1].text", "must be a string"},
+		{"thought not a boolean", `{"contents": [{"parts": [{"thought": "yes"}]}]}`, "contents[0].parts[0].thought", "must be a boolean"},
+		{"thought_signature not a string", `{"contents": [{"parts": [{"thought_signature": 1}]}]}`, "contents[0].parts[0].thought_signature", "must be a string"},
+		{"duplicated part member", `{"contents": [{"parts": [{"text": "a"}]}, {"parts": [{"functionCall": {}, "function_call": {}}]}]}`, "contents[1].parts[0].function_call", "duplicates functionCall"},
+		{"system instruction parts", `{"system_instruction": {"parts": [1]}}`, "system_instruction.parts[0]", "must be an object"},
+		{"generation config not an object", `{"generationConfig": 1}`, "generationConfig", "must be an object"},
+		{"generation config integer", `{"generation_config": {"max_output_tokens": "many"}}`, "generation_config.max_output_tokens", "must be an integer"},
+		{"generation config string", `{"generationConfig": {"responseMimeType": 1}}`, "generationConfig.responseMimeType", "must be a string"},
+		{"response schema", `{"generationConfig": {"responseSchema": []}}`, "generationConfig.responseSchema", "must be an object"},
+		{"duplicated generation config member", `{"generationConfig": {"candidateCount": 1, "candidate_count": 2}}`, "generationConfig.candidate_count", "duplicates candidateCount"},
+		{"duplicated generation config", `{"generationConfig": {}, "generation_config": {}}`, "generation_config", "duplicates generationConfig"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRequest([]byte(tt.body))
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("ParseRequest error = %v, want a *ValidationError", err)
+			}
+			want := []FieldViolation{{Field: tt.field, Description: tt.want}}
+			if !reflect.DeepEqual(validationErr.Violations, want) {
+				t.Errorf("violations = %+v, want %+v", validationErr.Violations, want)
+			}
+		})
+	}
+}
+
+func TestParseRequestInvalidJSON(t *testing.T) {
+	_, err := ParseRequest([]byte(`{"contents": [`))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Violations) != 1 {
+		t.Fatalf("ParseRequest error = %v, want one violation", err)
+	}
+	// The description carries the decoder's message
+	if violation := validationErr.Violations[0]; violation.Field != "" || !strings.HasPrefix(violation.Description, "invalid JSON payload: ") {
+		t.Errorf("violation = %+v, want an invalid JSON payload of the body", violation)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []FieldViolation
+	}{
+		{"valid", `{"contents": [{"role": "user", "parts": [{"text": "a"}]}, {"role": "model", "parts": [{"text": "b"}]}, {"role": "function", "parts": [{"functionResponse": {}}]}, {"parts": [{"text": "c"}]}]}`, nil},
+		{"no contents", `{}`, []FieldViolation{{"contents", "must contain at least one message"}}},
+		{"empty contents", `{"contents": []}`, []FieldViolation{{"contents", "must contain at least one message"}}},
+		{"null content", `{"contents": [{"parts": [{"text": "a"}]}, null]}`, []FieldViolation{{"contents[1]", "must not be null"}}},
+		{"unknown role", `{"contents": [{"role": "system", "parts": [{"text": "a"}]}]}`, []FieldViolation{{"contents[0].role", `must be user, model or function, got "system"`}}},
+		{"no parts", `{"contents": [{"role": "user"}]}`, []FieldViolation{{"contents[0].parts", "must contain at least one part"}}},
+		{"null part", `{"contents": [{"parts": [{"text": "a"}]}, {"parts": [{"text": "b"}, null]}]}`, []FieldViolation{{"contents[1].parts[1]", "must not be null"}}},
+		{"empty system instruction", `{"contents": [{"parts": [{"text": "a"}]}], "systemInstruction": {"parts": []}}`, []FieldViolation{{"systemInstruction.parts", "must contain at least one part"}}},
+		{"negative counts", `{"contents": [{"parts": [{"text": "a"}]}], "generationConfig": {"candidateCount": -1, "maxOutputTokens": -2}}`, []FieldViolation{
+			{"generationConfig.candidateCount", "must not be negative"},
+			{"generationConfig.maxOutputTokens", "must not be negative"},
+		}},
+		{"several violations", `{"contents": [{"role": "tool", "parts": []}, {"parts": [null]}]}`, []FieldViolation{
+			{"contents[0].role", `must be user, model or function, got "tool"`},
+			{"contents[0].parts", "must contain at least one part"},
+			{"contents[1].parts[0]", "must not be null"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := ParseRequest([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("ParseRequest: %v", err)
+			}
+			err = request.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			if !reflect.DeepEqual(validationErr.Violations, tt.want) {
+				t.Errorf("violations = %+v, want %+v", validationErr.Violations, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := &ValidationError{Violations: []FieldViolation{
+		{Field: "", Description: "request body must be a JSON object"},
+		{Field: "contents[1].parts[0]", Description: "must not be null"},
+	}}
+	want := "invalid request: request body must be a JSON object; contents[1].parts[0]: must not be null"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package gemini
+
+import (
+	"encoding/json"
+)
+
+// GenerateContentResponse is a generateContent response, or one chunk of a streamGenerateContent response
+type GenerateContentResponse struct {
+	Candidates     []*Candidate    `json:"candidates"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback"`
+	UsageMetadata  *UsageMetadata  `json:"usageMetadata"`
+	// Extra holds the members the type does not model. It stays empty for parsed responses,
+	// whose members are kept in their source instead.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	src *source
+}
+
+// The members of each response type that are typed
+var (
+	responseMembers  = []string{"candidates", "promptFeedback", "usageMetadata"}
+	candidateMembers = []string{"content", "finishReason", "index"}
+	partMembers      = []string{"text", "thought", "thoughtSignature", "functionCall"}
+)
+
+// ParseResponse decodes a response. Unlike json.Unmarshal, it keeps the members the types do
+// not model (modelVersion, safetyRatings, functionCall arguments, ...) for re-encoding.
+func ParseResponse(data []byte) (*GenerateContentResponse, error) {
+	var response GenerateContentResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+
+	src := &source{data: data}
+	response.src = src
+	if response.PromptFeedback != nil {
+		response.PromptFeedback.src = src
+	}
+	if response.UsageMetadata != nil {
+		response.UsageMetadata.src = src
+	}
+	for i, candidate := range response.Candidates {
+		if candidate == nil {
+			continue
+		}
+		candidate.src, candidate.pos = src, i
+		if candidate.Content == nil {
+			continue
+		}
+		candidate.Content.src, candidate.Content.candidate = src, i
+		for j, part := range candidate.Content.Parts {
+			if part != nil {
+				part.src, part.candidate, part.pos = src, i, j
+			}
+		}
+	}
+	return &response, nil
+}
+
+// FirstCandidate returns the first candidate of the response, or nil when there is none
+func (r *GenerateContentResponse) FirstCandidate() *Candidate {
+	if len(r.Candidates) == 0 {
+		return nil
+	}
+	return r.Candidates[0]
+}
+
+// FinishReason returns the finish reason of the first candidate, or "" while it is still generating
+func (r *GenerateContentResponse) FinishReason() string {
+	if candidate := r.FirstCandidate(); candidate != nil {
+		return candidate.FinishReason
+	}
+	return ""
+}
+
+// Blocked reports whether upstream blocked the prompt
+func (r *GenerateContentResponse) Blocked() bool {
+	return r.PromptFeedback != nil && r.PromptFeedback.BlockReason != ""
+}
+
+// SplitCandidates returns one response per candidate, each keeping the untyped members
+// (modelVersion, responseId, ...). promptFeedback and usageMetadata concern all candidates, so
+// they follow in a response of their own without candidates.
+func (r *GenerateContentResponse) SplitCandidates() []*GenerateContentResponse {
+	responses := make([]*GenerateContentResponse, 0, len(r.Candidates)+1)
+	for _, candidate := range r.Candidates {
+		responses = append(responses, &GenerateContentResponse{Candidates: []*Candidate{candidate}, Extra: r.Extra, src: r.src})
+	}
+	if r.PromptFeedback != nil || r.UsageMetadata != nil {
+		responses = append(responses, &GenerateContentResponse{PromptFeedback: r.PromptFeedback, UsageMetadata: r.UsageMetadata, Extra: r.Extra, src: r.src})
+	}
+	return responses
+}
+
+// Untyped returns the members of the response the type does not model (modelVersion,
+// responseId, ...)
+func (r *GenerateContentResponse) Untyped() map[string]json.RawMessage {
+	if r.src != nil {
+		return r.src.members().without(responseMembers)
+	}
+	return r.Extra
+}
+
+// MarshalJSON encodes the response together with its untyped members
+func (r GenerateContentResponse) MarshalJSON() ([]byte, error) {
+	e := newEncoder(r.Untyped(), responseMembers...)
+	if r.Candidates != nil {
+		e.set("candidates", r.Candidates)
+	}
+	if r.PromptFeedback != nil {
+		e.set("promptFeedback", r.PromptFeedback)
+	}
+	if r.UsageMetadata != nil {
+		e.set("usageMetadata", r.UsageMetadata)
+	}
+	return e.encode()
+}
+
+// Candidate is one response candidate
+type Candidate struct {
+	Content      *Content `json:"content"`
+	FinishReason string   `json:"finishReason"`
+	// Index is the position of the candidate; upstream omits it for the first one
+	Index int `json:"index"`
+	// Extra holds the members the type does not model. It stays empty for parsed responses,
+	// whose members are kept in their source instead.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	src *source
+	pos int
+}
+
+// Parts returns the parts of the candidate's content
+func (c *Candidate) Parts() []*Part {
+	if c.Content == nil {
+		return nil
+	}
+	return c.Content.Parts
+}
+
+// Untyped returns the members of the candidate the type does not model (safetyRatings,
+// citationMetadata, groundingMetadata, ...)
+func (c *Candidate) Untyped() map[string]json.RawMessage {
+	if src := c.src.candidate(c.pos); src != nil {
+		return src.candidate.without(candidateMembers)
+	}
+	return c.Extra
+}
+
+// MarshalJSON encodes the candidate together with its untyped members
+func (c Candidate) MarshalJSON() ([]byte, error) {
+	e := newEncoder(c.Untyped(), candidateMembers...)
+	if c.Content != nil {
+		e.set("content", c.Content)
+	}
+	if c.FinishReason != "" {
+		e.set("finishReason", c.FinishReason)
+	}
+	if c.Index != 0 {
+		e.set("index", c.Index)
+	}
+	return e.encode()
+}
+
+// Content is a conversation turn: a role and its ordered parts
+type Content struct {
+	Role  string  `json:"role"`
+	Parts []*Part `json:"parts"`
+	// Extra holds the members the type does not model. It stays empty for parsed responses,
+	// whose members are kept in their source instead.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	src       *source
+	candidate int
+}
+
+// MarshalJSON encodes the content together with its untyped members
+func (c Content) MarshalJSON() ([]byte, error) {
+	members := object(c.Extra)
+	if src := c.src.candidate(c.candidate); src != nil {
+		members = src.contentMembers()
+	}
+
+	e := newEncoder(members, "role", "parts")
+	if c.Role != "" {
+		e.set("role", c.Role)
+	}
+	if c.Parts != nil {
+		e.set("parts", c.Parts)
+	}
+	return e.encode()
+}
+
+// Part is one part of a content. Text and function call parts are typed; every other kind of
+// part (executableCode, inlineData, functionResponse, ...) is kept untyped.
+type Part struct {
+	// Text is nil for parts that carry no text
+	Text    *string `json:"text"`
+	Thought bool    `json:"thought"`
+	// ThoughtSignature is the model's opaque reasoning signature attached to the part
+	ThoughtSignature string          `json:"thoughtSignature"`
+	FunctionCall     json.RawMessage `json:"functionCall"`
+	// Extra holds the members the type does not model. It stays empty for parsed responses,
+	// whose members are kept in their source instead.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	src       *source
+	candidate int
+	pos       int
+}
+
+// HasText reports whether the part carries text, possibly empty
+func (p *Part) HasText() bool {
+	return p.Text != nil
+}
+
+// TextValue returns the text of the part, or "" when it carries none
+func (p *Part) TextValue() string {
+	if p.Text == nil {
+		return ""
+	}
+	return *p.Text
+}
+
+// SetText replaces the text of the part
+func (p *Part) SetText(text string) {
+	p.Text = &text
+}
+
+// IsFunctionCall reports whether the part is a function call
+func (p *Part) IsFunctionCall() bool {
+	return len(p.FunctionCall) > 0
+}
+
+// Untyped returns the members of the part the type does not model (inlineData,
+// executableCode, ...)
+func (p *Part) Untyped() map[string]json.RawMessage {
+	if src := p.src.candidate(p.candidate); src != nil {
+		if parts := src.partMembers(); p.pos < len(parts) {
+			return parts[p.pos].without(partMembers)
+		}
+	}
+	return p.Extra
+}
+
+// MarshalJSON encodes the part together with its untyped members
+func (p Part) MarshalJSON() ([]byte, error) {
+	e := newEncoder(p.Untyped(), partMembers...)
+	if p.Text != nil {
+		e.set("text", *p.Text)
+	}
+	if p.Thought {
+		e.set("thought", true)
+	}
+	if p.ThoughtSignature != "" {
+		e.set("thoughtSignature", p.ThoughtSignature)
+	}
+	if len(p.FunctionCall) > 0 {
+		e.set("functionCall", p.FunctionCall)
+	}
+	return e.encode()
+}
+
+// PromptFeedback reports why a prompt was blocked
+type PromptFeedback struct {
+	BlockReason string `json:"blockReason"`
+
+	src *source
+}
+
+// MarshalJSON encodes the feedback together with the untyped members of its source (safetyRatings)
+func (f PromptFeedback) MarshalJSON() ([]byte, error) {
+	var members object
+	if f.src != nil {
+		members = f.src.member("promptFeedback")
+	}
+
+	e := newEncoder(members, "blockReason")
+	if f.BlockReason != "" {
+		e.set("blockReason", f.BlockReason)
+	}
+	return e.encode()
+}
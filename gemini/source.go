@@ -0,0 +1,156 @@
+// Package gemini models the Gemini API payloads the proxy inspects and rewrites.
+//
+// Only the members the proxy works with are typed, so decoding a payload is a single pass of
+// encoding/json over plain structs. A payload decoded with ParseResponse remembers its source:
+// when it is encoded again after a modification, every member the types do not model is
+// recovered from the source, so nothing upstream sent is lost.
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// object is a JSON object split into its raw members
+type object map[string]json.RawMessage
+
+func decodeObject(data json.RawMessage) object {
+	var members object
+	if len(data) > 0 {
+		json.Unmarshal(data, &members)
+	}
+	return members
+}
+
+// without returns the members of o except the given ones, or nil when there are no others
+func (o object) without(keys []string) object {
+	var members object
+	for key, raw := range o {
+		if contains(keys, key) {
+			continue
+		}
+		if members == nil {
+			members = make(object, len(o))
+		}
+		members[key] = raw
+	}
+	return members
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// source is the payload a response was parsed from. Its members are only split up when a
+// modified response is encoded or its untyped members are asked for, which is rare compared to
+// inspecting one, and then only down to the objects asked for.
+type source struct {
+	data []byte
+	// response is nil until the payload is split up
+	response   object
+	candidates []sourceCandidate
+	split      bool
+}
+
+type sourceCandidate struct {
+	candidate object
+	// content and parts are nil until they are asked for
+	content object
+	parts   []object
+}
+
+// members returns the members of the response
+func (s *source) members() object {
+	if s.response == nil {
+		s.response = decodeObject(s.data)
+	}
+	return s.response
+}
+
+// member returns the members of the object held by the response member key, e.g. usageMetadata
+func (s *source) member(key string) object {
+	return decodeObject(s.members()[key])
+}
+
+// candidate returns the source members of the candidate at position i, or nil
+func (s *source) candidate(i int) *sourceCandidate {
+	if s == nil {
+		return nil
+	}
+	if !s.split {
+		var candidates []object
+		json.Unmarshal(s.members()["candidates"], &candidates)
+		for _, candidate := range candidates {
+			s.candidates = append(s.candidates, sourceCandidate{candidate: candidate})
+		}
+		s.split = true
+	}
+	if i < 0 || i >= len(s.candidates) {
+		return nil
+	}
+	return &s.candidates[i]
+}
+
+// contentMembers returns the members of the candidate's content
+func (c *sourceCandidate) contentMembers() object {
+	if c.content == nil {
+		c.content = decodeObject(c.candidate["content"])
+	}
+	return c.content
+}
+
+// partMembers returns the members of each part of the candidate's content
+func (c *sourceCandidate) partMembers() []object {
+	if c.parts == nil {
+		var content struct {
+			Parts []object `json:"parts"`
+		}
+		json.Unmarshal(c.candidate["content"], &content)
+		c.parts = append(make([]object, 0, len(content.Parts)), content.Parts...)
+	}
+	return c.parts
+}
+
+// encoder builds a JSON object from the source members of a value, overridden by its typed members
+type encoder struct {
+	members object
+	err     error
+}
+
+// newEncoder starts from the source members, leaving out the typed ones: those are set from
+// the value, so a typed member the proxy cleared is dropped
+func newEncoder(src object, typed ...string) *encoder {
+	members := make(object, len(src)+len(typed))
+	for key, raw := range src {
+		members[key] = raw
+	}
+	for _, key := range typed {
+		delete(members, key)
+	}
+	return &encoder{members: members}
+}
+
+// set encodes v as the member key
+func (e *encoder) set(key string, v interface{}) {
+	if e.err != nil {
+		return
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		e.err = fmt.Errorf("invalid %s: %w", key, err)
+		return
+	}
+	e.members[key] = raw
+}
+
+func (e *encoder) encode() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return json.Marshal(e.members)
+}
@@ -0,0 +1,129 @@
+package gemini
+
+import (
+	"encoding/json"
+)
+
+// usageCounts are the members of UsageMetadata that are typed
+var usageCounts = []string{"promptTokenCount", "candidatesTokenCount", "thoughtsTokenCount", "totalTokenCount"}
+
+// UsageMetadata holds the token counts of a response. Within a stream every chunk reports the
+// running total of the request.
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+	// Extra holds the members the type does not model. It stays empty for parsed responses,
+	// whose members are kept in their source instead.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	src *source
+}
+
+// untyped returns the members the type does not model
+func (u *UsageMetadata) untyped() object {
+	if u.src != nil {
+		return u.src.member("usageMetadata")
+	}
+	return u.Extra
+}
+
+// MarshalJSON encodes the counts together with the untyped members (per-modality details,
+// cached and tool use counts)
+func (u UsageMetadata) MarshalJSON() ([]byte, error) {
+	e := newEncoder(u.untyped(), usageCounts...)
+	for _, count := range []struct {
+		key   string
+		value int
+	}{
+		{"promptTokenCount", u.PromptTokenCount},
+		{"candidatesTokenCount", u.CandidatesTokenCount},
+		{"thoughtsTokenCount", u.ThoughtsTokenCount},
+		{"totalTokenCount", u.TotalTokenCount},
+	} {
+		if count.value != 0 {
+			e.set(count.key, count.value)
+		}
+	}
+	return e.encode()
+}
+
+// SumUsage adds up the usage of several requests, e.g. the attempts of a retried stream. Counts
+// are added, per-modality details are added by modality, and any other member takes the value
+// of the last report that has it. Nil reports are skipped; SumUsage returns nil if all are.
+func SumUsage(reports ...*UsageMetadata) *UsageMetadata {
+	var sum *UsageMetadata
+	for _, u := range reports {
+		if u == nil {
+			continue
+		}
+		if sum == nil {
+			sum = &UsageMetadata{Extra: make(map[string]json.RawMessage)}
+		}
+
+		sum.PromptTokenCount += u.PromptTokenCount
+		sum.CandidatesTokenCount += u.CandidatesTokenCount
+		sum.ThoughtsTokenCount += u.ThoughtsTokenCount
+		sum.TotalTokenCount += u.TotalTokenCount
+		for key, raw := range u.untyped() {
+			if isUsageCount(key) {
+				continue
+			}
+			sum.Extra[key] = addUsageMember(sum.Extra[key], raw)
+		}
+	}
+	return sum
+}
+
+func isUsageCount(key string) bool {
+	for _, count := range usageCounts {
+		if key == count {
+			return true
+		}
+	}
+	return false
+}
+
+// modalityTokenCount is one entry of the per-modality details of a usage report
+type modalityTokenCount struct {
+	Modality   string `json:"modality"`
+	TokenCount int    `json:"tokenCount"`
+}
+
+// addUsageMember adds two values of an untyped usage member: numbers and per-modality details
+// are summed, anything else is replaced by b
+func addUsageMember(a, b json.RawMessage) json.RawMessage {
+	if a == nil {
+		return b
+	}
+
+	var x, y float64
+	if json.Unmarshal(a, &x) == nil && json.Unmarshal(b, &y) == nil {
+		if sum, err := json.Marshal(x + y); err == nil {
+			return sum
+		}
+		return b
+	}
+
+	var xs, ys []modalityTokenCount
+	if json.Unmarshal(a, &xs) == nil && json.Unmarshal(b, &ys) == nil {
+		counts := make(map[string]int)
+		var order []string
+		for _, entry := range append(xs, ys...) {
+			if _, seen := counts[entry.Modality]; !seen {
+				order = append(order, entry.Modality)
+			}
+			counts[entry.Modality] += entry.TokenCount
+		}
+
+		merged := make([]modalityTokenCount, 0, len(order))
+		for _, modality := range order {
+			merged = append(merged, modalityTokenCount{Modality: modality, TokenCount: counts[modality]})
+		}
+		if sum, err := json.Marshal(merged); err == nil {
+			return sum
+		}
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+package gemini
+
+import (
+	"testing"
+)
+
+// usageOf parses the usageMetadata of a response chunk
+func usageOf(t *testing.T, usage string) *UsageMetadata {
+	t.Helper()
+	response, err := ParseResponse([]byte(`{"usageMetadata": ` + usage + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.UsageMetadata
+}
+
+func TestSumUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		reports []string
+		want    string
+	}{
+		{
+			name:    "single report",
+			reports: []string{`{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}`},
+			want:    `{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}`,
+		},
+		{
+			name: "counts",
+			reports: []string{
+				`{"promptTokenCount": 10, "candidatesTokenCount": 5, "thoughtsTokenCount": 2, "totalTokenCount": 17}`,
+				`{"promptTokenCount": 20, "candidatesTokenCount": 7, "totalTokenCount": 27}`,
+			},
+			want: `{"promptTokenCount": 30, "candidatesTokenCount": 12, "thoughtsTokenCount": 2, "totalTokenCount": 44}`,
+		},
+		{
+			name: "untyped counts and modality details",
+			reports: []string{
+				`{"promptTokenCount": 268, "totalTokenCount": 268, "cachedContentTokenCount": 100, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 10}, {"modality": "IMAGE", "tokenCount": 258}]}`,
+				`{"promptTokenCount": 20, "totalTokenCount": 20, "cachedContentTokenCount": 4, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 20}]}`,
+			},
+			want: `{"promptTokenCount": 288, "totalTokenCount": 288, "cachedContentTokenCount": 104, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 30}, {"modality": "IMAGE", "tokenCount": 258}]}`,
+		},
+		{
+			name: "other members keep the last value",
+			reports: []string{
+				`{"totalTokenCount": 1, "trafficType": "ON_DEMAND"}`,
+				`{"totalTokenCount": 2, "trafficType": "PROVISIONED_THROUGHPUT"}`,
+			},
+			want: `{"totalTokenCount": 3, "trafficType": "PROVISIONED_THROUGHPUT"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reports []*UsageMetadata
+			for _, report := range tt.reports {
+				reports = append(reports, usageOf(t, report))
+			}
+			sum, err := SumUsage(reports...).MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, sum, []byte(tt.want)) {
+				t.Errorf("SumUsage = %s, want %s", sum, tt.want)
+			}
+		})
+	}
+}
+
+func TestSumUsageNil(t *testing.T) {
+	if sum := SumUsage(nil, nil); sum != nil {
+		t.Errorf("SumUsage(nil, nil) = %+v, want nil", sum)
+	}
+	report := usageOf(t, `{"totalTokenCount": 5}`)
+	if sum := SumUsage(nil, report, nil); sum == nil || sum.TotalTokenCount != 5 {
+		t.Errorf("SumUsage skipping nil reports = %+v, want a total of 5", sum)
+	}
+}
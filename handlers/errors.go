@@ -3,6 +3,8 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+
+	"gemini-antiblock/gemini"
 )
 
 // ErrorResponse represents a standardized error response
@@ -60,10 +62,22 @@ func JSONError(w http.ResponseWriter, status int, message string, details interf
 	json.NewEncoder(w).Encode(errorResp)
 }
 
+// InvalidArgumentError writes a 400 INVALID_ARGUMENT response listing the invalid fields of a
+// request as google.rpc.BadRequest field violations, like the Gemini API does
+func InvalidArgumentError(w http.ResponseWriter, err *gemini.ValidationError) {
+	JSONError(w, 400, err.Error(), []interface{}{
+		map[string]interface{}{
+			"@type":           "type.googleapis.com/google.rpc.BadRequest",
+			"fieldViolations": err.Violations,
+		},
+	})
+}
+
 // HandleCORS handles CORS preflight requests
 func HandleCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key, "+CompletionDetectorHeader+", "+LanguageHeader)
+	w.Header().Set("Access-Control-Expose-Headers", ModelHeader)
 	w.WriteHeader(http.StatusOK)
 }
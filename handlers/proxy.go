@@ -10,21 +10,34 @@ import (
 	"strings"
 
 	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
 	"gemini-antiblock/logger"
 	"gemini-antiblock/streaming"
 )
 
+// CompletionDetectorHeader lets a client choose the completion detector for a single request
+const CompletionDetectorHeader = "X-Antiblock-Completion-Detector"
+
+// LanguageHeader lets a client choose the language of the injected completion instruction
+const LanguageHeader = "X-Antiblock-Language"
+
+// ModelHeader reports the model that finished the answer, which differs from the requested one
+// after a fallback. Streaming responses send it as a trailer.
+const ModelHeader = "X-Antiblock-Model"
+
 // ProxyHandler handles proxy requests to Gemini API
 type ProxyHandler struct {
-	Config      *config.Config
-	RateLimiter *RateLimiter
+	Config       *config.Config
+	RateLimiter  *RateLimiter
+	TokenCounter *TokenCounter
 }
 
 // NewProxyHandler creates a new proxy handler
 func NewProxyHandler(cfg *config.Config, rateLimiter *RateLimiter) *ProxyHandler {
 	return &ProxyHandler{
-		Config:      cfg,
-		RateLimiter: rateLimiter,
+		Config:       cfg,
+		RateLimiter:  rateLimiter,
+		TokenCounter: NewTokenCounter(cfg),
 	}
 }
 
@@ -49,150 +62,105 @@ func (h *ProxyHandler) BuildUpstreamHeaders(reqHeaders http.Header) http.Header
 	return headers
 }
 
-// InjectSystemPrompt injects a system prompt to ensure the [done] token is present.
-// It intelligently handles both system_instruction (snake_case) and systemInstruction (camelCase)
-// by merging the content of system_instruction into systemInstruction before processing.
-// systemInstruction is the officially recommended format.
-func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
-	newSystemPromptPart := map[string]interface{}{
-		"text": "IMPORTANT: At the very end of your entire response, you must write the token [done] to signal completion. This is a mandatory technical requirement.",
-	}
-
-	// Standardize: If system_instruction exists, merge its content into systemInstruction.
-	if snakeVal, snakeExists := body["system_instruction"]; snakeExists {
-		// Ensure camelCase map exists
-		camelMap, _ := body["systemInstruction"].(map[string]interface{})
-		if camelMap == nil {
-			camelMap = make(map[string]interface{})
-		}
-
-		// Ensure camelCase parts array exists
-		camelParts, _ := camelMap["parts"].([]interface{})
-		if camelParts == nil {
-			camelParts = make([]interface{}, 0)
-		}
-
-		// If snake_case is a valid map with its own parts, prepend them to camelCase parts
-		if snakeMap, snakeOk := snakeVal.(map[string]interface{}); snakeOk {
-			if snakeParts, snakePartsOk := snakeMap["parts"].([]interface{}); snakePartsOk {
-				camelParts = append(snakeParts, camelParts...)
-			}
-		}
-
-		// Update the camelCase field with the merged parts and delete the snake_case one
-		camelMap["parts"] = camelParts
-		body["systemInstruction"] = camelMap
-		delete(body, "system_instruction")
-	}
-
-	// --- From this point on, we only need to deal with systemInstruction ---
-
-	// Case 1: systemInstruction field is missing or null. Create it.
-	if val, exists := body["systemInstruction"]; !exists || val == nil {
-		body["systemInstruction"] = map[string]interface{}{
-			"parts": []interface{}{newSystemPromptPart},
-		}
-		return
-	}
-
-	instruction, ok := body["systemInstruction"].(map[string]interface{})
-	if !ok {
-		// The field exists but is of the wrong type. Overwrite it.
-		body["systemInstruction"] = map[string]interface{}{
-			"parts": []interface{}{newSystemPromptPart},
-		}
-		return
-	}
-
-	// Case 2: The instruction field exists, but its 'parts' array is missing, null, or not an array.
-	parts, ok := instruction["parts"].([]interface{})
-	if !ok {
-		instruction["parts"] = []interface{}{newSystemPromptPart}
-		return
-	}
-
-	// Case 3: The instruction field and its 'parts' array both exist. Append to the existing array.
-	instruction["parts"] = append(parts, newSystemPromptPart)
+// InjectSystemPrompt appends the completion detector's instruction (e.g. "end with [done]") to the system prompt.
+// A system_instruction sent in snake_case has already been merged into systemInstruction when
+// the request was parsed, so the instruction always lands in systemInstruction, the officially
+// recommended format.
+func (h *ProxyHandler) InjectSystemPrompt(request *gemini.GenerateContentRequest, promptText string) {
+	request.AddSystemInstruction(promptText)
 }
 
-// HandleStreamingPost handles streaming POST requests
-func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
-	urlObj, _ := url.Parse(r.URL.String())
-	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
-	if urlObj.RawQuery != "" {
-		upstreamURL += "?" + urlObj.RawQuery
-	}
-
-	logger.LogInfo("=== NEW STREAMING REQUEST ===")
-	logger.LogInfo("Upstream URL:", upstreamURL)
-	logger.LogInfo("Request method:", r.Method)
-	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
-
+// prepareAntiblockRequest reads and validates the request body, picks the completion detector
+// and the resume strategy, and injects the detector's instruction. When the request is rejected
+// the error response has already been written and ok is false.
+func (h *ProxyHandler) prepareAntiblockRequest(w http.ResponseWriter, r *http.Request) (requestBody *gemini.GenerateContentRequest, detector streaming.CompletionDetector, strategy streaming.ResumeStrategy, ok bool) {
 	// Read and parse request body
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		logger.LogError("Failed to read request body:", err)
 		JSONError(w, 400, "Failed to read request body", err.Error())
-		return
+		return nil, nil, strategy, false
 	}
 
-	var requestBody map[string]interface{}
-	if err := json.Unmarshal(bodyBytes, &requestBody); err != nil {
-		logger.LogError("Failed to parse request body:", err)
-		JSONError(w, 400, "Invalid JSON in request body", err.Error())
-		return
+	requestBody, err = gemini.ParseRequest(bodyBytes)
+	if err == nil {
+		err = requestBody.Validate()
 	}
-
-	logger.LogDebug(fmt.Sprintf("Request body size: %d bytes", len(bodyBytes)))
-
-	if contents, ok := requestBody["contents"].([]interface{}); ok {
-		if len(contents) == 0 {
-			logger.LogError("Request contains empty contents array")
-			JSONError(w, 400, "Request must contain at least one message in contents", "empty_contents")
-			return
+	if err != nil {
+		logger.LogError("Invalid request body:", err)
+		if validationErr, ok := err.(*gemini.ValidationError); ok {
+			InvalidArgumentError(w, validationErr)
+		} else {
+			JSONError(w, 400, "Invalid JSON in request body", err.Error())
 		}
-		logger.LogDebug(fmt.Sprintf("Parsed request body with %d messages", len(contents)))
-	} else {
-		// contents字段不存在或类型错误
-		logger.LogError("Request missing or invalid contents field")
-		JSONError(w, 400, "Request must contain valid contents field", "missing_contents")
-		return
+		return nil, nil, strategy, false
 	}
 
+	logger.LogDebug(fmt.Sprintf("Request body size: %d bytes", len(bodyBytes)))
+	logger.LogDebug(fmt.Sprintf("Parsed request body with %d messages", len(requestBody.Contents)))
+
 	// === TOKEN LIMIT CHECK START ===
 	modelName := extractModelFromPath(r.URL.Path)
 	if modelName != "" {
 		if maxTokens, ok := h.Config.GeminiModelMaxTokens[modelName]; ok {
-			estimatedTokens := estimateTokenCount(requestBody)
-			logger.LogDebug(fmt.Sprintf("Model: %s, Max Tokens: %d, Estimated Tokens: %d", modelName, maxTokens, estimatedTokens))
-			if estimatedTokens > maxTokens {
-				logger.LogError(fmt.Sprintf("Token limit exceeded for model %s. Limit: %d, Estimated: %d", modelName, maxTokens, estimatedTokens))
+			tokens, source := h.TokenCounter.Count(r.Context(), h.countTokensURL(r), h.BuildUpstreamHeaders(r.Header), modelName, requestBody)
+			logger.LogDebug(fmt.Sprintf("Model: %s, Max Tokens: %d, Tokens: %d (%s)", modelName, maxTokens, tokens, source))
+			if tokens > maxTokens {
+				logger.LogError(fmt.Sprintf("Token limit exceeded for model %s. Limit: %d, Counted: %d (%s)", modelName, maxTokens, tokens, source))
 				JSONError(w, h.Config.TokenLimitExceededCode, h.Config.TokenLimitExceededMessage, "token_limit_exceeded")
-				return
+				return nil, nil, strategy, false
 			}
 		}
 	}
 	// === TOKEN LIMIT CHECK END ===
 
-	// Inject system prompt
-	h.InjectSystemPrompt(requestBody)
+	// Pick the language of the sentinel instruction: per request or detected from the last user message
+	language := strings.ToLower(strings.TrimSpace(r.Header.Get(LanguageHeader)))
+	if language == "" {
+		language = streaming.DetectLanguage(requestBody)
+	}
+
+	// Pick how completion is judged: per request, JSON mode, per model or the default
+	detector, err = streaming.ResolveCompletionDetector(h.Config, modelName, r.Header.Get(CompletionDetectorHeader), language, requestBody)
+	if err != nil {
+		logger.LogError("Invalid completion detector:", err)
+		JSONError(w, 400, err.Error(), "invalid_completion_detector")
+		return nil, nil, strategy, false
+	}
+
+	// Inject system prompt. Detectors that do not rely on the model's cooperation (e.g. JSON
+	// validity, since a trailing [done] token would corrupt structured output) skip this step.
+	if instruction := detector.Instruction(); instruction != "" {
+		h.InjectSystemPrompt(requestBody, instruction)
+	} else {
+		logger.LogInfo(fmt.Sprintf("Completion detector '%s' needs no system prompt injection", detector.Name()))
+	}
+
+	// Pick how resumed attempts ask the model to continue: per model or the default
+	strategy = streaming.ResolveResumeStrategy(h.Config, modelName, language)
+
+	return requestBody, detector, strategy, true
+}
 
+// openInitialStream makes the first upstream request of an antiblock session. When it fails the
+// error response has already been written and the returned response is nil.
+func (h *ProxyHandler) openInitialStream(w http.ResponseWriter, r *http.Request, upstreamURL string, requestBody *gemini.GenerateContentRequest) *http.Response {
 	// Create upstream request
 	modifiedBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
 		logger.LogError("Failed to marshal modified request body:", err)
 		JSONError(w, 500, "Internal server error", "Failed to process request body")
-		return
+		return nil
 	}
 
 	logger.LogInfo("=== MAKING INITIAL REQUEST ===")
 	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
 
-	upstreamReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), "POST", upstreamURL, bytes.NewReader(modifiedBodyBytes))
 	if err != nil {
 		logger.LogError("Failed to create upstream request:", err)
 		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
-		return
+		return nil
 	}
 
 	upstreamReq.Header = upstreamHeaders
@@ -202,7 +170,7 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		logger.LogError("Failed to make initial request:", err)
 		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
-		return
+		return nil
 	}
 
 	logger.LogInfo(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
@@ -231,7 +199,7 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.WriteHeader(initialResponse.StatusCode)
 			json.NewEncoder(w).Encode(errorResp)
-			return
+			return nil
 		}
 
 		// Fallback to standard error
@@ -240,29 +208,75 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 			message = "Resource has been exhausted (e.g. check quota)."
 		}
 		JSONError(w, initialResponse.StatusCode, message, string(errorBody))
+		return nil
+	}
+
+	return initialResponse
+}
+
+// HandleStreamingPost handles streaming POST requests
+func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
+	urlObj, _ := url.Parse(r.URL.String())
+	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
+	if urlObj.RawQuery != "" {
+		upstreamURL += "?" + urlObj.RawQuery
+	}
+
+	logger.LogInfo("=== NEW STREAMING REQUEST ===")
+	logger.LogInfo("Upstream URL:", upstreamURL)
+	logger.LogInfo("Request method:", r.Method)
+	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
+
+	requestBody, detector, strategy, ok := h.prepareAntiblockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	initialResponse := h.openInitialStream(w, r, upstreamURL, requestBody)
+	if initialResponse == nil {
 		return
 	}
+	route := streaming.NewModelRoute(h.Config, extractModelFromPath(r.URL.Path))
 
 	logger.LogInfo("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
 
+	// Answer in the framing the client asked for: SSE with alt=sse, a streamed JSON array otherwise
+	framing := streaming.RequestFraming(r.URL.Query())
+	var output streaming.StreamWriter
+	var arrayWriter *streaming.JSONArrayWriter
+	if framing == streaming.FramingJSONArray {
+		arrayWriter = streaming.NewJSONArrayWriter(w)
+		output = arrayWriter
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	} else {
+		output = streaming.NewSSEWriter(w)
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	}
+
 	// Set up streaming response
-	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// Browsers only show the model trailer to scripts when it is exposed up front
+	w.Header().Set("Access-Control-Expose-Headers", ModelHeader)
 
 	// Additional headers to prevent buffering by proxies
 	w.Header().Set("X-Accel-Buffering", "no") // Nginx
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
+	w.Header().Set("Trailer", ModelHeader)
 
 	w.WriteHeader(http.StatusOK)
 
 	// Process stream with retry logic
-	err = streaming.ProcessStreamAndRetryInternally(
+	err := streaming.ProcessStreamAndRetryInternally(
+		r.Context(),
 		h.Config,
+		detector,
+		strategy,
+		route,
 		initialResponse.Body,
-		w,
+		output,
 		requestBody,
 		upstreamURL,
 		r.Header,
@@ -273,10 +287,85 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 		logger.LogError("Exception:", err)
 	}
 
+	if arrayWriter != nil {
+		arrayWriter.Close()
+	}
+	w.Header().Set(ModelHeader, route.Served())
+
 	initialResponse.Body.Close()
 	logger.LogInfo("Streaming response completed")
 }
 
+// HandleGenerateContent protects non-streaming generateContent calls. The request is sent to
+// streamGenerateContent instead, runs through the same completion and retry logic as a streaming
+// request, and the chunks are assembled into a single GenerateContentResponse.
+func (h *ProxyHandler) HandleGenerateContent(w http.ResponseWriter, r *http.Request) {
+	urlObj, _ := url.Parse(r.URL.String())
+	query := urlObj.Query()
+	query.Set("alt", "sse")
+	upstreamURL := h.Config.UpstreamURLBase + strings.Replace(urlObj.Path, ":generateContent", ":streamGenerateContent", 1) + "?" + query.Encode()
+
+	logger.LogInfo("=== NEW NON-STREAMING REQUEST (served from a stream) ===")
+	logger.LogInfo("Upstream URL:", upstreamURL)
+	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
+
+	requestBody, detector, strategy, ok := h.prepareAntiblockRequest(w, r)
+	if !ok {
+		return
+	}
+
+	initialResponse := h.openInitialStream(w, r, upstreamURL, requestBody)
+	if initialResponse == nil {
+		return
+	}
+	defer initialResponse.Body.Close()
+	route := streaming.NewModelRoute(h.Config, extractModelFromPath(r.URL.Path))
+
+	logger.LogInfo("=== INITIAL REQUEST SUCCESSFUL - ASSEMBLING RESPONSE ===")
+
+	aggregator := streaming.NewResponseAggregator()
+	err := streaming.ProcessStreamAndRetryInternally(
+		r.Context(),
+		h.Config,
+		detector,
+		strategy,
+		route,
+		initialResponse.Body,
+		aggregator,
+		requestBody,
+		upstreamURL,
+		r.Header,
+	)
+
+	if payload, code, failed := aggregator.Err(); failed {
+		logger.LogError("Non-streaming request failed:", err)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(code)
+		w.Write(payload)
+		return
+	}
+
+	if err != nil {
+		if r.Context().Err() != nil {
+			logger.LogInfo("Client disconnected before the response was assembled")
+			return
+		}
+		logger.LogError("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
+		logger.LogError("Exception:", err)
+		JSONError(w, 502, "Bad Gateway", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", ModelHeader)
+	w.Header().Set(ModelHeader, route.Served())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(aggregator.Response())
+	logger.LogInfo("Non-streaming response completed")
+}
+
 // HandleNonStreaming handles non-streaming requests
 func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request) {
 	urlObj, _ := url.Parse(r.URL.String())
@@ -292,7 +381,7 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 		body = r.Body
 	}
 
-	upstreamReq, err := http.NewRequest(r.Method, upstreamURL, body)
+	upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, body)
 	if err != nil {
 		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
 		return
@@ -387,29 +476,12 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.HandleNonStreaming(w, r)
-}
-
-// estimateTokenCount estimates the number of tokens in the request.
-// NOTE: This is a simple word-count based estimation and not a precise tokenizer.
-func estimateTokenCount(body map[string]interface{}) int {
-	count := 0
-	if contents, ok := body["contents"].([]interface{}); ok {
-		for _, content := range contents {
-			if contentMap, ok := content.(map[string]interface{}); ok {
-				if parts, ok := contentMap["parts"].([]interface{}); ok {
-					for _, part := range parts {
-						if partMap, ok := part.(map[string]interface{}); ok {
-							if text, ok := partMap["text"].(string); ok {
-								count += len(strings.Fields(text))
-							}
-						}
-					}
-				}
-			}
-		}
+	if r.Method == "POST" && h.Config.NonStreamingAntiblock && strings.HasSuffix(r.URL.Path, ":generateContent") {
+		h.HandleGenerateContent(w, r)
+		return
 	}
-	return count
+
+	h.HandleNonStreaming(w, r)
 }
 
 // extractModelFromPath extracts the model name from the request URL path.
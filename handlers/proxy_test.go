@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/streaming"
+)
+
+// newTestProxy starts a proxy in front of an upstream that answers every request with one
+// finished chunk
+func newTestProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	proxy, _ := newAnsweringProxy(t, "Hello. [done]")
+	return proxy
+}
+
+// newAnsweringProxy starts a proxy in front of an upstream that answers every request with one
+// finished chunk of text. The bodies of the upstream requests are sent on the returned channel.
+func newAnsweringProxy(t *testing.T, text string) (*httptest.Server, <-chan string) {
+	t.Helper()
+	bodies := make(chan string, 16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":%q}]},\"finishReason\":\"STOP\"}]}\n\n", text)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := config.LoadConfig()
+	cfg.UpstreamURLBase = upstream.URL
+	cfg.EnableRateLimit = false
+	cfg.GeminiModelMaxTokens = nil
+	proxy := httptest.NewServer(NewProxyHandler(cfg, NewRateLimiter(1, 0)))
+	t.Cleanup(proxy.Close)
+	return proxy, bodies
+}
+
+func TestModelHeaderExposed(t *testing.T) {
+	proxy := newTestProxy(t)
+	body := `{"contents":[{"role":"user","parts":[{"text":"Hi"}]}]}`
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		wantTrailer bool
+	}{
+		{"preflight", http.MethodOptions, "/v1beta/models/gemini-2.5-pro:streamGenerateContent", false},
+		{"streaming", http.MethodPost, "/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", true},
+		{"non-streaming", http.MethodPost, "/v1beta/models/gemini-2.5-pro:generateContent", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(tt.method, proxy.URL+tt.path, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("Origin", "https://app.example")
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			io.ReadAll(response.Body)
+
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", response.StatusCode)
+			}
+			if got := response.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(got, ModelHeader) {
+				t.Errorf("Access-Control-Expose-Headers = %q, want it to list %s", got, ModelHeader)
+			}
+			if tt.method == http.MethodOptions {
+				return
+			}
+
+			model := response.Header.Get(ModelHeader)
+			if tt.wantTrailer {
+				model = response.Trailer.Get(ModelHeader)
+			}
+			if model != "gemini-2.5-pro" {
+				t.Errorf("%s = %q, want gemini-2.5-pro", ModelHeader, model)
+			}
+		})
+	}
+}
+
+func TestCompletionDetectorHeader(t *testing.T) {
+	body := `{"contents":[{"role":"user","parts":[{"text":"Name a sea."}]}],"generationConfig":{"responseMimeType":"application/json"}}`
+
+	tests := []struct {
+		name   string
+		header string
+		answer string
+		// wantSentinel is whether the model is asked for the sentinel
+		wantSentinel bool
+		wantStatus   int
+	}{
+		{"JSON mode", "", `{"name": "Baltic"}`, false, http.StatusOK},
+		{"sentinel requested in JSON mode", "sentinel", `{"name": "Baltic"} [done]`, true, http.StatusOK},
+		{"unknown detector", "done", `{"name": "Baltic"}`, false, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, upstreamBodies := newAnsweringProxy(t, tt.answer)
+			request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				request.Header.Set(CompletionDetectorHeader, tt.header)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			output, _ := io.ReadAll(response.Body)
+
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.StatusCode, tt.wantStatus, output)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(string(output), "invalid_completion_detector") {
+					t.Errorf("error response %s does not name the invalid detector", output)
+				}
+				return
+			}
+
+			upstreamBody := <-upstreamBodies
+			if asked := strings.Contains(upstreamBody, "[done]"); asked != tt.wantSentinel {
+				t.Errorf("upstream request asks for the sentinel: %t, want %t: %s", asked, tt.wantSentinel, upstreamBody)
+			}
+			if !strings.Contains(string(output), "Baltic") || strings.Contains(string(output), "[done]") {
+				t.Errorf("client received %s, want the document without the sentinel", output)
+			}
+		})
+	}
+}
+
+func TestLanguageHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		question string
+		language string
+	}{
+		{"detected", "", "Write a haiku about the sea.", "en"},
+		{"detected from the question", "", "用三句话介绍长城。", "zh"},
+		{"requested", "ja", "Write a haiku about the sea.", "ja"},
+		{"requested in capitals", " KO ", "用三句话介绍长城。", "ko"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, upstreamBodies := newAnsweringProxy(t, "Hello. [done]")
+			body := fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":%q}]}]}`, tt.question)
+			request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/v1beta/models/gemini-2.5-pro:streamGenerateContent?alt=sse", strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				request.Header.Set(LanguageHeader, tt.header)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			io.ReadAll(response.Body)
+
+			upstreamRequest, err := gemini.ParseRequest([]byte(<-upstreamBodies))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var instruction string
+			if upstreamRequest.SystemInstruction != nil {
+				for _, part := range upstreamRequest.SystemInstruction.Parts {
+					instruction += part.TextValue()
+				}
+			}
+			want := streaming.ResolveSentinel(config.LoadConfig(), "gemini-2.5-pro", tt.language).Instruction
+			if instruction != want {
+				t.Errorf("system instruction = %q, want %q", instruction, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/estimator"
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// Token count modes of the GEMINI_MODEL_MAX_TOKENS_JSON limit check
+const (
+	// TokenCountModeLocal estimates the size of a request locally
+	TokenCountModeLocal = "local"
+	// TokenCountModeUpstream asks upstream countTokens before forwarding a request
+	TokenCountModeUpstream = "upstream"
+)
+
+// TokenCounter measures requests for the token limit check. In upstream mode it asks upstream
+// countTokens with the caller's credentials and caches the answers by request hash; when
+// upstream cannot answer, or in local mode, it falls back to the local estimator.
+type TokenCounter struct {
+	cfg       *config.Config
+	client    *http.Client
+	cache     *tokenCountCache
+	estimator *estimator.Estimator
+}
+
+// NewTokenCounter creates a token counter for the configured mode
+func NewTokenCounter(cfg *config.Config) *TokenCounter {
+	return &TokenCounter{
+		cfg:       cfg,
+		client:    &http.Client{},
+		cache:     newTokenCountCache(cfg.TokenCountCacheSize),
+		estimator: estimator.New(cfg.EstimatorMediaCosts),
+	}
+}
+
+// Count returns the number of prompt tokens of a request to model and where it comes from:
+// "upstream", "cache" or "estimate". countURL is the upstream countTokens endpoint of the model
+// and headers carry the caller's credentials.
+func (t *TokenCounter) Count(ctx context.Context, countURL string, headers http.Header, model string, request *gemini.GenerateContentRequest) (int, string) {
+	if !strings.EqualFold(t.cfg.TokenCountMode, TokenCountModeUpstream) {
+		return t.estimator.Request(request), "estimate"
+	}
+
+	body, err := countTokensBody(model, request)
+	if err != nil {
+		logger.LogError("Failed to build the countTokens request, using the local estimate:", err)
+		return t.estimator.Request(request), "estimate"
+	}
+
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+	if count, ok := t.cache.get(key); ok {
+		return count, "cache"
+	}
+
+	count, err := t.countUpstream(ctx, countURL, headers, body)
+	if err != nil {
+		logger.LogError(fmt.Sprintf("countTokens pre-flight for model %s failed, using the local estimate: %v", model, err))
+		return t.estimator.Request(request), "estimate"
+	}
+	t.cache.add(key, count)
+	return count, "upstream"
+}
+
+// countTokensBody wraps the request the way countTokens expects it, so the system instruction,
+// tools and media are counted along with the contents
+func countTokensBody(model string, request *gemini.GenerateContentRequest) ([]byte, error) {
+	counted := request.Clone()
+	modelName, err := json.Marshal("models/" + model)
+	if err != nil {
+		return nil, err
+	}
+	if counted.Extra == nil {
+		counted.Extra = make(map[string]json.RawMessage)
+	}
+	counted.Extra["model"] = modelName
+
+	return json.Marshal(struct {
+		GenerateContentRequest *gemini.GenerateContentRequest `json:"generateContentRequest"`
+	}{counted})
+}
+
+func (t *TokenCounter) countUpstream(ctx context.Context, countURL string, headers http.Header, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.TokenCountTimeoutMs)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", countURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Del("Accept")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream answered %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	var counted struct {
+		TotalTokens *int `json:"totalTokens"`
+	}
+	if err := json.Unmarshal(respBody, &counted); err != nil {
+		return 0, fmt.Errorf("invalid countTokens response: %w", err)
+	}
+	if counted.TotalTokens == nil {
+		// Upstream omits totalTokens when it is 0
+		return 0, nil
+	}
+	return *counted.TotalTokens, nil
+}
+
+// countTokensURL returns the upstream countTokens endpoint for a generateContent or
+// streamGenerateContent path. Only the key parameter of the query is kept.
+func (h *ProxyHandler) countTokensURL(r *http.Request) string {
+	path := r.URL.Path
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		path = path[:i]
+	}
+
+	countURL := h.Config.UpstreamURLBase + path + ":countTokens"
+	if key := r.URL.Query().Get("key"); key != "" {
+		countURL += "?key=" + url.QueryEscape(key)
+	}
+	return countURL
+}
+
+// tokenCountCache is a fixed-size LRU cache of token counts by request hash
+type tokenCountCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+type tokenCountEntry struct {
+	key   string
+	count int
+}
+
+// newTokenCountCache creates a cache holding up to size counts; 0 disables caching
+func newTokenCountCache(size int) *tokenCountCache {
+	return &tokenCountCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *tokenCountCache) get(key string) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*tokenCountEntry).count, true
+}
+
+func (c *tokenCountCache) add(key string, count int) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*tokenCountEntry).count = count
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&tokenCountEntry{key: key, count: count})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tokenCountEntry).key)
+	}
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/estimator"
+	"gemini-antiblock/gemini"
+)
+
+// countRequests are the requests the token counter tests measure
+var countRequests = []string{
+	`{"contents": [{"role": "user", "parts": [{"text": "Count to three."}]}]}`,
+	`{"contents": [{"role": "user", "parts": [{"text": "Count to four."}]}], "systemInstruction": {"parts": [{"text": "Be brief."}]}}`,
+}
+
+// countUpstream is a countTokens endpoint answering with the status and body of its handler
+type countUpstream struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newCountUpstream(t *testing.T, answer func(w http.ResponseWriter, r *http.Request)) *countUpstream {
+	t.Helper()
+	upstream := &countUpstream{}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream.mu.Lock()
+		upstream.bodies = append(upstream.bodies, string(body))
+		upstream.mu.Unlock()
+		answer(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// calls returns how many countTokens requests upstream received
+func (u *countUpstream) calls() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.bodies)
+}
+
+// body returns the body of countTokens request i
+func (u *countUpstream) body(i int) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bodies[i]
+}
+
+// countURL returns the countTokens endpoint of the test model
+func (u *countUpstream) countURL() string {
+	return u.URL + "/v1beta/models/gemini-test:countTokens"
+}
+
+// answerTokens answers countTokens with a total of tokens
+func answerTokens(tokens int) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"totalTokens": %d, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": %d}]}`, tokens, tokens)
+	}
+}
+
+func tokenCountConfig(mode string, cacheSize int) *config.Config {
+	return &config.Config{
+		TokenCountMode:      mode,
+		TokenCountTimeoutMs: time.Second,
+		TokenCountCacheSize: cacheSize,
+		EstimatorMediaCosts: config.DefaultMediaCosts,
+	}
+}
+
+func parseCountRequest(t *testing.T, i int) *gemini.GenerateContentRequest {
+	t.Helper()
+	request, err := gemini.ParseRequest([]byte(countRequests[i]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+func TestTokenCounterCount(t *testing.T) {
+	estimate := estimator.New(config.DefaultMediaCosts)
+	tests := []struct {
+		name    string
+		mode    string
+		timeout time.Duration
+		answer  func(http.ResponseWriter, *http.Request)
+		// want is the count, -1 for the local estimate
+		want      int
+		wantFrom  string
+		wantCalls int
+	}{
+		{
+			name:      "local",
+			mode:      TokenCountModeLocal,
+			answer:    answerTokens(1234),
+			want:      -1,
+			wantFrom:  "estimate",
+			wantCalls: 0,
+		},
+		{
+			name:      "upstream",
+			mode:      TokenCountModeUpstream,
+			answer:    answerTokens(1234),
+			want:      1234,
+			wantFrom:  "upstream",
+			wantCalls: 1,
+		},
+		{
+			name: "upstream omits zero",
+			mode: TokenCountModeUpstream,
+			answer: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{}`)
+			},
+			want:      0,
+			wantFrom:  "upstream",
+			wantCalls: 1,
+		},
+		{
+			name: "upstream error",
+			mode: TokenCountModeUpstream,
+			answer: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				io.WriteString(w, `{"error": {"code": 403, "status": "PERMISSION_DENIED"}}`)
+			},
+			want:      -1,
+			wantFrom:  "estimate",
+			wantCalls: 1,
+		},
+		{
+			name: "invalid answer",
+			mode: TokenCountModeUpstream,
+			answer: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"totalTokens": "many"}`)
+			},
+			want:      -1,
+			wantFrom:  "estimate",
+			wantCalls: 1,
+		},
+		{
+			name:    "timeout",
+			mode:    TokenCountModeUpstream,
+			timeout: 20 * time.Millisecond,
+			answer: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+				answerTokens(1234)(w, r)
+			},
+			want:      -1,
+			wantFrom:  "estimate",
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newCountUpstream(t, tt.answer)
+			cfg := tokenCountConfig(tt.mode, 16)
+			if tt.timeout > 0 {
+				cfg.TokenCountTimeoutMs = tt.timeout
+			}
+			counter := NewTokenCounter(cfg)
+			request := parseCountRequest(t, 1)
+
+			want := tt.want
+			if want < 0 {
+				want = estimate.Request(request)
+			}
+			headers := http.Header{"X-Goog-Api-Key": {"client-key"}}
+			count, from := counter.Count(context.Background(), upstream.countURL(), headers, "gemini-test", request)
+			if count != want || from != tt.wantFrom {
+				t.Errorf("Count = %d from %s, want %d from %s", count, from, want, tt.wantFrom)
+			}
+			if got := upstream.calls(); got != tt.wantCalls {
+				t.Errorf("upstream received %d countTokens requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTokenCounterRequest(t *testing.T) {
+	headerCh := make(chan http.Header, 1)
+	upstream := newCountUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		headerCh <- r.Header.Clone()
+		answerTokens(7)(w, r)
+	})
+	counter := NewTokenCounter(tokenCountConfig(TokenCountModeUpstream, 16))
+	headers := http.Header{"X-Goog-Api-Key": {"client-key"}, "Accept": {"text/event-stream"}}
+	counter.Count(context.Background(), upstream.countURL(), headers, "gemini-test", parseCountRequest(t, 1))
+	header := <-headerCh
+
+	if got := header.Get("X-Goog-Api-Key"); got != "client-key" {
+		t.Errorf("countTokens sent with key %q, want the client's", got)
+	}
+	if got := header.Get("Accept"); got == "text/event-stream" {
+		t.Errorf("countTokens sent with Accept %q", got)
+	}
+	var body struct {
+		GenerateContentRequest map[string]json.RawMessage `json:"generateContentRequest"`
+	}
+	if err := json.Unmarshal([]byte(upstream.body(0)), &body); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(body.GenerateContentRequest["model"]); got != `"models/gemini-test"` {
+		t.Errorf("model = %s, want \"models/gemini-test\"", got)
+	}
+	for _, member := range []string{"contents", "systemInstruction"} {
+		if _, ok := body.GenerateContentRequest[member]; !ok {
+			t.Errorf("countTokens request is missing %s", member)
+		}
+	}
+}
+
+func TestTokenCounterCache(t *testing.T) {
+	upstream := newCountUpstream(t, answerTokens(1234))
+	counter := NewTokenCounter(tokenCountConfig(TokenCountModeUpstream, 1))
+	count := func(i int) string {
+		t.Helper()
+		_, from := counter.Count(context.Background(), upstream.countURL(), http.Header{}, "gemini-test", parseCountRequest(t, i))
+		return from
+	}
+
+	// The cache holds one count: the second request evicts the first
+	for step, want := range []struct {
+		request int
+		from    string
+	}{
+		{0, "upstream"},
+		{0, "cache"},
+		{1, "upstream"},
+		{1, "cache"},
+		{0, "upstream"},
+	} {
+		if got := count(want.request); got != want.from {
+			t.Errorf("step %d: request %d counted from %s, want %s", step, want.request, got, want.from)
+		}
+	}
+	if got := upstream.calls(); got != 3 {
+		t.Errorf("upstream received %d countTokens requests, want 3", got)
+	}
+}
+
+func TestTokenCounterFailuresNotCached(t *testing.T) {
+	var recovered atomic.Bool
+	upstream := newCountUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if !recovered.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		answerTokens(1234)(w, r)
+	})
+	counter := NewTokenCounter(tokenCountConfig(TokenCountModeUpstream, 16))
+	request := parseCountRequest(t, 0)
+
+	if _, from := counter.Count(context.Background(), upstream.countURL(), http.Header{}, "gemini-test", request); from != "estimate" {
+		t.Fatalf("counted from %s while upstream failed", from)
+	}
+	recovered.Store(true)
+	if count, from := counter.Count(context.Background(), upstream.countURL(), http.Header{}, "gemini-test", request); count != 1234 || from != "upstream" {
+		t.Errorf("Count = %d from %s after upstream recovered, want 1234 from upstream", count, from)
+	}
+}
+
+func TestTokenCountCache(t *testing.T) {
+	cache := newTokenCountCache(2)
+	cache.add("a", 1)
+	cache.add("b", 2)
+	cache.get("a")
+	// a was used last, so b is evicted
+	cache.add("c", 3)
+	cache.add("a", 10)
+
+	for key, want := range map[string]int{"a": 10, "c": 3} {
+		if got, ok := cache.get(key); !ok || got != want {
+			t.Errorf("get(%q) = %d, %t, want %d", key, got, ok, want)
+		}
+	}
+	if _, ok := cache.get("b"); ok {
+		t.Error("the least recently used count was kept")
+	}
+
+	disabled := newTokenCountCache(0)
+	disabled.add("a", 1)
+	if _, ok := disabled.get("a"); ok {
+		t.Error("a cache of size 0 kept a count")
+	}
+}
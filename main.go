@@ -32,8 +32,33 @@ func main() {
 	logger.LogInfo(fmt.Sprintf("Max retries: %d", cfg.MaxConsecutiveRetries))
 	logger.LogInfo(fmt.Sprintf("Debug mode: %t", cfg.DebugMode))
 	logger.LogInfo(fmt.Sprintf("Retry delay: %v", cfg.RetryDelayMs))
+	logger.LogInfo(fmt.Sprintf("Retry backoff: %s (multiplier %.2f, max %v, jitter %s)", cfg.RetryBackoffStrategy, cfg.RetryBackoffMultiplier, cfg.RetryMaxDelayMs, cfg.RetryJitter))
 	logger.LogInfo(fmt.Sprintf("Swallow thoughts after retry: %t", cfg.SwallowThoughtsAfterRetry))
+	logger.LogInfo(fmt.Sprintf("Non-streaming antiblock: %t", cfg.NonStreamingAntiblock))
+	logger.LogInfo(fmt.Sprintf("Max SSE event size: %d bytes", cfg.SSEMaxEventBytes))
+	logger.LogInfo(fmt.Sprintf("Resume with thought signatures: %t, thought text: %t", cfg.ResumeThoughtSignatures, cfg.ResumeThoughtText))
+	if cfg.ResumeOverlapWindow > 0 {
+		logger.LogInfo(fmt.Sprintf("Resume overlap trimming: last %d characters, at least %d repeated", cfg.ResumeOverlapWindow, cfg.ResumeOverlapMinChars))
+	} else {
+		logger.LogInfo("Resume overlap trimming disabled")
+	}
+	if cfg.ResumePreambleWindow > 0 {
+		logger.LogInfo(fmt.Sprintf("Resume preamble stripping: first %d characters, %d custom pattern(s)", cfg.ResumePreambleWindow, len(cfg.ResumePreamblePatterns)))
+	} else {
+		logger.LogInfo("Resume preamble stripping disabled")
+	}
+	logger.LogInfo(fmt.Sprintf("Resume strategy: %s, %d per-model override(s)", cfg.ResumeStrategy, len(cfg.ResumeStrategyModels)))
+	if cfg.HedgedRetryRequests > 1 {
+		logger.LogInfo(fmt.Sprintf("Hedged retries: %d requests at once, at most %d extra per request, %d alternative key(s), %d alternative model(s)", cfg.HedgedRetryRequests, cfg.HedgedRetryMaxExtra, len(cfg.HedgedRetryAPIKeys), len(cfg.HedgedRetryModels)))
+	}
+	if len(cfg.ModelFallbackChains) > 0 {
+		logger.LogInfo(fmt.Sprintf("Model fallback chains for %d models, switching after %v", len(cfg.ModelFallbackChains), cfg.ModelFallbackAfter))
+	}
+	logger.LogInfo(fmt.Sprintf("Per-attempt usage breakdown: %t", cfg.UsageAttemptBreakdown))
 	logger.LogInfo(fmt.Sprintf("Server port: %s", cfg.Port))
+	if len(cfg.GeminiModelMaxTokens) > 0 {
+		logger.LogInfo(fmt.Sprintf("Token limit check for %d models, counting mode: %s (timeout %v, cache %d)", len(cfg.GeminiModelMaxTokens), cfg.TokenCountMode, cfg.TokenCountTimeoutMs, cfg.TokenCountCacheSize))
+	}
 
 	// Create rate limiter from config
 	rateLimitWindow := time.Duration(cfg.RateLimitWindowSeconds) * time.Second
@@ -51,6 +76,11 @@ func main() {
 		logger.LogInfo("Punctuation heuristic disabled")
 	}
 
+	logger.LogInfo(fmt.Sprintf("Default completion detector: %s", cfg.CompletionDetector))
+	for model, detector := range cfg.CompletionDetectorModels {
+		logger.LogInfo(fmt.Sprintf("Completion detector for model %s: %s", model, detector))
+	}
+
 	// Create proxy handler
 	proxyHandler := handlers.NewProxyHandler(cfg, rateLimiter)
 
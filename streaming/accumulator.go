@@ -0,0 +1,91 @@
+package streaming
+
+import (
+	"strings"
+
+	"gemini-antiblock/gemini"
+)
+
+// ResponseAccumulator collects the formal (non-thought) output forwarded to the client across
+// all attempts: text as well as functionCall, executableCode, codeExecutionResult and any other
+// part kinds. Retries replay the accumulated parts as the partial model turn. Thought text and
+// thought signatures are only kept when added with AddThought / AddSignedText.
+type ResponseAccumulator struct {
+	parts []*gemini.Part
+	text  strings.Builder
+}
+
+// AddText appends formal text, merging it into the previous part when that part is plain text as well
+func (a *ResponseAccumulator) AddText(text string) {
+	a.addTextPart(text, false, "")
+}
+
+// AddSignedText appends formal text carrying a thought signature. The signed part is kept
+// separate, since the signature must be replayed with exactly the part it was attached to.
+func (a *ResponseAccumulator) AddSignedText(text, signature string) {
+	a.addTextPart(text, false, signature)
+}
+
+// AddThought appends thought text (and its signature, if any) to be replayed in the model turn
+func (a *ResponseAccumulator) AddThought(text, signature string) {
+	a.addTextPart(text, true, signature)
+}
+
+func (a *ResponseAccumulator) addTextPart(text string, thought bool, signature string) {
+	if text == "" && signature == "" {
+		return
+	}
+	if !thought {
+		a.text.WriteString(text)
+	}
+
+	if n := len(a.parts); n > 0 && signature == "" {
+		previous := a.parts[n-1]
+		if previous.HasText() && previous.Thought == thought && previous.ThoughtSignature == "" {
+			previous.SetText(previous.TextValue() + text)
+			return
+		}
+	}
+
+	part := gemini.TextPart(text)
+	part.Thought = thought
+	part.ThoughtSignature = signature
+	a.parts = append(a.parts, part)
+}
+
+// AddPart appends a non-text part (e.g. a functionCall) exactly as the model emitted it
+func (a *ResponseAccumulator) AddPart(part *gemini.Part) {
+	a.parts = append(a.parts, part.Clone())
+}
+
+// Text returns all formal text accumulated so far
+func (a *ResponseAccumulator) Text() string {
+	return a.text.String()
+}
+
+// Empty reports whether nothing has been accumulated yet
+func (a *ResponseAccumulator) Empty() bool {
+	return len(a.parts) == 0
+}
+
+// EndsWithFunctionCall reports whether the last accumulated formal part is a function call.
+// A model turn ending in a complete function call is a finished answer: the client has to
+// run the function, and the turn cannot be resumed without its response.
+func (a *ResponseAccumulator) EndsWithFunctionCall() bool {
+	for i := len(a.parts) - 1; i >= 0; i-- {
+		if a.parts[i].Thought {
+			continue
+		}
+		return a.parts[i].IsFunctionCall()
+	}
+	return false
+}
+
+// Parts returns a copy of the accumulated parts, ready to be used as the parts of a model turn
+func (a *ResponseAccumulator) Parts() []*gemini.Part {
+	parts := make([]*gemini.Part, 0, len(a.parts))
+	for _, part := range a.parts {
+		parts = append(parts, part.Clone())
+	}
+	return parts
+}
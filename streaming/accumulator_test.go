@@ -0,0 +1,357 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/gemini"
+)
+
+// Parts of the model output the tests stream
+const (
+	weatherCallPart = `{"functionCall": {"name": "weather", "args": {"city": "Rome"}}}`
+	weatherCall     = `[` + weatherCallPart + `]`
+	codeExecution   = `[{"executableCode": {"language": "PYTHON", "code": "print(2 + 2)"}}, {"codeExecutionResult": {"outcome": "OUTCOME_OK", "output": "4\n"}}]`
+)
+
+// sseParts returns an SSE message event carrying the parts (a JSON array) of candidate 0,
+// finished with finishReason unless that is empty
+func sseParts(parts, finishReason string) string {
+	candidate := `{"content":{"role":"model","parts":` + parts + `}`
+	if finishReason != "" {
+		candidate += `,"finishReason":"` + finishReason + `"`
+	}
+	return "data: {\"candidates\":[" + candidate + "}]}\n\n"
+}
+
+// jsonParts returns the data of the event returned by sseParts
+func jsonParts(parts, finishReason string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(sseParts(parts, finishReason), "data: "), "\n\n")
+}
+
+// partsOf parses a JSON array of parts
+func partsOf(t *testing.T, parts string) []*gemini.Part {
+	t.Helper()
+	chunk := ParseChunk(jsonParts(parts, ""))
+	if chunk.Response == nil {
+		t.Fatalf("invalid parts %s", parts)
+	}
+	return chunk.FirstCandidate().Parts()
+}
+
+// resumedModelTurn returns the parts of the last model turn of a retry request body
+func resumedModelTurn(t *testing.T, body string) []byte {
+	t.Helper()
+	request, err := gemini.ParseRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(request.Contents) - 1; i >= 0; i-- {
+		if request.Contents[i].Role == "model" {
+			parts, err := json.Marshal(request.Contents[i].Parts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return parts
+		}
+	}
+	t.Fatalf("retry request has no model turn: %s", body)
+	return nil
+}
+
+func TestResponseAccumulatorParts(t *testing.T) {
+	accumulator := &ResponseAccumulator{}
+	accumulator.AddText("Let me ")
+	accumulator.AddText("compute.")
+	for _, part := range partsOf(t, codeExecution) {
+		accumulator.AddPart(part)
+	}
+	accumulator.AddText("Now the weather.")
+	accumulator.AddPart(partsOf(t, weatherCall)[0])
+
+	parts, err := json.Marshal(accumulator.Parts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONEqual(t, parts, []byte(`[
+		{"text": "Let me compute."},
+		{"executableCode": {"language": "PYTHON", "code": "print(2 + 2)"}},
+		{"codeExecutionResult": {"outcome": "OUTCOME_OK", "output": "4\n"}},
+		{"text": "Now the weather."},
+		{"functionCall": {"name": "weather", "args": {"city": "Rome"}}}
+	]`))
+	if got := accumulator.Text(); got != "Let me compute.Now the weather." {
+		t.Errorf("Text = %q", got)
+	}
+}
+
+func TestResponseAccumulatorCopiesParts(t *testing.T) {
+	accumulator := &ResponseAccumulator{}
+	added := partsOf(t, weatherCall)[0]
+	accumulator.AddPart(added)
+	added.FunctionCall = json.RawMessage(`{"name": "changed"}`)
+
+	parts := accumulator.Parts()
+	parts[0].FunctionCall = json.RawMessage(`{"name": "changed"}`)
+
+	again, _ := json.Marshal(accumulator.Parts())
+	assertJSONEqual(t, again, []byte(weatherCall))
+}
+
+func TestEndsWithFunctionCall(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts string
+		want  bool
+	}{
+		{"nothing", `[]`, false},
+		{"text", `[{"text": "Rome is sunny."}]`, false},
+		{"function call", `[{"text": "Checking."}, ` + weatherCallPart + `]`, true},
+		{"text after the call", `[` + weatherCallPart + `, {"text": "Checking."}]`, false},
+		{"thought after the call", `[` + weatherCallPart + `, {"text": "Waiting.", "thought": true}]`, true},
+		{"code execution", codeExecution, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accumulator := &ResponseAccumulator{}
+			for _, part := range partsOf(t, tt.parts) {
+				switch {
+				case part.Thought:
+					accumulator.AddThought(part.TextValue(), "")
+				case part.HasText():
+					accumulator.AddText(part.TextValue())
+				default:
+					accumulator.AddPart(part)
+				}
+			}
+			if got := accumulator.EndsWithFunctionCall(); got != tt.want {
+				t.Errorf("EndsWithFunctionCall = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkEndsWithFunctionCall(t *testing.T) {
+	tests := []struct {
+		name        string
+		accumulated string
+		chunk       string
+		want        bool
+	}{
+		{"call in the chunk", `[]`, weatherCall, true},
+		{"call before the chunk", weatherCall, `[]`, true},
+		{"empty text after the call", `[]`, `[` + weatherCallPart + `, {"text": ""}]`, true},
+		{"text after the call", `[]`, `[` + weatherCallPart + `, {"text": "Checking."}]`, false},
+		{"chunk text after an earlier call", weatherCall, `[{"text": "Checking."}]`, false},
+		{"thought after the call", `[]`, `[` + weatherCallPart + `, {"text": "Waiting.", "thought": true}]`, true},
+		{"text only", `[]`, `[{"text": "Rome is sunny."}]`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accumulator := &ResponseAccumulator{}
+			for _, part := range partsOf(t, tt.accumulated) {
+				accumulator.AddPart(part)
+			}
+			content := ParseChunkContent(ParseChunk(jsonParts(tt.chunk, "STOP")))
+			if got := chunkEndsWithFunctionCall(content.Parts, accumulator); got != tt.want {
+				t.Errorf("chunkEndsWithFunctionCall = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionCallCompletesTurn(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string
+		retries int
+	}{
+		{"STOP with the call", sseParts(`[{"text": "Checking Rome."}, `+weatherCallPart+`]`, "STOP"), 0},
+		{"STOP after the call", sseParts(weatherCall, "") + sseParts(`[{"text": ""}]`, "STOP"), 0},
+		{"dropped after the call", sseChunk("Checking Rome.", "") + sseParts(weatherCall, ""), 0},
+		{"text after the call", sseParts(weatherCall, "") + sseChunk("Rome is", "") + sseChunk("", "STOP"), 1},
+		// The rejected STOP chunk is not forwarded, so the turn the client has still ends with the call
+		{"rejected text after the call", sseParts(weatherCall, "") + sseChunk("Rome is", "STOP"), 0},
+		{"dropped after text", sseParts(weatherCall, "") + sseChunk("Rome is", ""), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" sunny. [done]", "STOP")})
+			// The model is told to end with the sentinel, which a function call does not need
+			cfg := testSessionConfig()
+			detector := newTestDetector(t, DetectorSentinel, cfg)
+
+			writer, err := runSessionDetector(context.Background(), t, cfg, detector, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), testRequest, io.NopCloser(strings.NewReader(tt.initial)))
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := len(upstream.Requests()); got != tt.retries {
+				t.Errorf("upstream received %d retry requests, want %d", got, tt.retries)
+			}
+			var calls int
+			for _, event := range writer.events {
+				calls += len(ParseChunkContent(ParseChunk(event.Data)).DataParts)
+			}
+			if calls != 1 {
+				t.Errorf("client received %d function calls, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestRetryReplaysDataParts(t *testing.T) {
+	recordPauses(t)
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" The answer is 4.", "STOP")})
+	initial := sseChunk("Let me compute.", "") + sseParts(codeExecution, "")
+
+	cfg := testSessionConfig()
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), initial)
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := writer.text(); got != "Let me compute. The answer is 4." {
+		t.Errorf("client received %q", got)
+	}
+
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream received %d retry requests, want 1", len(requests))
+	}
+	// The code and its result are replayed as the model emitted them
+	assertJSONEqual(t, resumedModelTurn(t, requests[0]), []byte(`[
+		{"text": "Let me compute."},
+		{"executableCode": {"language": "PYTHON", "code": "print(2 + 2)"}},
+		{"codeExecutionResult": {"outcome": "OUTCOME_OK", "output": "4\n"}}
+	]`))
+}
+
+func TestResponseAccumulatorThoughts(t *testing.T) {
+	accumulator := &ResponseAccumulator{}
+	accumulator.AddThought("Counting", "")
+	accumulator.AddThought(" up.", "")
+	accumulator.AddThought("", "dGhvdWdodA==")
+	accumulator.AddSignedText("One, ", "c2ln")
+	accumulator.AddText("two, ")
+	accumulator.AddText("three.")
+	accumulator.AddThought("", "")
+
+	parts, err := json.Marshal(accumulator.Parts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Signed parts stay on their own, so each signature is replayed with its part
+	assertJSONEqual(t, parts, []byte(`[
+		{"text": "Counting up.", "thought": true},
+		{"text": "", "thought": true, "thoughtSignature": "dGhvdWdodA=="},
+		{"text": "One, ", "thoughtSignature": "c2ln"},
+		{"text": "two, three."}
+	]`))
+	if got := accumulator.Text(); got != "One, two, three." {
+		t.Errorf("Text = %q, want the formal text only", got)
+	}
+}
+
+func TestResumeThoughts(t *testing.T) {
+	tests := []struct {
+		name       string
+		signatures bool
+		text       bool
+		want       string
+	}{
+		{
+			name: "neither",
+			want: `[{"text": "One, two,"}]`,
+		},
+		{
+			name:       "signatures",
+			signatures: true,
+			want: `[
+				{"text": "", "thought": true, "thoughtSignature": "dGhvdWdodA=="},
+				{"text": "One, ", "thoughtSignature": "c2ln"},
+				{"text": "two,"}
+			]`,
+		},
+		{
+			name: "thought text",
+			text: true,
+			want: `[
+				{"text": "Counting.", "thought": true},
+				{"text": "One, two,"}
+			]`,
+		},
+		{
+			name:       "signatures and thought text",
+			signatures: true,
+			text:       true,
+			want: `[
+				{"text": "Counting.", "thought": true, "thoughtSignature": "dGhvdWdodA=="},
+				{"text": "One, ", "thoughtSignature": "c2ln"},
+				{"text": "two,"}
+			]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" three.", "STOP")})
+			cfg := testSessionConfig()
+			cfg.ResumeThoughtSignatures = tt.signatures
+			cfg.ResumeThoughtText = tt.text
+			initial := sseParts(`[{"text": "Counting.", "thought": true, "thoughtSignature": "dGhvdWdodA=="}, {"text": "One, ", "thoughtSignature": "c2ln"}]`, "") +
+				sseChunk("two,", "")
+
+			writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), initial)
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := writer.text(); got != "One, two, three." {
+				t.Errorf("client received %q", got)
+			}
+			requests := upstream.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("upstream received %d retry requests, want 1", len(requests))
+			}
+			assertJSONEqual(t, resumedModelTurn(t, requests[0]), []byte(tt.want))
+		})
+	}
+}
+
+func TestResumeThoughtsSwallowed(t *testing.T) {
+	recordPauses(t)
+	// The first retry opens with a thought, which is swallowed, and breaks off again
+	upstream := newTestUpstream(t,
+		upstreamResponse{http.StatusOK, sseParts(`[{"text": "Where was I?", "thought": true, "thoughtSignature": "c3dhbGxvd2Vk"}]`, "") + sseChunk(" two,", "")},
+		upstreamResponse{http.StatusOK, sseChunk(" three.", "STOP")},
+	)
+	cfg := testSessionConfig()
+	cfg.SwallowThoughtsAfterRetry = true
+	cfg.ResumeThoughtSignatures = true
+	cfg.ResumeThoughtText = true
+	initial := sseParts(`[{"text": "Counting.", "thought": true, "thoughtSignature": "dGhvdWdodA=="}]`, "") + sseChunk("One,", "")
+
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), initial)
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := writer.text(); got != "One, two, three." {
+		t.Errorf("client received %q", got)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("upstream received %d retry requests, want 2", len(requests))
+	}
+	// Only the thought the client received is replayed
+	assertJSONEqual(t, resumedModelTurn(t, requests[1]), []byte(`[
+		{"text": "Counting.", "thought": true, "thoughtSignature": "dGhvdWdodA=="},
+		{"text": "One, two,"}
+	]`))
+}
@@ -0,0 +1,204 @@
+package streaming
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// ResponseAggregator is a StreamWriter that assembles the streamed chunks of a session into a
+// single GenerateContentResponse, as returned by the non-streaming generateContent method.
+// Parts are merged per candidate and the last finishReason and usageMetadata win: the session
+// reports the usage of all attempts in the chunks it forwards after a retry.
+type ResponseAggregator struct {
+	candidates     map[int]*aggregateCandidate
+	promptFeedback *gemini.PromptFeedback
+	usage          *gemini.UsageMetadata
+	// fields are the members of the chunks outside candidates (modelVersion, responseId, ...)
+	fields map[string]json.RawMessage
+
+	errorPayload []byte
+}
+
+// NewResponseAggregator creates an empty aggregator
+func NewResponseAggregator() *ResponseAggregator {
+	return &ResponseAggregator{
+		candidates: make(map[int]*aggregateCandidate),
+		fields:     make(map[string]json.RawMessage),
+	}
+}
+
+// BeginAttempt is a no-op: attempts are stitched into one response
+func (a *ResponseAggregator) BeginAttempt() {}
+
+// WriteEvent merges the chunk of a message event into the response. Other events are ignored.
+func (a *ResponseAggregator) WriteEvent(event SSEEvent) error {
+	if !event.IsMessage() {
+		return nil
+	}
+
+	chunk := ParseChunk(event.Data)
+	if chunk.Response == nil {
+		logger.LogDebug("Aggregator skipped an unparsable chunk")
+		return nil
+	}
+
+	for _, candidate := range chunk.Response.Candidates {
+		if candidate != nil {
+			a.mergeCandidate(candidate)
+		}
+	}
+	if chunk.Response.PromptFeedback != nil {
+		a.promptFeedback = chunk.Response.PromptFeedback
+	}
+	if chunk.Response.UsageMetadata != nil {
+		a.usage = chunk.Response.UsageMetadata
+	}
+	for key, raw := range chunk.Response.Untyped() {
+		a.fields[key] = raw
+	}
+	return nil
+}
+
+// WriteError records the terminal error of the session
+func (a *ResponseAggregator) WriteError(payload []byte) {
+	a.errorPayload = payload
+}
+
+// Err returns the error payload reported by the session and its HTTP status code, if any
+func (a *ResponseAggregator) Err() ([]byte, int, bool) {
+	if a.errorPayload == nil {
+		return nil, 0, false
+	}
+
+	code := 500
+	var payload struct {
+		Error struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(a.errorPayload, &payload) == nil && payload.Error.Code >= 400 {
+		code = payload.Error.Code
+	}
+	return a.errorPayload, code, true
+}
+
+// Response returns the assembled GenerateContentResponse
+func (a *ResponseAggregator) Response() *gemini.GenerateContentResponse {
+	response := &gemini.GenerateContentResponse{
+		PromptFeedback: a.promptFeedback,
+		UsageMetadata:  a.usage,
+		Extra:          a.fields,
+	}
+
+	indexes := make([]int, 0, len(a.candidates))
+	for index := range a.candidates {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		response.Candidates = append(response.Candidates, a.candidates[index].assemble())
+	}
+	return response
+}
+
+// aggregateCandidate is a candidate being assembled from its chunks
+type aggregateCandidate struct {
+	*gemini.Candidate
+	// text collects the text of the last part while the chunks keep extending it, so a long
+	// answer is not copied again with every chunk
+	text strings.Builder
+}
+
+// assemble returns the candidate with the text collected for its last part
+func (c *aggregateCandidate) assemble() *gemini.Candidate {
+	if c.text.Len() > 0 {
+		c.Content.Parts[len(c.Content.Parts)-1].SetText(c.text.String())
+	}
+	return c.Candidate
+}
+
+// appendPart appends a part, concatenating it with the previous one when both are plain text of
+// the same kind (thought or formal) and neither carries any other field
+func (c *aggregateCandidate) appendPart(part *gemini.Part) {
+	parts := c.Content.Parts
+	if len(parts) > 0 {
+		previous := parts[len(parts)-1]
+		if onlyText(previous) && onlyText(part) && previous.Thought == part.Thought {
+			if c.text.Len() == 0 {
+				c.text.WriteString(previous.TextValue())
+			}
+			c.text.WriteString(part.TextValue())
+			return
+		}
+	}
+
+	c.assemble()
+	c.text.Reset()
+	c.Content.Parts = append(parts, part)
+}
+
+// mergeCandidate folds one streamed candidate chunk into the aggregated candidate with the same index
+func (a *ResponseAggregator) mergeCandidate(chunk *gemini.Candidate) {
+	candidate, ok := a.candidates[chunk.Index]
+	if !ok {
+		candidate = &aggregateCandidate{Candidate: &gemini.Candidate{
+			Index:   chunk.Index,
+			Content: &gemini.Content{Role: "model", Parts: []*gemini.Part{}},
+			Extra:   make(map[string]json.RawMessage),
+		}}
+		a.candidates[chunk.Index] = candidate
+	}
+
+	if chunk.Content != nil {
+		if chunk.Content.Role != "" {
+			candidate.Content.Role = chunk.Content.Role
+		}
+		for _, part := range chunk.Content.Parts {
+			if part != nil {
+				candidate.appendPart(part)
+			}
+		}
+	}
+	if chunk.FinishReason != "" {
+		candidate.FinishReason = chunk.FinishReason
+	}
+	for key, raw := range chunk.Untyped() {
+		if key == "citationMetadata" {
+			raw = mergeCitations(candidate.Extra[key], raw)
+		}
+		candidate.Extra[key] = raw
+	}
+}
+
+// onlyText reports whether a part holds nothing but text and the thought flag
+func onlyText(part *gemini.Part) bool {
+	return part.HasText() && part.ThoughtSignature == "" && !part.IsFunctionCall() && len(part.Untyped()) == 0
+}
+
+// mergeCitations appends the citation sources of a chunk to the ones collected so far
+func mergeCitations(existing, chunk json.RawMessage) json.RawMessage {
+	var existingMembers, chunkMembers map[string]json.RawMessage
+	if existing == nil || json.Unmarshal(existing, &existingMembers) != nil || existingMembers == nil {
+		return chunk
+	}
+	if json.Unmarshal(chunk, &chunkMembers) != nil {
+		return existing
+	}
+
+	var sources, chunkSources []json.RawMessage
+	json.Unmarshal(existingMembers["citationSources"], &sources)
+	json.Unmarshal(chunkMembers["citationSources"], &chunkSources)
+	merged, err := json.Marshal(append(append([]json.RawMessage{}, sources...), chunkSources...))
+	if err != nil {
+		return existing
+	}
+	existingMembers["citationSources"] = merged
+	if encoded, err := json.Marshal(existingMembers); err == nil {
+		return encoded
+	}
+	return existing
+}
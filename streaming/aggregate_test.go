@@ -0,0 +1,318 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// aggregateStream is a stream of two candidates with thoughts, a function call, an untyped part,
+// citations and usage spread over several chunks
+var aggregateStream = []string{
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":"Let me think","thought":true}]}}],"modelVersion":"gemini-2.5-pro","responseId":"r1"}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":" about it.","thought":true}]},"index":0},{"content":{"role":"model","parts":[{"text":"Second "}]},"index":1}]}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":"The answer"}]},"citationMetadata":{"citationSources":[{"uri":"https://a.example"}]}}]}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"text":" is 42."},{"functionCall":{"name":"lookup","args":{"q":"42"}}}]},"citationMetadata":{"citationSources":[{"uri":"https://b.example"}]},"safetyRatings":[{"category":"HARM_CATEGORY_HATE_SPEECH","probability":"NEGLIGIBLE"}]}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"totalTokenCount":15}}`,
+	`{"candidates":[{"content":{"role":"model","parts":[{"executableCode":{"language":"PYTHON","code":"print(42)"}},{"text":"Done","thoughtSignature":"c2ln"}]},"finishReason":"STOP"},{"content":{"role":"model","parts":[{"text":"candidate."}]},"finishReason":"STOP","index":1}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":12,"totalTokenCount":22,"promptTokensDetails":[{"modality":"TEXT","tokenCount":10}]}}`,
+	`not json`,
+}
+
+// aggregateWant is the response the non-streaming method returns for aggregateStream
+const aggregateWant = `{
+	"candidates": [
+		{
+			"content": {"role": "model", "parts": [
+				{"text": "Let me think about it.", "thought": true},
+				{"text": "The answer is 42."},
+				{"functionCall": {"name": "lookup", "args": {"q": "42"}}},
+				{"executableCode": {"language": "PYTHON", "code": "print(42)"}},
+				{"text": "Done", "thoughtSignature": "c2ln"}
+			]},
+			"citationMetadata": {"citationSources": [{"uri": "https://a.example"}, {"uri": "https://b.example"}]},
+			"safetyRatings": [{"category": "HARM_CATEGORY_HATE_SPEECH", "probability": "NEGLIGIBLE"}],
+			"finishReason": "STOP"
+		},
+		{
+			"content": {"role": "model", "parts": [{"text": "Second candidate."}]},
+			"finishReason": "STOP",
+			"index": 1
+		}
+	],
+	"usageMetadata": {"promptTokenCount": 10, "candidatesTokenCount": 12, "totalTokenCount": 22, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 10}]},
+	"modelVersion": "gemini-2.5-pro",
+	"responseId": "r1"
+}`
+
+func TestResponseAggregator(t *testing.T) {
+	aggregator := NewResponseAggregator()
+	for _, data := range aggregateStream {
+		if err := aggregator.WriteEvent(SSEEvent{Data: data}); err != nil {
+			t.Fatalf("WriteEvent: %v", err)
+		}
+	}
+	aggregator.WriteEvent(SSEEvent{Event: "ping", Data: `{"candidates":[{"content":{"parts":[{"text":"ignored"}]}}]}`})
+
+	encoded, err := json.Marshal(aggregator.Response())
+	if err != nil {
+		t.Fatalf("encoding the response: %v", err)
+	}
+	assertJSONEqual(t, encoded, []byte(aggregateWant))
+
+	// The map aggregator the typed one replaced assembles the same response
+	legacy := newMapAggregator()
+	for _, data := range aggregateStream {
+		legacy.WriteEvent(SSEEvent{Data: data})
+	}
+	legacyEncoded, _ := json.Marshal(legacy.Response())
+	assertJSONEqual(t, encoded, legacyEncoded)
+}
+
+func TestResponseAggregatorEmpty(t *testing.T) {
+	encoded, err := json.Marshal(NewResponseAggregator().Response())
+	if err != nil {
+		t.Fatalf("encoding the response: %v", err)
+	}
+	if string(encoded) != "{}" {
+		t.Errorf("empty response = %s, want {}", encoded)
+	}
+}
+
+func TestResponseAggregatorErr(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		wantCode int
+	}{
+		{"upstream code", `{"error":{"code":429,"message":"quota","status":"RESOURCE_EXHAUSTED"}}`, 429},
+		{"no code", `{"error":{"message":"broken"}}`, 500},
+		{"not JSON", `broken`, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregator := NewResponseAggregator()
+			if _, _, failed := aggregator.Err(); failed {
+				t.Fatal("Err reported a failure before WriteError")
+			}
+			aggregator.WriteError([]byte(tt.payload))
+			payload, code, failed := aggregator.Err()
+			if !failed || code != tt.wantCode || string(payload) != tt.payload {
+				t.Errorf("Err() = %s, %d, %v; want %s, %d, true", payload, code, failed, tt.payload, tt.wantCode)
+			}
+		})
+	}
+}
+
+func assertJSONEqual(t *testing.T, got, want []byte) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &wantValue); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("JSON mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+// benchmarkStream returns a stream of n chunks of a sentence or two, the last one finishing the
+// answer and reporting usage
+func benchmarkStream(n int) []SSEEvent {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 3)
+	events := make([]SSEEvent, 0, n)
+	for i := 0; i < n-1; i++ {
+		events = append(events, SSEEvent{Data: fmt.Sprintf(`{"candidates":[{"content":{"role":"model","parts":[{"text":%q}]},"safetyRatings":[{"category":"HARM_CATEGORY_HATE_SPEECH","probability":"NEGLIGIBLE"}]}],"usageMetadata":{"promptTokenCount":10,"totalTokenCount":10},"modelVersion":"gemini-2.5-pro"}`, text)})
+	}
+	events = append(events, SSEEvent{Data: `{"candidates":[{"content":{"role":"model","parts":[{"text":"."}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":250,"totalTokenCount":260},"modelVersion":"gemini-2.5-pro"}`})
+	return events
+}
+
+func BenchmarkResponseAggregator(b *testing.B) {
+	events := benchmarkStream(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		aggregator := NewResponseAggregator()
+		for _, event := range events {
+			aggregator.WriteEvent(event)
+		}
+		json.Marshal(aggregator.Response())
+	}
+}
+
+func BenchmarkResponseAggregatorMap(b *testing.B) {
+	events := benchmarkStream(50)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		aggregator := newMapAggregator()
+		for _, event := range events {
+			aggregator.WriteEvent(event)
+		}
+		json.Marshal(aggregator.Response())
+	}
+}
+
+// mapAggregator is the aggregator that decoded every chunk into generic maps, kept as the
+// baseline of the benchmarks
+type mapAggregator struct {
+	candidates map[int]map[string]interface{}
+	fields     map[string]interface{}
+	usage      map[string]interface{}
+}
+
+func newMapAggregator() *mapAggregator {
+	return &mapAggregator{
+		candidates: make(map[int]map[string]interface{}),
+		fields:     make(map[string]interface{}),
+	}
+}
+
+func (a *mapAggregator) WriteEvent(event SSEEvent) {
+	var chunk map[string]interface{}
+	if json.Unmarshal([]byte(event.Data), &chunk) != nil {
+		return
+	}
+
+	for key, value := range chunk {
+		switch key {
+		case "candidates":
+			candidates, _ := value.([]interface{})
+			for _, candidate := range candidates {
+				if candidateMap, ok := candidate.(map[string]interface{}); ok {
+					a.mergeCandidate(candidateMap)
+				}
+			}
+		case "usageMetadata":
+			if usage, ok := value.(map[string]interface{}); ok {
+				a.usage = usage
+			}
+		default:
+			a.fields[key] = value
+		}
+	}
+}
+
+func (a *mapAggregator) Response() map[string]interface{} {
+	response := make(map[string]interface{}, len(a.fields)+2)
+	for key, value := range a.fields {
+		response[key] = value
+	}
+
+	indexes := make([]int, 0, len(a.candidates))
+	for index := range a.candidates {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	candidates := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		candidates = append(candidates, a.candidates[index])
+	}
+	if len(candidates) > 0 {
+		response["candidates"] = candidates
+	}
+	if a.usage != nil {
+		response["usageMetadata"] = a.usage
+	}
+	return response
+}
+
+func (a *mapAggregator) mergeCandidate(chunk map[string]interface{}) {
+	index := 0
+	if value, ok := chunk["index"].(float64); ok {
+		index = int(value)
+	}
+	candidate, ok := a.candidates[index]
+	if !ok {
+		candidate = map[string]interface{}{
+			"content": map[string]interface{}{"role": "model", "parts": []interface{}{}},
+		}
+		if index > 0 {
+			candidate["index"] = index
+		}
+		a.candidates[index] = candidate
+	}
+
+	for key, value := range chunk {
+		switch key {
+		case "index":
+		case "content":
+			content, _ := candidate["content"].(map[string]interface{})
+			chunkContent, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if role, ok := chunkContent["role"]; ok {
+				content["role"] = role
+			}
+			parts, _ := content["parts"].([]interface{})
+			chunkParts, _ := chunkContent["parts"].([]interface{})
+			for _, part := range chunkParts {
+				if partMap, ok := part.(map[string]interface{}); ok {
+					parts = appendMergedMapPart(parts, partMap)
+				}
+			}
+			content["parts"] = parts
+		case "citationMetadata":
+			candidate[key] = mergeMapCitations(candidate[key], value)
+		default:
+			candidate[key] = value
+		}
+	}
+}
+
+func appendMergedMapPart(parts []interface{}, part map[string]interface{}) []interface{} {
+	if text, ok := mapPlainText(part); ok && len(parts) > 0 {
+		if previous, ok := parts[len(parts)-1].(map[string]interface{}); ok {
+			thought, _ := part["thought"].(bool)
+			previousThought, _ := previous["thought"].(bool)
+			if previousText, ok := mapPlainText(previous); ok && thought == previousThought {
+				previous["text"] = previousText + text
+				return parts
+			}
+		}
+	}
+
+	copied := make(map[string]interface{}, len(part))
+	for k, v := range part {
+		copied[k] = v
+	}
+	return append(parts, copied)
+}
+
+func mapPlainText(part map[string]interface{}) (string, bool) {
+	text, ok := part["text"].(string)
+	if !ok {
+		return "", false
+	}
+	for key := range part {
+		if key != "text" && key != "thought" {
+			return "", false
+		}
+	}
+	return text, true
+}
+
+func mergeMapCitations(existing, chunk interface{}) interface{} {
+	existingMap, ok := existing.(map[string]interface{})
+	if !ok {
+		return chunk
+	}
+	chunkMap, ok := chunk.(map[string]interface{})
+	if !ok {
+		return existing
+	}
+
+	sources, _ := existingMap["citationSources"].([]interface{})
+	chunkSources, _ := chunkMap["citationSources"].([]interface{})
+	merged := make(map[string]interface{}, len(existingMap))
+	for k, v := range existingMap {
+		merged[k] = v
+	}
+	merged["citationSources"] = append(append([]interface{}{}, sources...), chunkSources...)
+	return merged
+}
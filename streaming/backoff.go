@@ -0,0 +1,152 @@
+package streaming
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// Backoff strategies
+const (
+	BackoffConstant    = "constant"
+	BackoffExponential = "exponential"
+)
+
+// Jitter modes
+const (
+	JitterNone         = "none"
+	JitterFull         = "full"
+	JitterDecorrelated = "decorrelated"
+)
+
+// Backoff computes the wait between consecutive failed upstream requests.
+// It is not safe for concurrent use; each stream session owns its own Backoff.
+type Backoff struct {
+	strategy   string
+	jitter     string
+	base       time.Duration
+	max        time.Duration
+	multiplier float64
+	attempt    int
+	prev       time.Duration
+	rng        *rand.Rand
+}
+
+// NewBackoff creates a backoff schedule from configuration
+func NewBackoff(cfg *config.Config) *Backoff {
+	multiplier := cfg.RetryBackoffMultiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	maxDelay := cfg.RetryMaxDelayMs
+	if maxDelay < cfg.RetryDelayMs {
+		maxDelay = cfg.RetryDelayMs
+	}
+
+	return &Backoff{
+		strategy:   strings.ToLower(cfg.RetryBackoffStrategy),
+		jitter:     strings.ToLower(cfg.RetryJitter),
+		base:       cfg.RetryDelayMs,
+		max:        maxDelay,
+		multiplier: multiplier,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the delay before the next attempt and advances the schedule
+func (b *Backoff) Next() time.Duration {
+	ceiling := b.base
+	if b.strategy == BackoffExponential {
+		ceiling = time.Duration(float64(b.base) * math.Pow(b.multiplier, float64(b.attempt)))
+		if ceiling > b.max || ceiling <= 0 {
+			ceiling = b.max
+		}
+	}
+	b.attempt++
+
+	var delay time.Duration
+	switch b.jitter {
+	case JitterFull:
+		delay = b.randomBetween(0, ceiling)
+	case JitterDecorrelated:
+		// Decorrelated jitter: sleep = min(max, random(base, prev*3))
+		prev := b.prev
+		if prev < b.base {
+			prev = b.base
+		}
+		upper := prev * 3
+		if upper > b.max || upper <= 0 {
+			upper = b.max
+		}
+		delay = b.randomBetween(b.base, upper)
+	default:
+		delay = ceiling
+	}
+
+	b.prev = delay
+	return delay
+}
+
+// Reset restarts the schedule after a successful request
+func (b *Backoff) Reset() {
+	b.attempt = 0
+	b.prev = 0
+}
+
+func (b *Backoff) randomBetween(low, high time.Duration) time.Duration {
+	if high <= low {
+		return low
+	}
+	return low + time.Duration(b.rng.Int63n(int64(high-low)+1))
+}
+
+// ParseRetryHint extracts the server-requested retry delay from a failed upstream response.
+// It honors the Retry-After header (seconds or HTTP date) and the retryDelay field of a
+// google.rpc.RetryInfo entry in the error details. The larger of the two wins.
+func ParseRetryHint(header http.Header, body []byte) (time.Duration, bool) {
+	var hint time.Duration
+	found := false
+
+	if value := strings.TrimSpace(header.Get("Retry-After")); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			hint = time.Duration(seconds) * time.Second
+			found = true
+		} else if at, err := http.ParseTime(value); err == nil {
+			if until := time.Until(at); until > 0 {
+				hint = until
+			}
+			found = true
+		}
+	}
+
+	var errorResp struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorResp); err == nil {
+		for _, detail := range errorResp.Error.Details {
+			if !strings.HasSuffix(detail.Type, "google.rpc.RetryInfo") || detail.RetryDelay == "" {
+				continue
+			}
+			// Durations are encoded as decimal seconds with an "s" suffix, e.g. "32s" or "1.5s"
+			if delay, err := time.ParseDuration(detail.RetryDelay); err == nil && delay >= 0 {
+				if delay > hint {
+					hint = delay
+				}
+				found = true
+			}
+		}
+	}
+
+	return hint, found
+}
@@ -0,0 +1,99 @@
+package streaming
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+func TestBackoffSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		want     []time.Duration
+	}{
+		{"exponential", BackoffExponential, []time.Duration{100, 200, 400, 800, 1000, 1000}},
+		{"constant", BackoffConstant, []time.Duration{100, 100, 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := NewBackoff(&config.Config{
+				RetryBackoffStrategy:   tt.strategy,
+				RetryJitter:            JitterNone,
+				RetryDelayMs:           100 * time.Millisecond,
+				RetryMaxDelayMs:        time.Second,
+				RetryBackoffMultiplier: 2,
+			})
+			for i, want := range tt.want {
+				if got := backoff.Next(); got != want*time.Millisecond {
+					t.Errorf("delay %d = %v, want %v", i, got, want*time.Millisecond)
+				}
+			}
+
+			backoff.Reset()
+			if got := backoff.Next(); got != tt.want[0]*time.Millisecond {
+				t.Errorf("delay after Reset = %v, want %v", got, tt.want[0]*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, time.Second
+
+	for _, jitter := range []string{JitterFull, JitterDecorrelated} {
+		t.Run(jitter, func(t *testing.T) {
+			backoff := NewBackoff(&config.Config{
+				RetryBackoffStrategy:   BackoffExponential,
+				RetryJitter:            jitter,
+				RetryDelayMs:           base,
+				RetryMaxDelayMs:        maxDelay,
+				RetryBackoffMultiplier: 2,
+			})
+			low := time.Duration(0)
+			if jitter == JitterDecorrelated {
+				low = base
+			}
+			for i := 0; i < 50; i++ {
+				if delay := backoff.Next(); delay < low || delay > maxDelay {
+					t.Fatalf("delay %d = %v, want between %v and %v", i, delay, low, maxDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryHint(t *testing.T) {
+	retryInfo := []byte(`{"error":{"code":429,"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"1.5s"}]}}`)
+
+	tests := []struct {
+		name       string
+		retryAfter string
+		body       []byte
+		want       time.Duration
+		wantFound  bool
+	}{
+		{"none", "", []byte(`{"error":{"code":429}}`), 0, false},
+		{"Retry-After seconds", "3", nil, 3 * time.Second, true},
+		{"Retry-After in the past", "Mon, 02 Jan 2006 15:04:05 GMT", nil, 0, true},
+		{"RetryInfo", "", retryInfo, 1500 * time.Millisecond, true},
+		{"larger of both", "1", retryInfo, 1500 * time.Millisecond, true},
+		{"invalid Retry-After", "soon", nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			got, found := ParseRetryHint(header, tt.body)
+			if got != tt.want || found != tt.wantFound {
+				t.Errorf("ParseRetryHint() = %v, %v; want %v, %v", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
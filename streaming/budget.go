@@ -0,0 +1,61 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// estimatedBytesPerToken approximates the output tokens of an attempt that reported no
+// usageMetadata: about one token per word piece of Latin text, about one per CJK character
+const estimatedBytesPerToken = 4
+
+// chargeAttempt adds the output tokens of the attempt that just ended to its candidates.
+// Upstream counts the tokens of all candidates of a request together, so candidates streamed
+// by the same attempt share them evenly. An attempt that reported no usage is estimated from
+// the text it produced.
+func (s *streamSession) chargeAttempt(active []*candidateState) {
+	for _, c := range active {
+		tokens := 0
+		if s.attemptUsage != nil {
+			tokens = s.attemptUsage.CandidatesTokenCount / len(active)
+		} else {
+			tokens = (len(c.textInThisStream) + estimatedBytesPerToken - 1) / estimatedBytesPerToken
+			logger.LogDebug(fmt.Sprintf("  %sNo usageMetadata in this attempt; estimated %d output tokens", s.label(c), tokens))
+		}
+		c.outputTokens += tokens
+
+		if s.tokenBudget > 0 {
+			logger.LogDebug(fmt.Sprintf("  %sOutput tokens: %d this attempt, %d of %d used", s.label(c), tokens, c.outputTokens, s.tokenBudget))
+		}
+	}
+}
+
+// remainingTokens returns the output tokens a candidate may still generate. It is only
+// meaningful when the request set maxOutputTokens.
+func (s *streamSession) remainingTokens(c *candidateState) int {
+	return s.tokenBudget - c.outputTokens
+}
+
+// budgetExhausted reports whether a candidate used up the maxOutputTokens of the request
+func (s *streamSession) budgetExhausted(c *candidateState) bool {
+	return s.tokenBudget > 0 && s.remainingTokens(c) <= 0
+}
+
+// finishWithMaxTokens ends a candidate whose budget is exhausted the way upstream would: with a
+// final chunk carrying finishReason MAX_TOKENS
+func (s *streamSession) finishWithMaxTokens(c *candidateState) error {
+	response := gemini.GenerateContentResponse{
+		Candidates: []*gemini.Candidate{{FinishReason: "MAX_TOKENS", Index: c.index}},
+	}
+	if s.retried() {
+		response.UsageMetadata = s.sessionUsage(s.attemptUsage)
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return s.forward(SSEEvent{Data: string(data)})
+}
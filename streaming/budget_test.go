@@ -0,0 +1,201 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/gemini"
+)
+
+// budgetRequest asks for at most 100 output tokens
+const budgetRequest = `{"contents": [{"role": "user", "parts": [{"text": "Count to three."}]}], "generationConfig": {"maxOutputTokens": 100}}`
+
+// sseUsageChunk returns an SSE message event like sseChunk, reporting usage along with the text
+func sseUsageChunk(text, finishReason, usage string) string {
+	chunk := strings.TrimSuffix(sseChunk(text, finishReason), "}\n\n")
+	return chunk + `,"usageMetadata":` + usage + "}\n\n"
+}
+
+func TestChargeAttempt(t *testing.T) {
+	tests := []struct {
+		name       string
+		usage      *gemini.UsageMetadata
+		candidates int
+		text       string
+		want       int
+	}{
+		{"reported", &gemini.UsageMetadata{CandidatesTokenCount: 30}, 1, "One, two", 30},
+		{"shared by candidates", &gemini.UsageMetadata{CandidatesTokenCount: 30}, 3, "One", 10},
+		{"estimated", nil, 1, "One, two,", 3},
+		{"estimated from bytes", nil, 1, "长城", 2},
+		{"nothing", nil, 1, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &streamSession{cfg: testSessionConfig(), tokenBudget: 100, attemptUsage: tt.usage}
+			active := make([]*candidateState, tt.candidates)
+			for i := range active {
+				active[i] = &candidateState{index: i, outputTokens: 5, textInThisStream: tt.text}
+			}
+			s.chargeAttempt(active)
+			for _, c := range active {
+				if c.outputTokens != 5+tt.want {
+					t.Errorf("candidate %d used %d tokens, want %d", c.index, c.outputTokens, 5+tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBudgetExhausted(t *testing.T) {
+	tests := []struct {
+		budget, used int
+		remaining    int
+		exhausted    bool
+	}{
+		{budget: 0, used: 500, remaining: -500, exhausted: false},
+		{budget: 100, used: 0, remaining: 100, exhausted: false},
+		{budget: 100, used: 99, remaining: 1, exhausted: false},
+		{budget: 100, used: 100, remaining: 0, exhausted: true},
+		{budget: 100, used: 130, remaining: -30, exhausted: true},
+	}
+	for _, tt := range tests {
+		s := &streamSession{tokenBudget: tt.budget}
+		c := &candidateState{outputTokens: tt.used}
+		if got := s.remainingTokens(c); got != tt.remaining {
+			t.Errorf("budget %d, used %d: remaining %d, want %d", tt.budget, tt.used, got, tt.remaining)
+		}
+		if got := s.budgetExhausted(c); got != tt.exhausted {
+			t.Errorf("budget %d, used %d: exhausted = %t, want %t", tt.budget, tt.used, got, tt.exhausted)
+		}
+	}
+}
+
+func TestTokenBudgetAcrossAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    string
+		responses  []upstreamResponse
+		wantLimits []int
+	}{
+		{
+			name:    "reported usage",
+			initial: sseUsageChunk("One,", "", `{"promptTokenCount": 10, "candidatesTokenCount": 30, "totalTokenCount": 40}`),
+			responses: []upstreamResponse{
+				{http.StatusOK, sseUsageChunk(" two,", "", `{"promptTokenCount": 20, "candidatesTokenCount": 25, "totalTokenCount": 45}`)},
+				{http.StatusOK, sseUsageChunk(" three.", "STOP", `{"promptTokenCount": 30, "candidatesTokenCount": 5, "totalTokenCount": 35}`)},
+			},
+			wantLimits: []int{70, 45},
+		},
+		{
+			name:    "estimated usage",
+			initial: sseChunk("One,", "") + sseChunk(" two,", ""),
+			responses: []upstreamResponse{
+				{http.StatusOK, sseUsageChunk(" three.", "STOP", `{"promptTokenCount": 20, "candidatesTokenCount": 4, "totalTokenCount": 24}`)},
+			},
+			// "One, two," is 9 bytes, estimated as 3 tokens
+			wantLimits: []int{97},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, tt.responses...)
+			cfg := testSessionConfig()
+			writer, err := runSessionRequest(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), budgetRequest, io.NopCloser(strings.NewReader(tt.initial)))
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := writer.text(); got != "One, two, three." {
+				t.Errorf("client received %q", got)
+			}
+
+			requests := upstream.Requests()
+			if len(requests) != len(tt.wantLimits) {
+				t.Fatalf("upstream received %d retry requests, want %d", len(requests), len(tt.wantLimits))
+			}
+			for i, body := range requests {
+				request, err := gemini.ParseRequest([]byte(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := request.GenerationConfig.MaxOutputTokens; got != tt.wantLimits[i] {
+					t.Errorf("retry %d asked for maxOutputTokens=%d, want %d", i+1, got, tt.wantLimits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBudgetExhausted(t *testing.T) {
+	tests := []struct {
+		name      string
+		initial   string
+		responses []upstreamResponse
+		retries   int
+		wantText  string
+		wantUsage string
+	}{
+		{
+			name:      "first attempt",
+			initial:   sseUsageChunk("One,", "", `{"promptTokenCount": 10, "candidatesTokenCount": 100, "totalTokenCount": 110}`),
+			responses: []upstreamResponse{{http.StatusOK, sseChunk(" two, three.", "STOP")}},
+			retries:   0,
+			wantText:  "One,",
+		},
+		{
+			name:    "after a retry",
+			initial: sseUsageChunk("One,", "", `{"promptTokenCount": 10, "candidatesTokenCount": 60, "totalTokenCount": 70}`),
+			responses: []upstreamResponse{
+				{http.StatusOK, sseUsageChunk(" two,", "", `{"promptTokenCount": 20, "candidatesTokenCount": 40, "totalTokenCount": 60}`)},
+				{http.StatusOK, sseChunk(" three.", "STOP")},
+			},
+			retries:   1,
+			wantText:  "One, two,",
+			wantUsage: `{"promptTokenCount": 30, "candidatesTokenCount": 100, "totalTokenCount": 130}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, tt.responses...)
+			cfg := testSessionConfig()
+			writer, err := runSessionRequest(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), budgetRequest, io.NopCloser(strings.NewReader(tt.initial)))
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := len(upstream.Requests()); got != tt.retries {
+				t.Errorf("upstream received %d retry requests, want %d", got, tt.retries)
+			}
+			if got := writer.text(); got != tt.wantText {
+				t.Errorf("client received %q, want %q", got, tt.wantText)
+			}
+
+			// The answer ends the way upstream ends one that hit maxOutputTokens
+			if len(writer.events) == 0 {
+				t.Fatal("client received nothing")
+			}
+			last := ParseChunk(writer.events[len(writer.events)-1].Data)
+			if got := ExtractFinishReason(last); got != "MAX_TOKENS" {
+				t.Errorf("last chunk finished with %q, want MAX_TOKENS", got)
+			}
+			if tt.wantUsage == "" {
+				if last.Response.UsageMetadata != nil {
+					t.Errorf("last chunk of a session without retries reports usage")
+				}
+				return
+			}
+			usage, err := last.Response.UsageMetadata.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, usage, []byte(tt.wantUsage))
+		})
+	}
+}
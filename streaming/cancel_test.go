@@ -0,0 +1,179 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// cancelDeadline is how long a session may take to return once its client is gone
+const cancelDeadline = time.Second
+
+// trackedBody records whether the session closed the stream it was reading
+type trackedBody struct {
+	io.ReadCloser
+	closed atomic.Bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed.Store(true)
+	return b.ReadCloser.Close()
+}
+
+// startSession runs a stream session in the background and returns its result channel
+func startSession(ctx context.Context, t *testing.T, cfg *config.Config, upstreamURL string, initial io.ReadCloser) <-chan error {
+	t.Helper()
+	result := make(chan error, 1)
+	route := NewModelRoute(cfg, "gemini-test")
+	go func() {
+		_, err := runSessionBody(ctx, t, cfg, route, upstreamURL, initial)
+		result <- err
+	}()
+	return result
+}
+
+// waitCanceled waits for a session to end after its context was cancelled
+func waitCanceled(t *testing.T, result <-chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("session ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(cancelDeadline):
+		t.Fatalf("session still running %v after the client disconnected", cancelDeadline)
+	}
+}
+
+// waitClosed waits for an upstream handler to see its request abandoned
+func waitClosed(t *testing.T, gone <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-gone:
+	case <-time.After(cancelDeadline):
+		t.Errorf("upstream request still open %v after the client disconnected", cancelDeadline)
+	}
+}
+
+// checkGoroutines fails the test when more goroutines run than the baseline taken before the
+// session started, once idle client connections are closed
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	deadline := time.Now().Add(cancelDeadline)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<16)
+			stacks = stacks[:runtime.Stack(stacks, true)]
+			t.Errorf("%d goroutines running after the session, %d before:\n%s", runtime.NumGoroutine(), baseline, stacks)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCancelMidStream(t *testing.T) {
+	streamed := make(chan struct{})
+	gone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, sseChunk("One,", ""))
+		w.(http.Flusher).Flush()
+		close(streamed)
+		<-r.Context().Done()
+		close(gone)
+	}))
+	defer upstream.Close()
+	baseline := runtime.NumGoroutine()
+
+	// The initial stream is bound to the client context, as the proxy handler opens it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", upstream.URL, strings.NewReader(testRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := &trackedBody{ReadCloser: response.Body}
+
+	result := startSession(ctx, t, testSessionConfig(), upstream.URL, body)
+	<-streamed
+	cancel()
+
+	waitCanceled(t, result)
+	if !body.closed.Load() {
+		t.Error("the upstream body was not closed")
+	}
+	waitClosed(t, gone)
+	checkGoroutines(t, baseline)
+}
+
+func TestCancelMidBackoff(t *testing.T) {
+	waiting := make(chan struct{})
+	pause = func(ctx context.Context, d time.Duration) error {
+		close(waiting)
+		return sleepContext(ctx, d)
+	}
+	t.Cleanup(func() { pause = sleepContext })
+
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" two, three.", "STOP")})
+	baseline := runtime.NumGoroutine()
+
+	cfg := testSessionConfig()
+	cfg.RetryDelayMs = time.Minute
+	cfg.RetryMaxDelayMs = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := &trackedBody{ReadCloser: io.NopCloser(strings.NewReader(sseChunk("One,", "")))}
+
+	result := startSession(ctx, t, cfg, upstream.URL("gemini-test"), body)
+	<-waiting
+	cancel()
+
+	waitCanceled(t, result)
+	if !body.closed.Load() {
+		t.Error("the interrupted body was not closed")
+	}
+	if got := len(upstream.Requests()); got != 0 {
+		t.Errorf("upstream received %d retry requests after the client disconnected", got)
+	}
+	checkGoroutines(t, baseline)
+}
+
+func TestCancelMidRetryRequest(t *testing.T) {
+	recordPauses(t)
+	requested := make(chan struct{})
+	gone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Upstream takes its time to answer the retry request
+		io.Copy(io.Discard, r.Body)
+		close(requested)
+		<-r.Context().Done()
+		close(gone)
+	}))
+	defer upstream.Close()
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := startSession(ctx, t, testSessionConfig(), upstream.URL+"/v1beta/models/gemini-test:streamGenerateContent?alt=sse", io.NopCloser(strings.NewReader(sseChunk("One,", ""))))
+	<-requested
+	cancel()
+
+	waitCanceled(t, result)
+	waitClosed(t, gone)
+	checkGoroutines(t, baseline)
+}
@@ -0,0 +1,70 @@
+package streaming
+
+import (
+	"fmt"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// noCandidateIndex marks a chunk that carries no candidate (e.g. promptFeedback or usage only)
+const noCandidateIndex = -1
+
+// CandidateChunk is the part of a chunk that belongs to a single candidate
+type CandidateChunk struct {
+	Index int
+	Chunk *Chunk
+}
+
+// RequestedCandidateCount returns generationConfig.candidateCount of a request, or 1 when unset
+func RequestedCandidateCount(request *gemini.GenerateContentRequest) int {
+	if request.GenerationConfig != nil && request.GenerationConfig.CandidateCount > 1 {
+		return request.GenerationConfig.CandidateCount
+	}
+	return 1
+}
+
+// SplitCandidates splits a chunk that interleaves several candidates into one chunk per
+// candidate, each carrying only its own candidate. usageMetadata and promptFeedback follow in a
+// chunk without candidates, so they reach the client even when the chunks of a settled or
+// interrupted candidate are dropped. Chunks with at most one candidate are returned unchanged.
+func SplitCandidates(chunk *Chunk) []CandidateChunk {
+	if chunk.Response == nil {
+		return []CandidateChunk{{Index: noCandidateIndex, Chunk: chunk}}
+	}
+
+	candidates := chunk.Response.Candidates
+	switch len(candidates) {
+	case 0:
+		return []CandidateChunk{{Index: noCandidateIndex, Chunk: chunk}}
+	case 1:
+		return []CandidateChunk{{Index: candidates[0].Index, Chunk: chunk}}
+	}
+
+	result := make([]CandidateChunk, 0, len(candidates)+1)
+	for _, single := range chunk.Response.SplitCandidates() {
+		index := noCandidateIndex
+		if len(single.Candidates) > 0 {
+			index = single.Candidates[0].Index
+		}
+		result = append(result, CandidateChunk{Index: index, Chunk: newChunk(single)})
+	}
+
+	logger.LogDebug(fmt.Sprintf("Split chunk into %d candidate chunks", len(result)))
+	return result
+}
+
+// ReindexCandidate sets the index of the candidate in a single-candidate chunk. Resumed
+// attempts request one candidate, which upstream numbers 0; its chunks are renumbered to the
+// index of the candidate they continue.
+func ReindexCandidate(chunk *Chunk, index int) {
+	if chunk.Response == nil || len(chunk.Response.Candidates) != 1 {
+		return
+	}
+	candidate := chunk.Response.Candidates[0]
+	if candidate.Index == index {
+		return
+	}
+	candidate.Index = index
+	chunk.MarkModified()
+}
@@ -0,0 +1,106 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// twoCandidatesRequest asks for two candidates
+const twoCandidatesRequest = `{"contents": [{"role": "user", "parts": [{"text": "Count to three."}]}], "generationConfig": {"candidateCount": 2}}`
+
+func TestSplitCandidates(t *testing.T) {
+	tests := []struct {
+		name        string
+		chunk       string
+		wantIndexes []int
+		want        []string
+	}{
+		{
+			name:        "single candidate",
+			chunk:       `{"candidates":[{"content":{"parts":[{"text":"One"}]}}],"usageMetadata":{"totalTokenCount":5},"modelVersion":"gemini-2.5-pro"}`,
+			wantIndexes: []int{0},
+			want:        []string{`{"candidates":[{"content":{"parts":[{"text":"One"}]}}],"usageMetadata":{"totalTokenCount":5},"modelVersion":"gemini-2.5-pro"}`},
+		},
+		{
+			name:        "no candidates",
+			chunk:       `{"usageMetadata":{"totalTokenCount":5}}`,
+			wantIndexes: []int{noCandidateIndex},
+			want:        []string{`{"usageMetadata":{"totalTokenCount":5}}`},
+		},
+		{
+			name:        "usage in a chunk of its own",
+			chunk:       `{"candidates":[{"content":{"parts":[{"text":"One"}]}},{"content":{"parts":[{"text":"Uno"}]},"finishReason":"STOP","index":1}],"usageMetadata":{"totalTokenCount":5},"modelVersion":"gemini-2.5-pro"}`,
+			wantIndexes: []int{0, 1, noCandidateIndex},
+			want: []string{
+				`{"candidates":[{"content":{"parts":[{"text":"One"}]}}],"modelVersion":"gemini-2.5-pro"}`,
+				`{"candidates":[{"content":{"parts":[{"text":"Uno"}]},"finishReason":"STOP","index":1}],"modelVersion":"gemini-2.5-pro"}`,
+				`{"usageMetadata":{"totalTokenCount":5},"modelVersion":"gemini-2.5-pro"}`,
+			},
+		},
+		{
+			name:        "without usage",
+			chunk:       `{"candidates":[{"content":{"parts":[{"text":"One"}]}},{"content":{"parts":[{"text":"Uno"}]},"index":1}],"modelVersion":"gemini-2.5-pro"}`,
+			wantIndexes: []int{0, 1},
+			want: []string{
+				`{"candidates":[{"content":{"parts":[{"text":"One"}]}}],"modelVersion":"gemini-2.5-pro"}`,
+				`{"candidates":[{"content":{"parts":[{"text":"Uno"}]},"index":1}],"modelVersion":"gemini-2.5-pro"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := SplitCandidates(ParseChunk(tt.chunk))
+			if len(chunks) != len(tt.want) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(tt.want))
+			}
+			for i, chunk := range chunks {
+				if chunk.Index != tt.wantIndexes[i] {
+					t.Errorf("chunk %d has index %d, want %d", i, chunk.Index, tt.wantIndexes[i])
+				}
+				assertJSONEqual(t, []byte(chunk.Chunk.Data()), []byte(tt.want[i]))
+			}
+		})
+	}
+}
+
+func TestUsageForwardedAfterCandidateSettled(t *testing.T) {
+	// Candidate 1 finishes in the first chunk; the usage arrives with the last chunk, which still
+	// lists candidate 1
+	initial := "data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"One,"}]}},{"content":{"role":"model","parts":[{"text":"Uno, dos, tres."}]},"finishReason":"STOP","index":1}]}` + "\n\n" +
+		"data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":" two, three."}]},"finishReason":"STOP"},{"finishReason":"STOP","index":1}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":12,"totalTokenCount":22}}` + "\n\n"
+
+	cfg := testSessionConfig()
+	writer, err := runSessionRequest(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), "http://upstream.invalid", twoCandidatesRequest, io.NopCloser(strings.NewReader(initial)))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	assertJSONEqual(t, lastUsage(t, writer), []byte(`{"promptTokenCount":10,"candidatesTokenCount":12,"totalTokenCount":22}`))
+}
+
+func TestUsageForwardedAfterCandidateInterrupted(t *testing.T) {
+	recordPauses(t)
+	// Candidate 1 breaks off with an abnormal finish in the chunk carrying the usage; it is
+	// resumed on its own afterwards
+	initial := "data: " + `{"candidates":[{"content":{"role":"model","parts":[{"text":"One, two, three."}]},"finishReason":"STOP"},{"content":{"role":"model","parts":[{"text":"Uno,"}]},"finishReason":"OTHER","index":1}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":8,"totalTokenCount":18}}` + "\n\n"
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" dos, tres.", "STOP")})
+
+	cfg := testSessionConfig()
+	writer, err := runSessionRequest(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), twoCandidatesRequest, io.NopCloser(strings.NewReader(initial)))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	var usageChunks int
+	for _, event := range writer.events {
+		if chunk := ParseChunk(event.Data); chunk.Response != nil && chunk.Response.UsageMetadata != nil {
+			usageChunks++
+		}
+	}
+	if usageChunks != 1 {
+		t.Errorf("client received usage in %d chunks, want the one of the first attempt", usageChunks)
+	}
+}
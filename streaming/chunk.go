@@ -0,0 +1,69 @@
+package streaming
+
+import (
+	"encoding/json"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// Chunk is one response chunk of a stream, decoded once into a typed response. It keeps the
+// data it was parsed from and is only re-encoded when the proxy modified it.
+type Chunk struct {
+	// Response is nil when the data is not a valid response chunk
+	Response *gemini.GenerateContentResponse
+
+	data     string
+	modified bool
+}
+
+// ParseChunk decodes the data of a message event. Data that does not decode is kept as is.
+func ParseChunk(data string) *Chunk {
+	response, err := gemini.ParseResponse([]byte(data))
+	if err != nil {
+		logger.LogDebug("Failed to parse chunk:", err)
+		return &Chunk{data: data}
+	}
+	return &Chunk{Response: response, data: data}
+}
+
+// rawChunk wraps data that is forwarded without being inspected
+func rawChunk(data string) *Chunk {
+	return &Chunk{data: data}
+}
+
+// newChunk creates a chunk from a response built by the proxy
+func newChunk(response *gemini.GenerateContentResponse) *Chunk {
+	return &Chunk{Response: response, modified: true}
+}
+
+// FirstCandidate returns the first candidate of the chunk, or nil when there is none
+func (c *Chunk) FirstCandidate() *gemini.Candidate {
+	if c.Response == nil {
+		return nil
+	}
+	return c.Response.FirstCandidate()
+}
+
+// MarkModified records that Response was changed, so Data encodes it again
+func (c *Chunk) MarkModified() {
+	if c.Response != nil {
+		c.modified = true
+	}
+}
+
+// Data returns the chunk in its wire form: the original data, or the modified response re-encoded
+func (c *Chunk) Data() string {
+	if !c.modified {
+		return c.data
+	}
+
+	encoded, err := json.Marshal(c.Response)
+	if err != nil {
+		logger.LogDebug("Failed to encode modified chunk:", err)
+		return c.data
+	}
+	c.data = string(encoded)
+	c.modified = false
+	return c.data
+}
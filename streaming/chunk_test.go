@@ -0,0 +1,228 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// inspectChunks are chunks the retry loop inspects: plain text, a thought, a function call, the
+// final chunk carrying the sentinel and usage, and a blocked prompt
+var inspectChunks = map[string]string{
+	"text":          fmt.Sprintf(`{"candidates":[{"content":{"role":"model","parts":[{"text":%q}]},"safetyRatings":[{"category":"HARM_CATEGORY_HATE_SPEECH","probability":"NEGLIGIBLE"}]}],"usageMetadata":{"promptTokenCount":10,"totalTokenCount":10},"modelVersion":"gemini-2.5-pro","responseId":"r1"}`, strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20)),
+	"thought":       `{"candidates":[{"content":{"role":"model","parts":[{"text":"Weighing the options before answering.","thought":true,"thoughtSignature":"c2lnbmF0dXJl"}]}}],"modelVersion":"gemini-2.5-pro"}`,
+	"function call": `{"candidates":[{"content":{"role":"model","parts":[{"text":"Looking it up."},{"functionCall":{"name":"lookup","args":{"q":"the answer","limit":3}}}]}}],"modelVersion":"gemini-2.5-pro"}`,
+	"final":         `{"candidates":[{"content":{"role":"model","parts":[{"text":"That is all. [do"},{"text":"ne]\n"}]},"finishReason":"STOP","citationMetadata":{"citationSources":[{"uri":"https://a.example"}]}}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":250,"totalTokenCount":260,"promptTokensDetails":[{"modality":"TEXT","tokenCount":10}]},"modelVersion":"gemini-2.5-pro"}`,
+	"blocked":       `{"promptFeedback":{"blockReason":"SAFETY","safetyRatings":[{"category":"HARM_CATEGORY_HARASSMENT","probability":"HIGH"}]},"modelVersion":"gemini-2.5-pro"}`,
+}
+
+// inspection is what the retry loop learns from a chunk and what it forwards
+type inspection struct {
+	text         string
+	isThought    bool
+	dataParts    int
+	finishReason string
+	blocked      bool
+	forwarded    string
+}
+
+// inspectChunk runs a chunk through the steps the retry loop applies to every message event
+func inspectChunk(data string) inspection {
+	chunk := ParseChunk(data)
+	content := ParseChunkContent(chunk)
+	finishReason := ExtractFinishReason(chunk)
+	blocked := IsBlockedChunk(chunk)
+	RemoveDoneTokenFromChunk(chunk, "[done]", finishReason == "STOP")
+	return inspection{content.Text, content.IsThought, len(content.DataParts), finishReason, blocked, chunk.Data()}
+}
+
+// inspectChunkMap runs a chunk through the same steps with the map-based helpers the typed chunk
+// replaced, each of which decoded the chunk again
+func inspectChunkMap(data string) inspection {
+	content := mapChunkContent(data)
+	finishReason := mapFinishReason(data)
+	blocked := strings.Contains(data, "blockReason")
+	forwarded := mapRemoveDoneToken(data, "[done]", finishReason == "STOP")
+	return inspection{content.Text, content.IsThought, content.DataParts, finishReason, blocked, forwarded}
+}
+
+func TestInspectChunkMatchesMap(t *testing.T) {
+	for name, data := range inspectChunks {
+		t.Run(name, func(t *testing.T) {
+			got, want := inspectChunk(data), inspectChunkMap(data)
+			forwarded, wantForwarded := got.forwarded, want.forwarded
+			got.forwarded, want.forwarded = "", ""
+			if got != want {
+				t.Errorf("inspection = %+v, want %+v", got, want)
+			}
+			assertJSONEqual(t, []byte(forwarded), []byte(wantForwarded))
+		})
+	}
+}
+
+func BenchmarkInspectChunk(b *testing.B) {
+	benchmarkInspect(b, inspectChunk)
+}
+
+func BenchmarkInspectChunkMap(b *testing.B) {
+	benchmarkInspect(b, inspectChunkMap)
+}
+
+func benchmarkInspect(b *testing.B, inspect func(string) inspection) {
+	for _, name := range []string{"text", "thought", "function call", "final", "blocked"} {
+		data := inspectChunks[name]
+		b.Run(strings.ReplaceAll(name, " ", "_"), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				inspect(data)
+			}
+		})
+	}
+}
+
+// mapContent is what the map-based ParseChunkContent reported
+type mapContent struct {
+	Text      string
+	IsThought bool
+	DataParts int
+}
+
+func mapChunkContent(chunk string) mapContent {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(chunk), &data); err != nil {
+		return mapContent{}
+	}
+	rawParts, ok := mapFirstCandidateParts(data)
+	if !ok {
+		return mapContent{}
+	}
+
+	var result mapContent
+	var text strings.Builder
+	hasThought, hasFormal := false, false
+	for _, rawPart := range rawParts {
+		part, ok := rawPart.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		partText, hasText := part["text"].(string)
+		thought, _ := part["thought"].(bool)
+		_, _ = part["thoughtSignature"].(string)
+		switch {
+		case thought:
+			hasThought = true
+		case hasText:
+			hasFormal = true
+			text.WriteString(partText)
+		default:
+			hasFormal = true
+			result.DataParts++
+		}
+	}
+	result.Text = text.String()
+	result.IsThought = hasThought && !hasFormal
+	return result
+}
+
+func mapFinishReason(chunk string) string {
+	if !strings.Contains(chunk, "finishReason") {
+		return ""
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(chunk), &data); err != nil {
+		return ""
+	}
+	if candidates, ok := data["candidates"].([]interface{}); ok && len(candidates) > 0 {
+		if candidate, ok := candidates[0].(map[string]interface{}); ok {
+			if finishReason, ok := candidate["finishReason"].(string); ok {
+				return finishReason
+			}
+		}
+	}
+	return ""
+}
+
+func mapFirstCandidateParts(data map[string]interface{}) ([]interface{}, bool) {
+	candidates, ok := data["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return nil, false
+	}
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	content, ok := candidate["content"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	parts, ok := content["parts"].([]interface{})
+	if !ok || len(parts) == 0 {
+		return nil, false
+	}
+	return parts, true
+}
+
+func mapRemoveDoneToken(chunk string, token string, shouldRemove bool) string {
+	if !shouldRemove || token == "" {
+		return chunk
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(chunk), &data); err != nil {
+		return chunk
+	}
+	rawParts, ok := mapFirstCandidateParts(data)
+	if !ok {
+		return chunk
+	}
+
+	var textParts []map[string]interface{}
+	var combined strings.Builder
+	for _, rawPart := range rawParts {
+		part, ok := rawPart.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text, hasText := part["text"].(string)
+		if thought, _ := part["thought"].(bool); !hasText || thought {
+			continue
+		}
+		textParts = append(textParts, part)
+		combined.WriteString(text)
+	}
+	if len(textParts) == 0 {
+		return chunk
+	}
+
+	originalText := strings.TrimRightFunc(combined.String(), unicode.IsSpace)
+	removed := ""
+	for i := 0; i < len(token); i++ {
+		if !utf8.RuneStart(token[i]) {
+			continue
+		}
+		if suffix := token[i:]; strings.HasSuffix(originalText, suffix) {
+			removed = suffix
+			break
+		}
+	}
+	if removed == "" {
+		return chunk
+	}
+
+	cut := combined.Len() - len(originalText) + len(removed)
+	for i := len(textParts) - 1; i >= 0 && cut > 0; i-- {
+		text := textParts[i]["text"].(string)
+		n := min(cut, len(text))
+		textParts[i]["text"] = text[:len(text)-n]
+		cut -= n
+	}
+
+	modifiedData, err := json.Marshal(data)
+	if err != nil {
+		return chunk
+	}
+	return string(modifiedData)
+}
@@ -0,0 +1,310 @@
+package streaming
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// Built-in completion detector names
+const (
+	DetectorSentinel    = "sentinel"
+	DetectorPunctuation = "punctuation"
+	DetectorBalanced    = "balanced"
+	DetectorJSON        = "json"
+	DetectorTrustStop   = "stop"
+)
+
+// punctuationStreakThreshold is the number of consecutive interrupted resume attempts ending with
+// sentence punctuation after which the answer is accepted as finished
+const punctuationStreakThreshold = 3
+
+// CompletionDetector decides whether a response that upstream reports as finished
+// (finishReason STOP) is really complete, or was cut short and must be resumed.
+// Detectors may keep state across the attempts of one session, so a new detector
+// is created for every request.
+type CompletionDetector interface {
+	// Name returns the detector name used in configuration and logs
+	Name() string
+	// Instruction returns the text injected into the system instruction so the model
+	// cooperates with the detector, or "" when no instruction is needed
+	Instruction() string
+	// CheckComplete returns nil when text, the formal text accumulated over all attempts,
+	// is a finished answer, or an error describing why it looks incomplete
+	CheckComplete(text string) error
+}
+
+// SentinelStripper is implemented by detectors that mark completion with an in-band
+// token which must be removed before the final chunk reaches the client.
+type SentinelStripper interface {
+	Sentinel() string
+}
+
+// AttemptJudge is implemented by detectors that may accept an interrupted resumed attempt
+// as a finished answer. It is consulted once per interrupted attempt after the first retry.
+type AttemptJudge interface {
+	AcceptInterruptedAttempt(lastFormalText string) bool
+}
+
+// NewCompletionDetector creates a built-in detector by name. sentinel is only used by the
+// sentinel detector and schema only by the JSON detector.
+func NewCompletionDetector(name string, cfg *config.Config, sentinel Sentinel, schema map[string]interface{}) (CompletionDetector, error) {
+	var streak *punctuationStreak
+	if cfg.EnablePunctuationHeuristic {
+		streak = &punctuationStreak{threshold: punctuationStreakThreshold}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case DetectorSentinel:
+		return &sentinelDetector{sentinel: sentinel, streak: streak}, nil
+	case DetectorPunctuation:
+		return &punctuationDetector{streak: punctuationStreak{threshold: punctuationStreakThreshold}}, nil
+	case DetectorBalanced:
+		return &balancedDetector{streak: streak}, nil
+	case DetectorJSON:
+		return &jsonDetector{schema: schema}, nil
+	case DetectorTrustStop:
+		return trustStopDetector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown completion detector %q (available: %s)", name, strings.Join(DetectorNames(), ", "))
+	}
+}
+
+// DetectorNames lists the built-in detector names
+func DetectorNames() []string {
+	names := []string{DetectorSentinel, DetectorPunctuation, DetectorBalanced, DetectorJSON, DetectorTrustStop}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveCompletionDetector picks the detector for a request. In order of precedence:
+// the detector requested by the client (requested, may be empty), the JSON detector for
+// JSON-mode requests, the per-model configuration, and finally the configured default.
+// language selects the sentinel instruction template (see ResolveSentinel).
+func ResolveCompletionDetector(cfg *config.Config, model, requested, language string, request *gemini.GenerateContentRequest) (CompletionDetector, error) {
+	name := cfg.CompletionDetector
+	source := "default"
+
+	if modelName, ok := cfg.CompletionDetectorModels[model]; ok && model != "" {
+		name = modelName
+		source = "model " + model
+	}
+
+	var schema map[string]interface{}
+	if IsJSONMode(request) {
+		if cfg.JSONModeValidateSchema {
+			schema, _ = ResponseSchema(request)
+		}
+		name = DetectorJSON
+		source = "JSON mode"
+	}
+
+	if requested != "" {
+		name = requested
+		source = "request"
+	}
+
+	detector, err := NewCompletionDetector(name, cfg, ResolveSentinel(cfg, model, language), schema)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.LogInfo(fmt.Sprintf("Completion detector: %s (selected by %s)", detector.Name(), source))
+	return detector, nil
+}
+
+// sentinelDetector requires the answer to end with the sentinel token (e.g. [done]) the model is instructed to emit
+type sentinelDetector struct {
+	sentinel Sentinel
+	streak   *punctuationStreak
+}
+
+func (d *sentinelDetector) Name() string        { return DetectorSentinel }
+func (d *sentinelDetector) Instruction() string { return d.sentinel.Instruction }
+func (d *sentinelDetector) Sentinel() string    { return d.sentinel.Token }
+
+func (d *sentinelDetector) CheckComplete(text string) error {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasSuffix(trimmed, d.sentinel.Token) {
+		return nil
+	}
+	return fmt.Errorf("text ends with '%s' instead of %s", lastRune(trimmed), d.sentinel.Token)
+}
+
+func (d *sentinelDetector) AcceptInterruptedAttempt(lastFormalText string) bool {
+	return d.streak != nil && d.streak.accept(lastFormalText)
+}
+
+// punctuationDetector accepts answers ending with sentence punctuation
+type punctuationDetector struct {
+	streak punctuationStreak
+}
+
+func (d *punctuationDetector) Name() string        { return DetectorPunctuation }
+func (d *punctuationDetector) Instruction() string { return "" }
+
+func (d *punctuationDetector) CheckComplete(text string) error {
+	if endsWithSentencePunctuation(text) {
+		return nil
+	}
+	return fmt.Errorf("text ends with '%s', which is not sentence punctuation", lastRune(strings.TrimSpace(text)))
+}
+
+func (d *punctuationDetector) AcceptInterruptedAttempt(lastFormalText string) bool {
+	return d.streak.accept(lastFormalText)
+}
+
+// balancedDetector requires every markdown code fence to be closed and the brackets
+// inside fenced code to be balanced. Brackets in prose are ignored because list
+// markers such as "1)" are common there.
+type balancedDetector struct {
+	streak *punctuationStreak
+}
+
+func (d *balancedDetector) Name() string        { return DetectorBalanced }
+func (d *balancedDetector) Instruction() string { return "" }
+
+func (d *balancedDetector) CheckComplete(text string) error {
+	return checkBalanced(text)
+}
+
+func (d *balancedDetector) AcceptInterruptedAttempt(lastFormalText string) bool {
+	return d.streak != nil && d.streak.accept(lastFormalText)
+}
+
+// jsonDetector requires the answer to be a complete JSON document. A document that does not
+// match the response schema is still complete (see CheckJSONCompletion).
+type jsonDetector struct {
+	schema map[string]interface{}
+}
+
+func (d *jsonDetector) Name() string        { return DetectorJSON }
+func (d *jsonDetector) Instruction() string { return "" }
+
+func (d *jsonDetector) CheckComplete(text string) error {
+	return CheckJSONCompletion(text, d.schema)
+}
+
+// trustStopDetector accepts every STOP as final; only drops, blocks and abnormal finishes are retried
+type trustStopDetector struct{}
+
+func (trustStopDetector) Name() string               { return DetectorTrustStop }
+func (trustStopDetector) Instruction() string        { return "" }
+func (trustStopDetector) CheckComplete(string) error { return nil }
+
+// punctuationStreak counts consecutive interrupted resume attempts whose last formal text
+// ends with sentence punctuation
+type punctuationStreak struct {
+	threshold int
+	count     int
+}
+
+func (s *punctuationStreak) accept(lastFormalText string) bool {
+	if lastFormalText != "" && endsWithSentencePunctuation(lastFormalText) {
+		s.count++
+		logger.LogInfo(fmt.Sprintf("Resume punctuation streak incremented to %d (last formal text ends with sentence punctuation)", s.count))
+	} else {
+		if lastFormalText == "" {
+			logger.LogDebug("No formal text in this attempt; resetting resume punctuation streak to 0")
+		} else {
+			logger.LogDebug("Last formal text does not end with sentence punctuation; resetting resume punctuation streak to 0")
+		}
+		s.count = 0
+	}
+
+	if s.count >= s.threshold {
+		logger.LogInfo(fmt.Sprintf("Treating stream as successful due to %d consecutive resume attempts ending with sentence punctuation.", s.count))
+		return true
+	}
+	return false
+}
+
+// fresh returns a streak with the same threshold and no count; nil stays nil
+func (s *punctuationStreak) fresh() *punctuationStreak {
+	if s == nil {
+		return nil
+	}
+	return &punctuationStreak{threshold: s.threshold}
+}
+
+// checkBalanced reports unclosed code fences and unbalanced brackets inside fenced code
+func checkBalanced(text string) error {
+	inFence := false
+	var stack []rune
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if inFence && len(stack) > 0 {
+				return fmt.Errorf("unbalanced '%c' in code block", stack[len(stack)-1])
+			}
+			inFence = !inFence
+			stack = stack[:0]
+			continue
+		}
+		if !inFence {
+			continue
+		}
+
+		inString := false
+		escaped := false
+		for _, r := range line {
+			if inString {
+				switch {
+				case escaped:
+					escaped = false
+				case r == '\\':
+					escaped = true
+				case r == '"':
+					inString = false
+				}
+				continue
+			}
+			switch r {
+			case '"':
+				inString = true
+			case '(', '[', '{':
+				stack = append(stack, r)
+			case ')', ']', '}':
+				if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+					return fmt.Errorf("unexpected '%c' in code block", r)
+				}
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if inFence {
+		return fmt.Errorf("unclosed code fence")
+	}
+	return nil
+}
+
+func lastRune(text string) string {
+	runes := []rune(text)
+	if len(runes) == 0 {
+		return ""
+	}
+	return string(runes[len(runes)-1])
+}
+
+// cloneDetector returns a detector with the same configuration and fresh session state, so that
+// every candidate of a multi-candidate response is judged independently
+func cloneDetector(detector CompletionDetector) CompletionDetector {
+	switch d := detector.(type) {
+	case *sentinelDetector:
+		return &sentinelDetector{sentinel: d.sentinel, streak: d.streak.fresh()}
+	case *punctuationDetector:
+		return &punctuationDetector{streak: punctuationStreak{threshold: d.streak.threshold}}
+	case *balancedDetector:
+		return &balancedDetector{streak: d.streak.fresh()}
+	case *jsonDetector:
+		return &jsonDetector{schema: d.schema}
+	default:
+		return detector
+	}
+}
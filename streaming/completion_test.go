@@ -0,0 +1,296 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+// jsonModeRequest asks for a JSON document matching a schema
+const jsonModeRequest = `{
+	"contents": [{"role": "user", "parts": [{"text": "Name a sea."}]}],
+	"generationConfig": {
+		"responseMimeType": "application/json",
+		"responseSchema": {"type": "OBJECT", "properties": {"name": {"type": "STRING"}}}
+	}
+}`
+
+func newTestDetector(t *testing.T, name string, cfg *config.Config) CompletionDetector {
+	t.Helper()
+	detector, err := NewCompletionDetector(name, cfg, Sentinel{Token: DefaultSentinelToken}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return detector
+}
+
+func TestCompletionDetectors(t *testing.T) {
+	tests := []struct {
+		detector string
+		name     string
+		text     string
+		complete bool
+	}{
+		{DetectorSentinel, "token at the end", "Waves fold into foam. [done]", true},
+		{DetectorSentinel, "token before trailing whitespace", "Waves fold into foam. [done]\n", true},
+		{DetectorSentinel, "no token", "Waves fold into foam.", false},
+		{DetectorSentinel, "token in the middle", "Waves fold [done] into foam.", false},
+		{DetectorSentinel, "token cut short", "Waves fold into foam. [do", false},
+
+		{DetectorPunctuation, "full stop", "Waves fold into foam.", true},
+		{DetectorPunctuation, "question mark", "Is that the tide?", true},
+		{DetectorPunctuation, "closing quote", `She said "the tide."`, true},
+		{DetectorPunctuation, "ideographic full stop", "长城是中国古代的军事防御工程。", true},
+		{DetectorPunctuation, "trailing newline", "Waves fold into foam\n", true},
+		{DetectorPunctuation, "mid-sentence", "Waves fold into", false},
+		{DetectorPunctuation, "comma", "长城是中国古代的军事防御工程，", false},
+		{DetectorPunctuation, "whitespace only", " \n ", false},
+
+		{DetectorBalanced, "prose", "Steps: 1) fold 2) foam", true},
+		{DetectorBalanced, "closed fence", "Run this:\n```go\nfunc main() { fmt.Println(\"hi\") }\n```\nDone", true},
+		{DetectorBalanced, "brackets inside strings", "```js\nconsole.log(\"(\", \"[\");\n```", true},
+		{DetectorBalanced, "escaped quote in string", "```js\nconsole.log(\"\\\")\");\n```", true},
+		{DetectorBalanced, "unclosed fence", "Run this:\n```go\nfunc main() {}", false},
+		{DetectorBalanced, "unbalanced brackets", "```go\nfunc main() {\n```", false},
+		{DetectorBalanced, "mismatched brackets", "```go\nf(x]\n```", false},
+		{DetectorBalanced, "closing bracket first", "```\n)\n```", false},
+
+		{DetectorJSON, "document", `{"name": "Baltic"}`, true},
+		{DetectorJSON, "truncated document", `{"name": "Bal`, false},
+		{DetectorJSON, "prose", "The Baltic.", false},
+
+		{DetectorTrustStop, "mid-sentence", "Waves fold into", true},
+		{DetectorTrustStop, "empty", "", true},
+	}
+
+	cfg := &config.Config{}
+	for _, tt := range tests {
+		t.Run(tt.detector+"/"+tt.name, func(t *testing.T) {
+			err := newTestDetector(t, tt.detector, cfg).CheckComplete(tt.text)
+			if complete := err == nil; complete != tt.complete {
+				t.Errorf("CheckComplete(%q) = %v, want complete=%t", tt.text, err, tt.complete)
+			}
+		})
+	}
+}
+
+func TestNewCompletionDetector(t *testing.T) {
+	cfg := &config.Config{}
+	for _, name := range DetectorNames() {
+		if got := newTestDetector(t, name, cfg).Name(); got != name {
+			t.Errorf("NewCompletionDetector(%q) created %q", name, got)
+		}
+	}
+	if got := newTestDetector(t, " Balanced ", cfg).Name(); got != DetectorBalanced {
+		t.Errorf("NewCompletionDetector(\" Balanced \") created %q", got)
+	}
+
+	_, err := NewCompletionDetector("done", cfg, Sentinel{Token: DefaultSentinelToken}, nil)
+	if err == nil || !strings.Contains(err.Error(), strings.Join(DetectorNames(), ", ")) {
+		t.Errorf("NewCompletionDetector(\"done\") = %v, want an error listing the detectors", err)
+	}
+}
+
+func TestDetectorInstructions(t *testing.T) {
+	cfg := &config.Config{}
+	sentinel := Sentinel{Token: "<<END>>", Instruction: "End with <<END>>."}
+	for _, name := range DetectorNames() {
+		detector, err := NewCompletionDetector(name, cfg, sentinel, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, strips := detector.(SentinelStripper)
+		if name == DetectorSentinel {
+			if detector.Instruction() != sentinel.Instruction || !strips || detector.(SentinelStripper).Sentinel() != sentinel.Token {
+				t.Errorf("the sentinel detector asks for %q and strips %t", detector.Instruction(), strips)
+			}
+			continue
+		}
+		// The other detectors judge the output as the model writes it
+		if detector.Instruction() != "" || strips {
+			t.Errorf("the %s detector asks for %q and strips %t", name, detector.Instruction(), strips)
+		}
+	}
+}
+
+func TestResolveCompletionDetector(t *testing.T) {
+	cfg := &config.Config{
+		CompletionDetector:       DetectorSentinel,
+		CompletionDetectorModels: map[string]string{"gemini-flash": DetectorPunctuation},
+		JSONModeValidateSchema:   true,
+	}
+	tests := []struct {
+		name      string
+		model     string
+		requested string
+		request   string
+		want      string
+	}{
+		{"default", "gemini-pro", "", testRequest, DetectorSentinel},
+		{"per model", "gemini-flash", "", testRequest, DetectorPunctuation},
+		{"JSON mode", "gemini-pro", "", jsonModeRequest, DetectorJSON},
+		{"JSON mode over the model", "gemini-flash", "", jsonModeRequest, DetectorJSON},
+		{"request over the model", "gemini-flash", DetectorTrustStop, testRequest, DetectorTrustStop},
+		{"request over JSON mode", "gemini-pro", DetectorSentinel, jsonModeRequest, DetectorSentinel},
+		{"request over the model in JSON mode", "gemini-flash", DetectorBalanced, jsonModeRequest, DetectorBalanced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := gemini.ParseRequest([]byte(tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			detector, err := ResolveCompletionDetector(cfg, tt.model, tt.requested, "en", request)
+			if err != nil {
+				t.Fatalf("ResolveCompletionDetector: %v", err)
+			}
+			if detector.Name() != tt.want {
+				t.Errorf("picked the %s detector, want %s", detector.Name(), tt.want)
+			}
+		})
+	}
+
+	t.Run("sentinel requested in JSON mode", func(t *testing.T) {
+		request, _ := gemini.ParseRequest([]byte(jsonModeRequest))
+		detector, err := ResolveCompletionDetector(cfg, "gemini-pro", DetectorSentinel, "en", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The client asked for the sentinel, so the model is told to write it
+		if !strings.Contains(detector.Instruction(), DefaultSentinelToken) {
+			t.Errorf("instruction %q does not ask for %s", detector.Instruction(), DefaultSentinelToken)
+		}
+	})
+
+	t.Run("JSON mode with schema", func(t *testing.T) {
+		request, _ := gemini.ParseRequest([]byte(jsonModeRequest))
+		detector, err := ResolveCompletionDetector(cfg, "gemini-pro", "", "en", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, ok := detector.(*jsonDetector); !ok || d.schema == nil {
+			t.Errorf("the JSON detector does not check the response schema")
+		}
+	})
+
+	t.Run("unknown detector requested", func(t *testing.T) {
+		request, _ := gemini.ParseRequest([]byte(testRequest))
+		if _, err := ResolveCompletionDetector(cfg, "gemini-pro", "done", "en", request); err == nil {
+			t.Error("ResolveCompletionDetector accepted an unknown detector")
+		}
+	})
+}
+
+func TestAcceptInterruptedAttempt(t *testing.T) {
+	tests := []struct {
+		name      string
+		detector  string
+		heuristic bool
+		attempts  []string
+		// accepted is the attempt accepted as a finished answer, -1 for none
+		accepted int
+	}{
+		{"punctuation streak", DetectorPunctuation, false, []string{"One.", "Two.", "Three."}, 2},
+		{"streak reset by an unfinished attempt", DetectorPunctuation, false, []string{"One.", "Two", "Three.", "Four.", "Five."}, 4},
+		{"streak reset by an attempt without text", DetectorPunctuation, false, []string{"One.", "Two.", "", "Three."}, -1},
+		{"sentinel with the heuristic", DetectorSentinel, true, []string{"One.", "Two.", "Three."}, 2},
+		{"sentinel without the heuristic", DetectorSentinel, false, []string{"One.", "Two.", "Three.", "Four."}, -1},
+		{"balanced with the heuristic", DetectorBalanced, true, []string{"One.", "Two.", "Three."}, 2},
+		{"balanced without the heuristic", DetectorBalanced, false, []string{"One.", "Two.", "Three.", "Four."}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector := newTestDetector(t, tt.detector, &config.Config{EnablePunctuationHeuristic: tt.heuristic})
+			judge := detector.(AttemptJudge)
+			accepted := -1
+			for i, text := range tt.attempts {
+				if judge.AcceptInterruptedAttempt(text) {
+					accepted = i
+					break
+				}
+			}
+			if accepted != tt.accepted {
+				t.Errorf("accepted attempt %d, want %d", accepted, tt.accepted)
+			}
+		})
+	}
+
+	// Detectors that judge the whole answer never accept an interrupted attempt
+	for _, name := range []string{DetectorJSON, DetectorTrustStop} {
+		if _, ok := newTestDetector(t, name, &config.Config{EnablePunctuationHeuristic: true}).(AttemptJudge); ok {
+			t.Errorf("the %s detector judges interrupted attempts", name)
+		}
+	}
+}
+
+func TestCloneDetector(t *testing.T) {
+	for _, name := range []string{DetectorSentinel, DetectorPunctuation, DetectorBalanced} {
+		t.Run(name, func(t *testing.T) {
+			detector := newTestDetector(t, name, &config.Config{EnablePunctuationHeuristic: true})
+			detector.(AttemptJudge).AcceptInterruptedAttempt("One.")
+			detector.(AttemptJudge).AcceptInterruptedAttempt("Two.")
+
+			// The clone starts its own streak, and leaves the one of the original alone
+			clone := cloneDetector(detector)
+			if clone.Name() != name {
+				t.Fatalf("clone is a %s detector", clone.Name())
+			}
+			if clone.(AttemptJudge).AcceptInterruptedAttempt("Three.") {
+				t.Error("the clone took over the streak of the original")
+			}
+			if !detector.(AttemptJudge).AcceptInterruptedAttempt("Three.") {
+				t.Error("cloning reset the streak of the original")
+			}
+		})
+	}
+}
+
+func TestSessionCompletionDetectors(t *testing.T) {
+	tests := []struct {
+		detector string
+		// streamed is the text of the first chunk, stop the text of the STOP chunk after it
+		streamed, stop string
+		resumed        string
+		want           string
+		// wantRetries is the number of retry requests
+		wantRetries int
+	}{
+		{DetectorSentinel, "One, two,", "", " three. [done]", "One, two, three. ", 1},
+		{DetectorSentinel, "One, two,", " three. [done]", "", "One, two, three. ", 0},
+		{DetectorPunctuation, "One, two,", "", " three.", "One, two, three.", 1},
+		{DetectorPunctuation, "One, two,", " three.", "", "One, two, three.", 0},
+		{DetectorBalanced, "```\ncount(1, 2,", "", " 3)\n```", "```\ncount(1, 2, 3)\n```", 1},
+		{DetectorBalanced, "```\ncount(1, 2,", " 3)\n```", "", "```\ncount(1, 2, 3)\n```", 0},
+		{DetectorJSON, `{"count": [1, 2,`, "", ` 3]}`, `{"count": [1, 2, 3]}`, 1},
+		{DetectorJSON, `{"count": [1, 2,`, ` 3]}`, "", `{"count": [1, 2, 3]}`, 0},
+		{DetectorTrustStop, "One, two,", "", "", "One, two,", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.detector+"/"+tt.streamed+tt.stop, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(tt.resumed, "STOP")})
+			cfg := testSessionConfig()
+			detector := newTestDetector(t, tt.detector, cfg)
+			initial := sseChunk(tt.streamed, "") + sseChunk(tt.stop, "STOP")
+
+			writer, err := runSessionDetector(context.Background(), t, cfg, detector, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), testRequest, io.NopCloser(strings.NewReader(initial)))
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := writer.text(); got != tt.want {
+				t.Errorf("client received %q, want %q", got, tt.want)
+			}
+			if got := len(upstream.Requests()); got != tt.wantRetries {
+				t.Errorf("upstream received %d retry requests, want %d", got, tt.wantRetries)
+			}
+		})
+	}
+}
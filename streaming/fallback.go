@@ -0,0 +1,113 @@
+package streaming
+
+import (
+	"fmt"
+	"strings"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// ModelRoute tracks the models a session talks to. When the requested model has a fallback
+// chain (MODEL_FALLBACK_CHAINS_JSON), the session moves down the chain for its later attempts
+// once the current model failed MODEL_FALLBACK_AFTER_JSON times for one reason.
+type ModelRoute struct {
+	// chain is the requested model followed by its fallbacks, position the current one
+	chain    []string
+	position int
+	after    map[string]int
+	// failures counts the failures of the current model per reason
+	failures map[string]int
+	// served is the model of the last attempt that got a stream
+	served string
+}
+
+// NewModelRoute creates the route of a request for model
+func NewModelRoute(cfg *config.Config, model string) *ModelRoute {
+	route := &ModelRoute{chain: []string{model}, after: cfg.ModelFallbackAfter, failures: map[string]int{}, served: model}
+	if fallbacks := cfg.ModelFallbackChains[model]; model != "" && len(fallbacks) > 0 {
+		route.chain = append(route.chain, fallbacks...)
+		logger.LogInfo(fmt.Sprintf("Model fallback chain: %s", strings.Join(route.chain, " -> ")))
+	}
+	return route
+}
+
+// Current returns the model later attempts are sent to
+func (r *ModelRoute) Current() string {
+	return r.chain[r.position]
+}
+
+// Served returns the model of the last attempt, the one that finished the answer once the
+// session is over
+func (r *ModelRoute) Served() string {
+	return r.served
+}
+
+// Fail records a failure of the current model: an interruption reason such as BLOCK, or the
+// HTTP status code of a failed retry request. It reports whether the failure moved the route
+// to the next model of the chain.
+func (r *ModelRoute) Fail(reason string) bool {
+	limit := r.after[reason]
+	if limit <= 0 || r.position == len(r.chain)-1 {
+		return false
+	}
+
+	r.failures[reason]++
+	if r.failures[reason] < limit {
+		logger.LogDebug(fmt.Sprintf("Model %s failed with %s %d of %d times before falling back", r.Current(), reason, r.failures[reason], limit))
+		return false
+	}
+
+	failed := r.Current()
+	r.position++
+	r.failures = map[string]int{}
+	logger.LogInfo(fmt.Sprintf("Model %s failed %d times with %s. Falling back to %s.", failed, limit, reason, r.Current()))
+	return true
+}
+
+// URL returns upstreamURL with the model of the request replaced by the current model
+func (r *ModelRoute) URL(upstreamURL string) string {
+	if r.position == 0 {
+		return upstreamURL
+	}
+	return withModel(upstreamURL, r.Current())
+}
+
+// serve records the model of an upstream URL that delivered an attempt's stream
+func (r *ModelRoute) serve(upstreamURL string) {
+	if model := urlModel(upstreamURL); model != "" {
+		r.served = model
+	}
+}
+
+// withModel rewrites the model of a generateContent URL (".../models/{model}:method")
+func withModel(upstreamURL, model string) string {
+	start, end := modelSegment(upstreamURL)
+	if start < 0 {
+		return upstreamURL
+	}
+	return upstreamURL[:start] + model + upstreamURL[end:]
+}
+
+// urlModel returns the model of a generateContent URL, or "" when it names none
+func urlModel(upstreamURL string) string {
+	start, end := modelSegment(upstreamURL)
+	if start < 0 {
+		return ""
+	}
+	return upstreamURL[start:end]
+}
+
+// modelSegment returns the position of the model name in a generateContent URL, or -1, -1
+func modelSegment(upstreamURL string) (int, int) {
+	start := strings.Index(upstreamURL, "/models/")
+	if start < 0 {
+		return -1, -1
+	}
+	start += len("/models/")
+	end := strings.IndexByte(upstreamURL[start:], ':')
+	if end < 0 {
+		return -1, -1
+	}
+	return start, start + end
+}
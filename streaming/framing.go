@@ -0,0 +1,174 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// Framing is the wire format of a streamGenerateContent response
+type Framing int
+
+const (
+	// FramingSSE is server-sent events, requested with alt=sse
+	FramingSSE Framing = iota
+	// FramingJSONArray is a JSON array whose elements are streamed one by one (the default without alt=sse)
+	FramingJSONArray
+)
+
+// RequestFraming returns the framing a client asked for in the query of a streaming request
+func RequestFraming(query url.Values) Framing {
+	if query.Get("alt") == "sse" {
+		return FramingSSE
+	}
+	return FramingJSONArray
+}
+
+// StreamEventIterator detects the framing of an upstream response body and emits its chunks as
+// SSE events, so the retry engine handles both framings alike. A body starting with '[' is
+// decoded as a JSON array stream, anything else as SSE.
+func StreamEventIterator(ctx context.Context, reader io.Reader, maxEventSize int, ch chan<- SSEEvent) {
+	buffered := bufio.NewReader(reader)
+	for {
+		b, err := buffered.Peek(1)
+		if err != nil || !isJSONSpace(b[0]) {
+			if err == nil && b[0] == '[' {
+				JSONArrayEventIterator(ctx, buffered, ch)
+				return
+			}
+			break
+		}
+		buffered.ReadByte()
+	}
+	SSEEventIterator(ctx, buffered, maxEventSize, ch)
+}
+
+// JSONArrayEventIterator decodes a streamed JSON array and emits every element as the data of
+// an SSE message event. It returns (closing ch) when the array ends, the stream breaks off or
+// ctx is done.
+func JSONArrayEventIterator(ctx context.Context, reader io.Reader, ch chan<- SSEEvent) {
+	defer close(ch)
+
+	decoder := json.NewDecoder(reader)
+	elementCount := 0
+
+	logger.LogDebug("Starting JSON array stream iteration")
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		logger.LogError(fmt.Sprintf("JSON array stream does not start with '[' (token %v, error %v)", token, err))
+		return
+	}
+
+	for decoder.More() {
+		var element json.RawMessage
+		if err := decoder.Decode(&element); err != nil {
+			if ctx.Err() == nil {
+				logger.LogError("Error reading JSON array stream:", err)
+			}
+			return
+		}
+
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, element); err != nil {
+			logger.LogError("Invalid element in JSON array stream:", err)
+			return
+		}
+
+		elementCount++
+		select {
+		case ch <- SSEEvent{Data: compact.String()}:
+		case <-ctx.Done():
+			logger.LogDebug("JSON array stream iteration cancelled")
+			return
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		logger.LogError("JSON array stream ended without closing ']':", err)
+	}
+
+	logger.LogDebug(fmt.Sprintf("JSON array stream ended. Total elements processed: %d", elementCount))
+}
+
+func isJSONSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// JSONArrayWriter writes the session output to the client as a streamed JSON array, the framing
+// of streamGenerateContent without alt=sse. Close must be called to terminate the array.
+type JSONArrayWriter struct {
+	w       io.Writer
+	started bool
+	closed  bool
+}
+
+// NewJSONArrayWriter creates a writer emitting a streamed JSON array to w
+func NewJSONArrayWriter(w io.Writer) *JSONArrayWriter {
+	return &JSONArrayWriter{w: w}
+}
+
+// BeginAttempt is a no-op: attempts are stitched into one array
+func (j *JSONArrayWriter) BeginAttempt() {}
+
+// WriteEvent writes the data of a message event as the next array element. Other events are dropped.
+func (j *JSONArrayWriter) WriteEvent(event SSEEvent) error {
+	if !event.IsMessage() {
+		return nil
+	}
+	return j.writeElement(strings.TrimSpace(event.Data))
+}
+
+// WriteError writes the error as the last array element and closes the array
+func (j *JSONArrayWriter) WriteError(payload []byte) {
+	j.writeElement(string(payload))
+	j.Close()
+}
+
+// Close terminates the array; it is safe to call more than once
+func (j *JSONArrayWriter) Close() error {
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+
+	closing := "]"
+	if !j.started {
+		closing = "[]"
+	}
+	if _, err := j.w.Write([]byte(closing)); err != nil {
+		return err
+	}
+	j.flush()
+	return nil
+}
+
+func (j *JSONArrayWriter) writeElement(element string) error {
+	if j.closed {
+		return fmt.Errorf("JSON array stream already closed")
+	}
+
+	separator := ",\r\n"
+	if !j.started {
+		separator = "["
+		j.started = true
+	}
+	if _, err := j.w.Write([]byte(separator + element)); err != nil {
+		return err
+	}
+	j.flush()
+	return nil
+}
+
+func (j *JSONArrayWriter) flush() {
+	if flusher, ok := j.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,197 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/gemini"
+)
+
+// jsonChunk returns the JSON of a chunk carrying text of candidate 0, as a JSON array stream
+// carries it
+func jsonChunk(text, finishReason string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(sseChunk(text, finishReason), "data: "), "\n\n")
+}
+
+func TestStreamEventIterator(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"sse", "data: {\"a\":1}\n\ndata: {\"b\":2}\n\n", []string{`{"a":1}`, `{"b":2}`}},
+		{"sse after blank lines", "\r\n\r\ndata: {\"a\":1}\r\n\r\n", []string{`{"a":1}`}},
+		{"json array", `[{"a":1},{"b":2}]`, []string{`{"a":1}`, `{"b":2}`}},
+		{"json array after whitespace", "\r\n \t[ {\"a\": 1} ,\r\n {\"b\": [2, 3]}\n]\n", []string{`{"a":1}`, `{"b":[2,3]}`}},
+		{"empty json array", "[]", nil},
+		{"truncated json array", `[{"a":1},{"b":`, []string{`{"a":1}`}},
+		{"json array without closing bracket", `[{"a":1},{"b":2}`, []string{`{"a":1}`, `{"b":2}`}},
+		{"whitespace only", " \n\t", nil},
+		{"empty", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan SSEEvent, 10)
+			go StreamEventIterator(context.Background(), strings.NewReader(tt.body), 1<<20, ch)
+			var got []string
+			for event := range ch {
+				if !event.IsMessage() {
+					t.Errorf("got a %q event", event.Event)
+				}
+				got = append(got, event.Data)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") || len(got) != len(tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONArrayWriter(t *testing.T) {
+	errorPayload := `{"error":{"code":504,"status":"DEADLINE_EXCEEDED"}}`
+	tests := []struct {
+		name  string
+		write func(w *JSONArrayWriter)
+		want  string
+	}{
+		{
+			name:  "nothing written",
+			write: func(w *JSONArrayWriter) {},
+			want:  `[]`,
+		},
+		{
+			name: "attempts stitched into one array",
+			write: func(w *JSONArrayWriter) {
+				w.BeginAttempt()
+				w.WriteEvent(SSEEvent{Data: `{"a":1}`})
+				w.BeginAttempt()
+				w.WriteEvent(SSEEvent{Data: "{\"b\":\n2}\n"})
+				w.WriteEvent(SSEEvent{Event: "message", Data: `{"c":3}`})
+			},
+			want: `[{"a":1},{"b":2},{"c":3}]`,
+		},
+		{
+			name: "other events dropped",
+			write: func(w *JSONArrayWriter) {
+				w.WriteEvent(SSEEvent{Event: "ping", Data: "keep-alive"})
+				w.WriteEvent(SSEEvent{Data: `{"a":1}`})
+			},
+			want: `[{"a":1}]`,
+		},
+		{
+			name: "error after events",
+			write: func(w *JSONArrayWriter) {
+				w.WriteEvent(SSEEvent{Data: `{"a":1}`})
+				w.WriteError([]byte(errorPayload))
+			},
+			want: `[{"a":1},` + errorPayload + `]`,
+		},
+		{
+			name:  "error only",
+			write: func(w *JSONArrayWriter) { w.WriteError([]byte(errorPayload)) },
+			want:  `[` + errorPayload + `]`,
+		},
+		{
+			name: "events after the error",
+			write: func(w *JSONArrayWriter) {
+				w.WriteError([]byte(errorPayload))
+				if err := w.WriteEvent(SSEEvent{Data: `{"a":1}`}); err == nil {
+					t.Error("WriteEvent after WriteError succeeded")
+				}
+			},
+			want: `[` + errorPayload + `]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewJSONArrayWriter(&out)
+			tt.write(w)
+			// The handler always closes the writer, after the session wrote an error or not
+			w.Close()
+			w.Close()
+			if !json.Valid(out.Bytes()) {
+				t.Fatalf("output is not valid JSON: %s", out.Bytes())
+			}
+			assertJSONEqual(t, out.Bytes(), []byte(tt.want))
+		})
+	}
+}
+
+func TestJSONArrayOutputAcrossAttempts(t *testing.T) {
+	tests := []struct {
+		name      string
+		initial   string
+		responses []upstreamResponse
+		wantText  string
+		wantError bool
+	}{
+		{
+			name:      "resumed after a truncated array",
+			initial:   `[` + jsonChunk("One,", "") + `,` + jsonChunk(" two", ""),
+			responses: []upstreamResponse{{http.StatusOK, "[" + jsonChunk(",", "") + ",\r\n" + jsonChunk(" three.", "STOP") + "]"}},
+			wantText:  "One, two, three.",
+		},
+		{
+			name:      "resumed from an array into SSE",
+			initial:   `[` + jsonChunk("One,", ""),
+			responses: []upstreamResponse{{http.StatusOK, sseChunk(" two, three.", "STOP")}},
+			wantText:  "One, two, three.",
+		},
+		{
+			name:      "retry limit",
+			initial:   `[` + jsonChunk("One,", "") + `]`,
+			responses: []upstreamResponse{{http.StatusServiceUnavailable, `{"error": {"code": 503}}`}},
+			wantText:  "One,",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, tt.responses...)
+			request, err := gemini.ParseRequest([]byte(testRequest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := testSessionConfig()
+			cfg.MaxConsecutiveRetries = 2
+
+			var out bytes.Buffer
+			writer := NewJSONArrayWriter(&out)
+			err = ProcessStreamAndRetryInternally(context.Background(), cfg, trustStopDetector{}, ResumeStrategy{Name: ResumeTwoTurn}, NewModelRoute(cfg, "gemini-test"), io.NopCloser(strings.NewReader(tt.initial)), writer, request, upstream.URL("gemini-test"), http.Header{})
+			writer.Close()
+			if (err != nil) != tt.wantError {
+				t.Errorf("session error = %v, want error %t", err, tt.wantError)
+			}
+
+			var elements []json.RawMessage
+			if err := json.Unmarshal(out.Bytes(), &elements); err != nil {
+				t.Fatalf("output is not a JSON array: %v\n%s", err, out.Bytes())
+			}
+			var text strings.Builder
+			sawError := false
+			for _, element := range elements {
+				if bytes.Contains(element, []byte(`"error"`)) {
+					sawError = true
+					continue
+				}
+				text.WriteString(ParseChunkContent(ParseChunk(string(element))).Text)
+			}
+			if text.String() != tt.wantText {
+				t.Errorf("text = %q, want %q", text.String(), tt.wantText)
+			}
+			if sawError != tt.wantError {
+				t.Errorf("error element present = %t, want %t", sawError, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// raceBody is the body of one request of a hedged retry. Closing it cancels the request.
+type raceBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	// events are the events read while racing and rest the channel the remaining ones arrive
+	// on. Both are nil when the response was not a stream.
+	events []SSEEvent
+	rest   <-chan SSEEvent
+}
+
+// Close cancels the request and closes the upstream body
+func (b *raceBody) Close() error {
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// replay sends the events read while racing, followed by the rest of the stream. It returns
+// (closing ch) when the stream ends or ctx is done.
+func (b *raceBody) replay(ctx context.Context, ch chan<- SSEEvent) {
+	defer close(ch)
+	for _, event := range b.events {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+	for event := range b.rest {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// raceResult is the outcome of one request of a hedged retry
+type raceResult struct {
+	index    int
+	response *http.Response
+	err      error
+	// formal is set when the stream yielded formal output, which wins the race
+	formal bool
+	// elapsed is the time from sending the request to the result
+	elapsed time.Duration
+}
+
+// hedgeWidth returns how many requests to send at once for the next retry: HEDGED_RETRY_REQUESTS,
+// reduced to what is left of the extra requests the session may spend
+func (s *streamSession) hedgeWidth() int {
+	width := s.cfg.HedgedRetryRequests
+	if width <= 1 {
+		return 1
+	}
+	if limit := s.cfg.HedgedRetryMaxExtra; limit > 0 {
+		width = min(width, 1+limit-s.hedgeExtraRequests)
+	}
+	return max(width, 1)
+}
+
+// hedgedRetry sends width copies of a retry request at once and returns the response of the
+// first one whose stream yields formal output (text or a function call); the others are
+// cancelled. The stream of the returned response starts over with the events read while racing.
+// When no stream yields formal output, the first stream that ended is returned so the retry
+// loop judges it as usual, else the first upstream error response, else the first error.
+//
+// The first request is the retry as configured. The others take turns with the alternative API
+// keys and models of HEDGED_RETRY_API_KEYS_JSON and HEDGED_RETRY_MODELS_JSON, when set.
+func (s *streamSession) hedgedRetry(ctx context.Context, width int, upstreamURL string, body []byte, headers http.Header) (*http.Response, error) {
+	s.hedgeExtraRequests += width - 1
+	logger.LogInfo(fmt.Sprintf("Hedged retry: sending %d requests at once (%d extra requests spent so far)", width, s.hedgeExtraRequests))
+
+	results := make(chan raceResult, width)
+	cancels := make([]context.CancelFunc, width)
+	for i := range cancels {
+		var raceCtx context.Context
+		raceCtx, cancels[i] = context.WithCancel(ctx)
+		go s.race(raceCtx, cancels[i], i, upstreamURL, body, headers, results)
+	}
+
+	var winner, ended, failed, broken *raceResult
+	pending := width
+	for ; pending > 0 && winner == nil; pending-- {
+		result := <-results
+		switch {
+		case result.formal:
+			winner = &result
+		case result.err != nil:
+			logger.LogError(fmt.Sprintf("Hedged request %d failed after %v: %v", result.index, result.elapsed, result.err))
+			broken = firstResult(broken, &result)
+		case result.response.StatusCode != http.StatusOK:
+			logger.LogError(fmt.Sprintf("Hedged request %d failed after %v with status %d", result.index, result.elapsed, result.response.StatusCode))
+			failed = firstResult(failed, &result)
+		default:
+			logger.LogError(fmt.Sprintf("Hedged request %d: stream ended after %v without formal output", result.index, result.elapsed))
+			ended = firstResult(ended, &result)
+		}
+	}
+
+	// Cancel the requests still racing, and release those that lost
+	for i, cancel := range cancels {
+		if winner == nil || i != winner.index {
+			cancel()
+		}
+	}
+	go func(pending int) {
+		for ; pending > 0; pending-- {
+			discardRaceResult(<-results)
+		}
+	}(pending)
+
+	chosen := winner
+	for _, candidate := range []*raceResult{ended, failed, broken} {
+		if chosen == nil {
+			chosen = candidate
+		} else if candidate != nil {
+			discardRaceResult(*candidate)
+		}
+	}
+
+	if winner != nil {
+		logger.LogInfo(fmt.Sprintf("Hedged request %d won the race: first formal output after %v", winner.index, winner.elapsed))
+	}
+	return chosen.response, chosen.err
+}
+
+// race sends request i of a hedged retry and reads its stream up to the first formal output, or
+// until ctx is cancelled. The body of the response it reports cancels ctx when closed.
+func (s *streamSession) race(ctx context.Context, cancel context.CancelFunc, i int, upstreamURL string, body []byte, headers http.Header, results chan<- raceResult) {
+	start := time.Now()
+
+	requestURL, key := s.hedgeVariant(i, upstreamURL)
+	request, err := newRetryRequest(ctx, requestURL, body, headers)
+	if err == nil && key != "" {
+		setAPIKey(request, key)
+	}
+	var response *http.Response
+	if err == nil {
+		response, err = (&http.Client{}).Do(request)
+	}
+	if err != nil {
+		cancel()
+		results <- raceResult{index: i, err: err, elapsed: time.Since(start)}
+		return
+	}
+
+	raced := &raceBody{ReadCloser: response.Body, cancel: cancel}
+	response.Body = raced
+	if response.StatusCode != http.StatusOK {
+		results <- raceResult{index: i, response: response, elapsed: time.Since(start)}
+		return
+	}
+
+	eventCh := make(chan SSEEvent, 100)
+	go StreamEventIterator(ctx, raced.ReadCloser, s.cfg.SSEMaxEventBytes, eventCh)
+	raced.rest = eventCh
+	for event := range eventCh {
+		raced.events = append(raced.events, event)
+		if event.IsMessage() && hasFormalOutput(ParseChunk(event.Data)) {
+			results <- raceResult{index: i, response: response, formal: true, elapsed: time.Since(start)}
+			return
+		}
+	}
+	results <- raceResult{index: i, response: response, elapsed: time.Since(start)}
+}
+
+// hedgeVariant returns the upstream URL and the API key (empty to keep the client's) of request
+// i of a hedged retry
+func (s *streamSession) hedgeVariant(i int, upstreamURL string) (string, string) {
+	if i == 0 {
+		return upstreamURL, ""
+	}
+
+	key := ""
+	if keys := s.cfg.HedgedRetryAPIKeys; len(keys) > 0 {
+		key = keys[(i-1)%len(keys)]
+	}
+	if models := s.cfg.HedgedRetryModels; len(models) > 0 {
+		model := models[(i-1)%len(models)]
+		upstreamURL = withModel(upstreamURL, model)
+		logger.LogDebug(fmt.Sprintf("Hedged request %d uses model %s", i, model))
+	}
+	return upstreamURL, key
+}
+
+// hasFormalOutput reports whether a chunk carries formal text or a function call or other data
+// part
+func hasFormalOutput(chunk *Chunk) bool {
+	content := ParseChunkContent(chunk)
+	return content.Text != "" || len(content.DataParts) > 0
+}
+
+func firstResult(first, result *raceResult) *raceResult {
+	if first != nil {
+		discardRaceResult(*result)
+		return first
+	}
+	return result
+}
+
+func discardRaceResult(result raceResult) {
+	if result.response != nil {
+		result.response.Body.Close()
+	}
+}
+
+// setAPIKey replaces the client's credentials of a request with an API key, in the key query
+// parameter when the client used it and in the X-Goog-Api-Key header otherwise
+func setAPIKey(request *http.Request, key string) {
+	query := request.URL.Query()
+	if query.Has("key") {
+		query.Set("key", key)
+		request.URL.RawQuery = query.Encode()
+		return
+	}
+	request.Header.Del("Authorization")
+	request.Header.Set("X-Goog-Api-Key", key)
+}
@@ -0,0 +1,290 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sseThought returns an SSE message event carrying one thought of candidate 0
+func sseThought(text string) string {
+	return fmt.Sprintf("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":%q,\"thought\":true}]}}]}\n\n", text)
+}
+
+// hedgeModels are the models of the requests of a hedged retry of width 3: the first request
+// asks for the model of the retry, the others for the models of HEDGED_RETRY_MODELS_JSON
+var hedgeModels = []string{"gemini-test", "gemini-b", "gemini-c"}
+
+// newHedgeUpstream starts an upstream answering each request with the handler of the model it
+// asks for
+func newHedgeUpstream(t *testing.T, handlers map[string]http.HandlerFunc) string {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		model, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta/models/"), ":")
+		handlers[model](w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.URL + "/v1beta/models/gemini-test:streamGenerateContent?alt=sse"
+}
+
+// streamEvents answers with a stream of events
+func streamEvents(events ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			io.WriteString(w, event)
+		}
+	}
+}
+
+// stallAfter answers with a stream of events that then stalls until the request is abandoned
+func stallAfter(events ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		streamEvents(events...)(w, r)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+// failWith answers with an upstream error
+func failWith(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error": {"code": %d}}`, status)
+	}
+}
+
+// hedgeRequest is a request a session sent through trackingTransport
+type hedgeRequest struct {
+	model   string
+	request *http.Request
+	body    *trackedBody
+}
+
+// trackingTransport records the requests sent and whether their response bodies were closed
+type trackingTransport struct {
+	base     http.RoundTripper
+	mu       sync.Mutex
+	requests []hedgeRequest
+}
+
+// trackRequests routes the requests of the test through a trackingTransport
+func trackRequests(t *testing.T) *trackingTransport {
+	t.Helper()
+	transport := &trackingTransport{base: http.DefaultTransport}
+	http.DefaultTransport = transport
+	t.Cleanup(func() {
+		http.DefaultTransport = transport.base
+		transport.base.(*http.Transport).CloseIdleConnections()
+	})
+	return transport
+}
+
+func (tr *trackingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := tr.base.RoundTrip(request)
+	model, _, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, "/v1beta/models/"), ":")
+	sent := hedgeRequest{model: model, request: request}
+	if err == nil {
+		sent.body = &trackedBody{ReadCloser: response.Body}
+		response.Body = sent.body
+	}
+	tr.mu.Lock()
+	tr.requests = append(tr.requests, sent)
+	tr.mu.Unlock()
+	return response, err
+}
+
+// count returns how many requests were sent
+func (tr *trackingTransport) count() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.requests)
+}
+
+// released waits until the request of model is cancelled and its response body, if any, closed
+func (tr *trackingTransport) released(model string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		tr.mu.Lock()
+		for _, sent := range tr.requests {
+			if sent.model == model && sent.request.Context().Err() != nil && (sent.body == nil || sent.body.closed.Load()) {
+				tr.mu.Unlock()
+				return true
+			}
+		}
+		tr.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// hedgeSession returns a session sending three requests per retry, at most extra of them on
+// top of one per retry
+func hedgeSession(extra int) *streamSession {
+	cfg := testSessionConfig()
+	cfg.HedgedRetryRequests = len(hedgeModels)
+	cfg.HedgedRetryMaxExtra = extra
+	cfg.HedgedRetryModels = hedgeModels[1:]
+	return &streamSession{cfg: cfg}
+}
+
+// replayed returns the data of the events of a hedged retry response, as the retry loop reads them
+func replayed(t *testing.T, response *http.Response) []string {
+	t.Helper()
+	raced, ok := response.Body.(*raceBody)
+	if !ok || raced.rest == nil {
+		t.Fatalf("response body is a %T, not a raced stream", response.Body)
+	}
+	ch := make(chan SSEEvent, 100)
+	go raced.replay(context.Background(), ch)
+	var data []string
+	for event := range ch {
+		data = append(data, event.Data)
+	}
+	return data
+}
+
+func TestHedgeWidth(t *testing.T) {
+	tests := []struct {
+		requests, maxExtra, spent int
+		want                      int
+	}{
+		{requests: 1, maxExtra: 4, spent: 0, want: 1},
+		{requests: 0, maxExtra: 4, spent: 0, want: 1},
+		{requests: 3, maxExtra: 4, spent: 0, want: 3},
+		{requests: 3, maxExtra: 4, spent: 2, want: 3},
+		{requests: 3, maxExtra: 4, spent: 3, want: 2},
+		{requests: 3, maxExtra: 4, spent: 4, want: 1},
+		{requests: 3, maxExtra: 4, spent: 9, want: 1},
+		{requests: 3, maxExtra: 0, spent: 100, want: 3},
+	}
+	for _, tt := range tests {
+		cfg := testSessionConfig()
+		cfg.HedgedRetryRequests = tt.requests
+		cfg.HedgedRetryMaxExtra = tt.maxExtra
+		s := &streamSession{cfg: cfg, hedgeExtraRequests: tt.spent}
+		if got := s.hedgeWidth(); got != tt.want {
+			t.Errorf("hedgeWidth(requests=%d, maxExtra=%d, spent=%d) = %d, want %d", tt.requests, tt.maxExtra, tt.spent, got, tt.want)
+		}
+	}
+}
+
+func TestHedgedRetrySpendCap(t *testing.T) {
+	transport := trackRequests(t)
+	upstreamURL := newHedgeUpstream(t, map[string]http.HandlerFunc{
+		"gemini-test": failWith(http.StatusServiceUnavailable),
+		"gemini-b":    failWith(http.StatusServiceUnavailable),
+		"gemini-c":    failWith(http.StatusServiceUnavailable),
+	})
+
+	// Three extra requests: the first retry spends two, the second the last one
+	s := hedgeSession(3)
+	for retry, want := range []int{3, 2, 1, 1} {
+		before := transport.count()
+		response, err := s.sendRetry(context.Background(), upstreamURL, []byte(testRequest), http.Header{})
+		if err != nil {
+			t.Fatalf("retry %d: %v", retry, err)
+		}
+		response.Body.Close()
+		if got := transport.count() - before; got != want {
+			t.Errorf("retry %d sent %d requests, want %d", retry, got, want)
+		}
+	}
+	if s.hedgeExtraRequests != 3 {
+		t.Errorf("session spent %d extra requests, want 3", s.hedgeExtraRequests)
+	}
+}
+
+func TestHedgedRetryReleasesLosers(t *testing.T) {
+	transport := trackRequests(t)
+	upstreamURL := newHedgeUpstream(t, map[string]http.HandlerFunc{
+		// The second request wins while the first is still thinking and the third failed
+		"gemini-test": stallAfter(sseThought("Still thinking.")),
+		"gemini-b":    stallAfter(sseChunk("Hello", "")),
+		"gemini-c":    failWith(http.StatusServiceUnavailable),
+	})
+
+	response, err := hedgeSession(4).sendRetry(context.Background(), upstreamURL, []byte(testRequest), http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if model := urlModel(response.Request.URL.String()); model != "gemini-b" {
+		t.Errorf("request for %s won, want gemini-b", model)
+	}
+	for _, loser := range []string{"gemini-test", "gemini-c"} {
+		if !transport.released(loser) {
+			t.Errorf("losing request for %s was not cancelled and closed", loser)
+		}
+	}
+	if response.Request.Context().Err() != nil {
+		t.Error("the winning request was cancelled")
+	}
+
+	response.Body.Close()
+	if !transport.released("gemini-b") {
+		t.Error("closing the winning body did not cancel its request")
+	}
+}
+
+func TestHedgedRetryEndedStreamWins(t *testing.T) {
+	transport := trackRequests(t)
+	thought := sseThought("Nothing to add.")
+	upstreamURL := newHedgeUpstream(t, map[string]http.HandlerFunc{
+		// No request yields formal output: the stream that ended goes to the retry loop
+		"gemini-test": failWith(http.StatusServiceUnavailable),
+		"gemini-b":    streamEvents(thought),
+		"gemini-c":    failWith(http.StatusInternalServerError),
+	})
+
+	response, err := hedgeSession(4).sendRetry(context.Background(), upstreamURL, []byte(testRequest), http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || urlModel(response.Request.URL.String()) != "gemini-b" {
+		t.Fatalf("got status %d from %s, want the stream of gemini-b", response.StatusCode, response.Request.URL)
+	}
+	if got, want := replayed(t, response), []string{strings.TrimSuffix(strings.TrimPrefix(thought, "data: "), "\n\n")}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+	for _, loser := range []string{"gemini-test", "gemini-c"} {
+		if !transport.released(loser) {
+			t.Errorf("failed request for %s was not released", loser)
+		}
+	}
+}
+
+func TestHedgedRetryReplaysBufferedThoughts(t *testing.T) {
+	trackRequests(t)
+	events := []string{sseThought("First,"), sseThought(" second."), sseChunk("Hello", ""), sseChunk(" there.", "STOP")}
+	upstreamURL := newHedgeUpstream(t, map[string]http.HandlerFunc{
+		"gemini-test": streamEvents(events...),
+		"gemini-b":    stallAfter(),
+		"gemini-c":    stallAfter(),
+	})
+
+	response, err := hedgeSession(4).sendRetry(context.Background(), upstreamURL, []byte(testRequest), http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var want []string
+	for _, event := range events {
+		want = append(want, strings.TrimSuffix(strings.TrimPrefix(event, "data: "), "\n\n"))
+	}
+	if got := replayed(t, response); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replayed events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,251 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// jsonContinuationPrompt is the resume instruction used for JSON-mode requests. Retries drop the
+// response schema constraint (the model must emit a fragment, not a new document), so the prompt
+// carries the schema instead.
+const jsonContinuationPrompt = "Your previous response was cut off in the middle of a JSON document. Continue the JSON output exactly where it stopped: output only the remaining characters, starting with the very next character, without repeating anything, without markdown code fences and without any preamble or explanation."
+
+// IsJSONMode reports whether the request asks for structured JSON output via
+// generationConfig.responseMimeType=application/json or a response schema.
+func IsJSONMode(request *gemini.GenerateContentRequest) bool {
+	genConfig := request.GenerationConfig
+	if genConfig == nil {
+		return false
+	}
+
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(genConfig.ResponseMimeType)), "application/json") {
+		return true
+	}
+
+	_, hasSchema := ResponseSchema(request)
+	return hasSchema
+}
+
+// ResponseSchema returns the response schema of a JSON-mode request, if any.
+// Both the OpenAPI-style responseSchema and the JSON Schema responseJsonSchema are recognized.
+func ResponseSchema(request *gemini.GenerateContentRequest) (map[string]interface{}, bool) {
+	genConfig := request.GenerationConfig
+	if genConfig == nil {
+		return nil, false
+	}
+
+	for _, raw := range []json.RawMessage{genConfig.ResponseSchema, genConfig.ResponseJSONSchema} {
+		var schema map[string]interface{}
+		if len(raw) > 0 && json.Unmarshal(raw, &schema) == nil && schema != nil {
+			return schema, true
+		}
+	}
+	return nil, false
+}
+
+// CheckJSONCompletion reports whether text is a complete JSON document. The returned error
+// explains why the document is incomplete. When schema is non-nil a complete document is also
+// checked against it, but a mismatch is only logged: the document is finished, and resuming it
+// cannot make it match.
+func CheckJSONCompletion(text string, schema map[string]interface{}) error {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return fmt.Errorf("empty document")
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("trailing data after JSON document")
+	}
+
+	if schema != nil {
+		if err := validateJSONSchema(value, schema, "$"); err != nil {
+			logger.LogError(fmt.Sprintf("JSON document is complete but does not match the response schema: %v. Accepting it as is.", err))
+		}
+	}
+	return nil
+}
+
+// withoutJSONConstraints drops the structured output settings from a generation config, so that
+// a resumed attempt may produce a JSON fragment instead of a whole new document
+func withoutJSONConstraints(genConfig *gemini.GenerationConfig) {
+	genConfig.ResponseMimeType = ""
+	genConfig.ResponseSchema = nil
+	genConfig.ResponseJSONSchema = nil
+}
+
+// jsonResumePrompt builds the continuation instruction for a JSON-mode retry
+func jsonResumePrompt(request *gemini.GenerateContentRequest) string {
+	schema, ok := ResponseSchema(request)
+	if !ok {
+		return jsonContinuationPrompt
+	}
+	schemaBytes, err := json.Marshal(schema)
+	if err != nil {
+		return jsonContinuationPrompt
+	}
+	return jsonContinuationPrompt + " The complete document must conform to this schema: " + string(schemaBytes)
+}
+
+// validateJSONSchema checks value against the subset of schema keywords shared by the Gemini
+// OpenAPI Schema and JSON Schema: type, nullable, enum, properties, required, items,
+// minItems, maxItems and anyOf. Unknown keywords are ignored.
+func validateJSONSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && len(anyOf) > 0 {
+		var firstErr error
+		for _, option := range anyOf {
+			optionSchema, ok := option.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			err := validateJSONSchema(value, optionSchema, path)
+			if err == nil {
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		if schemaAllowsType(schema, "null") {
+			return nil
+		}
+		if _, hasType := schema["type"]; hasType {
+			return fmt.Errorf("%s: unexpected null", path)
+		}
+		return nil
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok && len(enum) > 0 {
+		matched := false
+		for _, candidate := range enum {
+			if fmt.Sprint(candidate) == fmt.Sprint(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value %v is not one of the allowed enum values", path, value)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if !schemaAllowsType(schema, "object") {
+			return fmt.Errorf("%s: unexpected object", path)
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				key, _ := name.(string)
+				if _, present := v[key]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for key, propValue := range v {
+				propSchema, ok := properties[key].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if err := validateJSONSchema(propValue, propSchema, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if !schemaAllowsType(schema, "array") {
+			return fmt.Errorf("%s: unexpected array", path)
+		}
+		if minItems, ok := schemaInt(schema, "minItems"); ok && len(v) < minItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", path, minItems, len(v))
+		}
+		if maxItems, ok := schemaInt(schema, "maxItems"); ok && len(v) > maxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", path, maxItems, len(v))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if !schemaAllowsType(schema, "string") {
+			return fmt.Errorf("%s: unexpected string", path)
+		}
+	case bool:
+		if !schemaAllowsType(schema, "boolean") {
+			return fmt.Errorf("%s: unexpected boolean", path)
+		}
+	case json.Number:
+		if schemaAllowsType(schema, "number") {
+			return nil
+		}
+		if schemaAllowsType(schema, "integer") {
+			if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+				return nil
+			}
+			return fmt.Errorf("%s: expected integer, got %s", path, v.String())
+		}
+		return fmt.Errorf("%s: unexpected number", path)
+	}
+	return nil
+}
+
+// schemaAllowsType reports whether the schema's "type" admits the given JSON type.
+// A schema without a type admits everything; type names are compared case-insensitively
+// because the Gemini Schema uses upper-case names (STRING, OBJECT, ...).
+func schemaAllowsType(schema map[string]interface{}, jsonType string) bool {
+	switch t := schema["type"].(type) {
+	case nil:
+		return true
+	case string:
+		return typeMatches(t, jsonType)
+	case []interface{}:
+		for _, entry := range t {
+			if name, ok := entry.(string); ok && typeMatches(name, jsonType) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func typeMatches(schemaType, jsonType string) bool {
+	return strings.ToLower(schemaType) == jsonType
+}
+
+func schemaInt(schema map[string]interface{}, key string) (int, bool) {
+	switch v := schema[key].(type) {
+	case float64:
+		return int(v), true
+	case string:
+		// The Gemini Schema encodes int64 fields as strings
+		var n int
+		if _, err := fmt.Sscanf(v, "%d", &n); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,37 @@
+package streaming
+
+import "testing"
+
+func TestCheckJSONCompletion(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"b"},
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		schema   map[string]interface{}
+		complete bool
+	}{
+		{"complete document", `{"a":1}`, nil, true},
+		{"surrounding whitespace", " \n{\"a\":1}\n", nil, true},
+		{"truncated object", `{"a":1,"b":`, nil, false},
+		{"truncated string", `{"a":"hel`, nil, false},
+		{"empty", "  ", nil, false},
+		{"trailing data", `{"a":1} {"b":2}`, nil, false},
+		{"not JSON", `Sure! {"a":1}`, nil, false},
+		{"matches schema", `{"a":1,"b":2}`, schema, true},
+		{"schema mismatch is complete", `{"a":1}`, schema, true},
+		{"truncated with schema", `{"a":1`, schema, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckJSONCompletion(tt.text, tt.schema)
+			if complete := err == nil; complete != tt.complete {
+				t.Errorf("CheckJSONCompletion(%q) = %v, want complete=%t", tt.text, err, tt.complete)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package streaming
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// overlapTail returns the end of the candidate's output a resumed attempt may repeat
+func (s *streamSession) overlapTail(c *candidateState) string {
+	return lastRunes(c.accumulator.Text(), s.cfg.ResumeOverlapWindow)
+}
+
+// lastRunes returns the last n characters of text
+func lastRunes(text string, n int) string {
+	start := len(text)
+	for ; n > 0 && start > 0; n-- {
+		_, size := utf8.DecodeLastRuneInString(text[:start])
+		start -= size
+	}
+	return text[start:]
+}
+
+// mayOverlap reports whether text, or a longer text starting with it, may still turn out to
+// repeat the end of tail
+func mayOverlap(tail, text string) bool {
+	if strings.Contains(tail, text) {
+		return true
+	}
+	normalizedTail, _ := normalizeSpace(tail)
+	normalizedText, _ := normalizeSpace(text)
+	return strings.Contains(normalizedTail, normalizedText)
+}
+
+// findOverlap returns the length of the longest beginning of text that repeats the end of
+// tail, matched exactly or else with whitespace runs collapsed
+func findOverlap(tail, text string) (cut int, normalized bool) {
+	if cut = suffixPrefixOverlap(tail, text); cut > 0 {
+		return cut, false
+	}
+
+	normalizedTail, _ := normalizeSpace(tail)
+	normalizedText, offsets := normalizeSpace(text)
+	if n := suffixPrefixOverlap(normalizedTail, normalizedText); n > 0 {
+		return offsets[n], true
+	}
+	return 0, false
+}
+
+// suffixPrefixOverlap returns the length of the longest prefix of b that is a suffix of a,
+// running a through the Knuth-Morris-Pratt automaton of b
+func suffixPrefixOverlap(a, b string) int {
+	if b == "" {
+		return 0
+	}
+
+	fail := make([]int, len(b))
+	for i, k := 1, 0; i < len(b); i++ {
+		for k > 0 && b[i] != b[k] {
+			k = fail[k-1]
+		}
+		if b[i] == b[k] {
+			k++
+		}
+		fail[i] = k
+	}
+
+	k := 0
+	for i := 0; i < len(a); i++ {
+		for k > 0 && (k == len(b) || a[i] != b[k]) {
+			k = fail[k-1]
+		}
+		if a[i] == b[k] {
+			k++
+		}
+	}
+	return k
+}
+
+// normalizeSpace collapses every whitespace run of s into a single space. offsets maps the
+// length of a prefix of the result to the length of the prefix of s it stands for.
+func normalizeSpace(s string) (string, []int) {
+	var normalized strings.Builder
+	offsets := make([]int, 1, len(s)+1)
+	inSpace := false
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r) && inSpace:
+			offsets[len(offsets)-1] = i + size
+		case unicode.IsSpace(r):
+			inSpace = true
+			normalized.WriteByte(' ')
+			offsets = append(offsets, i+size)
+		default:
+			inSpace = false
+			normalized.WriteString(s[i : i+size])
+			for j := 1; j < size; j++ {
+				offsets = append(offsets, i)
+			}
+			offsets = append(offsets, i+size)
+		}
+		i += size
+	}
+	return normalized.String(), offsets
+}
+
+// trimLeadingText cuts n bytes of formal text from the start of a chunk. It returns what is
+// left to cut, and whether the chunk carried formal text and nothing of it is left.
+func trimLeadingText(chunk *Chunk, n int) (int, bool) {
+	candidate := chunk.FirstCandidate()
+	if candidate == nil {
+		return n, false
+	}
+
+	hadText, kept := false, false
+	for _, part := range candidate.Parts() {
+		if part == nil || part.Thought {
+			continue
+		}
+		if !part.HasText() {
+			kept = true
+			continue
+		}
+
+		hadText = true
+		text := part.TextValue()
+		if cut := min(n, len(text)); cut > 0 {
+			text = text[cut:]
+			part.SetText(text)
+			n -= cut
+			chunk.MarkModified()
+		}
+		kept = kept || text != ""
+	}
+	return n, hadText && !kept
+}
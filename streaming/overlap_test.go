@@ -0,0 +1,98 @@
+package streaming
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFindOverlap(t *testing.T) {
+	tests := []struct {
+		name           string
+		tail, text     string
+		want           int
+		wantNormalized bool
+	}{
+		{"partial overlap", "Waves fold into foam, the tide", "the tide comes in.", len("the tide"), false},
+		{"full duplicate", "Waves fold into foam, the tide", "into foam, the tide", len("into foam, the tide"), false},
+		{"whole tail repeated", "the tide", "the tide comes in.", len("the tide"), false},
+		{"no overlap", "Waves fold into foam,", "Then the moon rises.", 0, false},
+		{"empty text", "Waves fold into foam,", "", 0, false},
+		{"empty tail", "", "Waves fold", 0, false},
+		{"collapsed whitespace in the tail", "foam,\n  the tide", "foam, the tide rises", len("foam, the tide"), true},
+		{"collapsed whitespace in the text", "foam, the tide", "foam,   the tide rises", len("foam,   the tide"), true},
+		{"multibyte", "长城是中国古代的", "古代的军事防御工程", len("古代的"), false},
+		{"multibyte duplicate", "长城是中国古代的", "中国古代的", len("中国古代的"), false},
+		{"multibyte sharing a leading byte", "café", "èclair", 0, false},
+		{"multibyte whitespace", "長い 文章", "長い　文章の続き", len("長い　文章"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut, normalized := findOverlap(tt.tail, tt.text)
+			if cut != tt.want || normalized != tt.wantNormalized {
+				t.Errorf("findOverlap(%q, %q) = %d, %t, want %d, %t", tt.tail, tt.text, cut, normalized, tt.want, tt.wantNormalized)
+			}
+			// What is left of the text after the cut must stay valid UTF-8
+			if !utf8.ValidString(tt.text[cut:]) {
+				t.Errorf("cut %d splits a character of %q", cut, tt.text)
+			}
+		})
+	}
+}
+
+func TestMayOverlap(t *testing.T) {
+	tests := []struct {
+		tail, text string
+		want       bool
+	}{
+		{"Waves fold into foam, the tide", "the ti", true},
+		{"Waves fold into foam, the tide", "into  foam,", true},
+		{"Waves fold into foam, the tide", "the moon", false},
+		{"长城是中国古代的", "中国", true},
+		{"长城是中国古代的", "中文", false},
+	}
+	for _, tt := range tests {
+		if got := mayOverlap(tt.tail, tt.text); got != tt.want {
+			t.Errorf("mayOverlap(%q, %q) = %t, want %t", tt.tail, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLastRunes(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"Waves fold", 4, "fold"},
+		{"长城是中国", 2, "中国"},
+		{"长城是中国", 10, "长城是中国"},
+		{"长城是中国", 0, ""},
+		{"", 3, ""},
+	}
+	for _, tt := range tests {
+		if got := lastRunes(tt.text, tt.n); got != tt.want {
+			t.Errorf("lastRunes(%q, %d) = %q, want %q", tt.text, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeSpaceOffsets(t *testing.T) {
+	text := "a \n b　长"
+	normalized, offsets := normalizeSpace(text)
+	if normalized != "a b 长" {
+		t.Fatalf("normalizeSpace(%q) = %q", text, normalized)
+	}
+	if len(offsets) != len(normalized)+1 {
+		t.Fatalf("%d offsets for %d bytes", len(offsets), len(normalized))
+	}
+	// Every prefix of the result stands for a prefix of text ending on a character boundary
+	for n, offset := range offsets {
+		if offset > len(text) || !utf8.ValidString(text[:offset]) {
+			t.Errorf("offsets[%d] = %d does not end on a character of %q", n, offset, text)
+		}
+	}
+	if offsets[len(normalized)] != len(text) {
+		t.Errorf("the whole result stands for %d bytes, want %d", offsets[len(normalized)], len(text))
+	}
+}
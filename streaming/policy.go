@@ -0,0 +1,168 @@
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// RetryAction is the outcome of a retry policy decision
+type RetryAction string
+
+const (
+	// RetryActionRetry retries the request after the decided delay
+	RetryActionRetry RetryAction = "retry"
+	// RetryActionAbort stops the session and reports the failure to the client
+	RetryActionAbort RetryAction = "abort"
+)
+
+// RetryDecision tells the retry loop how to handle a failure
+type RetryDecision struct {
+	Action RetryAction
+	// Delay is the wait before the next attempt. It is only meaningful when HasDelay is true;
+	// otherwise the loop's default delay applies.
+	Delay    time.Duration
+	HasDelay bool
+	// Source describes which rule produced the decision, for logging
+	Source string
+}
+
+type retryRule struct {
+	action   RetryAction
+	delay    time.Duration
+	hasDelay bool
+}
+
+// RetryPolicy decides whether a failure is retried or aborted, and how long to wait before retrying.
+// Rules are matched in order of specificity: upstream error status string, then HTTP status code,
+// then the built-in defaults derived from NO_RETRY_ERROR_CODES.
+type RetryPolicy struct {
+	statusRules         map[int]retryRule
+	upstreamStatusRules map[string]retryRule
+	interruptionRules   map[string]retryRule
+	defaultDelay        time.Duration
+}
+
+// NewRetryPolicy builds a retry policy from configuration
+func NewRetryPolicy(cfg *config.Config) *RetryPolicy {
+	policy := &RetryPolicy{
+		statusRules:         make(map[int]retryRule),
+		upstreamStatusRules: make(map[string]retryRule),
+		interruptionRules:   make(map[string]retryRule),
+		defaultDelay:        cfg.RetryDelayMs,
+	}
+
+	for _, code := range cfg.NoRetryErrorCodes {
+		policy.statusRules[code] = retryRule{action: RetryActionAbort}
+	}
+
+	for key, rule := range cfg.RetryPolicy.HTTPStatus {
+		code, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil {
+			logger.LogError(fmt.Sprintf("Ignoring retry policy rule for invalid HTTP status '%s'", key))
+			continue
+		}
+		if parsed, ok := parseRetryRule("httpStatus", key, rule); ok {
+			policy.statusRules[code] = parsed
+		}
+	}
+
+	for key, rule := range cfg.RetryPolicy.UpstreamStatus {
+		if parsed, ok := parseRetryRule("upstreamStatus", key, rule); ok {
+			policy.upstreamStatusRules[strings.ToUpper(strings.TrimSpace(key))] = parsed
+		}
+	}
+
+	for key, rule := range cfg.RetryPolicy.Interruption {
+		if parsed, ok := parseRetryRule("interruption", key, rule); ok {
+			policy.interruptionRules[strings.ToUpper(strings.TrimSpace(key))] = parsed
+		}
+	}
+
+	return policy
+}
+
+func parseRetryRule(kind, key string, rule config.RetryRule) (retryRule, bool) {
+	action := RetryAction(strings.ToLower(strings.TrimSpace(rule.Action)))
+	if action == "" {
+		action = RetryActionRetry
+	}
+	if action != RetryActionRetry && action != RetryActionAbort {
+		logger.LogError(fmt.Sprintf("Ignoring retry policy rule %s[%s]: unknown action '%s'", kind, key, rule.Action))
+		return retryRule{}, false
+	}
+
+	parsed := retryRule{action: action}
+	if rule.DelayMs != nil && *rule.DelayMs >= 0 {
+		parsed.delay = time.Duration(*rule.DelayMs) * time.Millisecond
+		parsed.hasDelay = true
+	}
+	return parsed, true
+}
+
+// DecideHTTPStatus decides how to handle a non-200 upstream response during a retry.
+// upstreamStatus is the "status" string from the upstream error body, if any.
+func (p *RetryPolicy) DecideHTTPStatus(statusCode int, upstreamStatus string) RetryDecision {
+	if upstreamStatus != "" {
+		if rule, ok := p.upstreamStatusRules[strings.ToUpper(upstreamStatus)]; ok {
+			return p.decision(rule, "upstreamStatus "+upstreamStatus)
+		}
+	}
+
+	if rule, ok := p.statusRules[statusCode]; ok {
+		return p.decision(rule, fmt.Sprintf("httpStatus %d", statusCode))
+	}
+
+	return RetryDecision{
+		Action:   RetryActionRetry,
+		Delay:    p.defaultDelay,
+		HasDelay: false,
+		Source:   "default",
+	}
+}
+
+// DecideInterruption decides how to handle a stream interruption such as DROP or BLOCK.
+// By default every interruption is retried after the loop's backoff delay.
+func (p *RetryPolicy) DecideInterruption(reason string) RetryDecision {
+	if rule, ok := p.interruptionRules[strings.ToUpper(reason)]; ok {
+		return p.decision(rule, "interruption "+reason)
+	}
+
+	return RetryDecision{
+		Action:   RetryActionRetry,
+		Delay:    p.defaultDelay,
+		HasDelay: false,
+		Source:   "default",
+	}
+}
+
+func (p *RetryPolicy) decision(rule retryRule, source string) RetryDecision {
+	decision := RetryDecision{
+		Action:   rule.action,
+		Delay:    rule.delay,
+		HasDelay: rule.hasDelay,
+		Source:   source,
+	}
+	if !rule.hasDelay {
+		decision.Delay = p.defaultDelay
+	}
+	return decision
+}
+
+// ExtractUpstreamErrorStatus returns the "error.status" string from an upstream error body, if present
+func ExtractUpstreamErrorStatus(body []byte) string {
+	var errorResp struct {
+		Error struct {
+			Status string `json:"status"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorResp); err != nil {
+		return ""
+	}
+	return errorResp.Error.Status
+}
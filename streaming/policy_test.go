@@ -0,0 +1,115 @@
+package streaming
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// testPolicy builds a retry policy from a RETRY_POLICY_JSON value, with NO_RETRY_ERROR_CODES
+// 400,401,403,404 and RETRY_DELAY_MS 750
+func testPolicy(t *testing.T, policyJSON string) *RetryPolicy {
+	t.Helper()
+	cfg := &config.Config{
+		NoRetryErrorCodes: []int{400, 401, 403, 404},
+		RetryDelayMs:      750 * time.Millisecond,
+	}
+	if err := json.Unmarshal([]byte(policyJSON), &cfg.RetryPolicy); err != nil {
+		t.Fatalf("invalid policy %s: %v", policyJSON, err)
+	}
+	return NewRetryPolicy(cfg)
+}
+
+func TestRetryPolicyHTTPStatus(t *testing.T) {
+	policy := testPolicy(t, `{
+		"httpStatus": {"400": {"action": "retry", "delayMs": 100}, "503": {"action": "abort"}, " 500 ": {"delayMs": 0}, "abc": {"action": "abort"}, "502": {"action": "explode"}},
+		"upstreamStatus": {"resource_exhausted": {"delayMs": 5000}, "FAILED_PRECONDITION": {"action": "abort"}}
+	}`)
+
+	tests := []struct {
+		name           string
+		status         int
+		upstreamStatus string
+		want           RetryDecision
+	}{
+		// Status codes
+		{"no-retry default", 401, "", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "httpStatus 401"}},
+		{"rule overrides no-retry default", 400, "", RetryDecision{Action: RetryActionRetry, Delay: 100 * time.Millisecond, HasDelay: true, Source: "httpStatus 400"}},
+		{"rule aborts a retryable status", 503, "", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "httpStatus 503"}},
+		{"rule without action retries", 500, "", RetryDecision{Action: RetryActionRetry, HasDelay: true, Source: "httpStatus 500"}},
+		{"rule with unknown action ignored", 502, "", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "default"}},
+		{"unmatched status", 504, "", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "default"}},
+		{"429 is retried by default", 429, "", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "default"}},
+
+		// Upstream status strings
+		{"upstream status beats status code", 429, "RESOURCE_EXHAUSTED", RetryDecision{Action: RetryActionRetry, Delay: 5 * time.Second, HasDelay: true, Source: "upstreamStatus RESOURCE_EXHAUSTED"}},
+		{"upstream status beats no-retry default", 400, "FAILED_PRECONDITION", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "upstreamStatus FAILED_PRECONDITION"}},
+		{"upstream status is case-insensitive", 503, "failed_precondition", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "upstreamStatus failed_precondition"}},
+		{"unmatched upstream status falls back to status code", 503, "UNAVAILABLE", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "httpStatus 503"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.DecideHTTPStatus(tt.status, tt.upstreamStatus); got != tt.want {
+				t.Errorf("DecideHTTPStatus(%d, %q) = %+v, want %+v", tt.status, tt.upstreamStatus, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyInterruption(t *testing.T) {
+	policy := testPolicy(t, `{
+		"httpStatus": {"500": {"action": "abort"}},
+		"interruption": {"block": {"action": "abort"}, "FINISH_ABNORMAL": {"delayMs": 2000}, "DROP": {"action": "retry"}, "TIMEOUT": {"delayMs": -1}}
+	}`)
+
+	tests := []struct {
+		reason string
+		want   RetryDecision
+	}{
+		{"BLOCK", RetryDecision{Action: RetryActionAbort, Delay: 750 * time.Millisecond, Source: "interruption BLOCK"}},
+		{"FINISH_ABNORMAL", RetryDecision{Action: RetryActionRetry, Delay: 2 * time.Second, HasDelay: true, Source: "interruption FINISH_ABNORMAL"}},
+		// Without a delay the loop's backoff applies
+		{"DROP", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "interruption DROP"}},
+		{"TIMEOUT", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "interruption TIMEOUT"}},
+		// Interruptions are not matched against status code rules
+		{"500", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "default"}},
+		{"FINISH_DUPLICATE", RetryDecision{Action: RetryActionRetry, Delay: 750 * time.Millisecond, Source: "default"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			if got := policy.DecideInterruption(tt.reason); got != tt.want {
+				t.Errorf("DecideInterruption(%q) = %+v, want %+v", tt.reason, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelayDefaults(t *testing.T) {
+	policy := testPolicy(t, `{}`)
+
+	for _, decision := range []RetryDecision{policy.DecideHTTPStatus(500, ""), policy.DecideInterruption("DROP")} {
+		if decision.HasDelay {
+			t.Errorf("default decision %+v has a delay; the backoff schedule should apply", decision)
+		}
+		if decision.Delay != 750*time.Millisecond {
+			t.Errorf("default decision delay = %v, want RETRY_DELAY_MS", decision.Delay)
+		}
+	}
+}
+
+func TestExtractUpstreamErrorStatus(t *testing.T) {
+	tests := map[string]string{
+		`{"error":{"code":429,"status":"RESOURCE_EXHAUSTED"}}`: "RESOURCE_EXHAUSTED",
+		`{"error":{"code":500}}`:                               "",
+		`<html>Bad Gateway</html>`:                             "",
+	}
+	for body, want := range tests {
+		if got := ExtractUpstreamErrorStatus([]byte(body)); got != want {
+			t.Errorf("ExtractUpstreamErrorStatus(%s) = %q, want %q", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package streaming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gemini-antiblock/logger"
+)
+
+// builtinPreambles match the openers models commonly put before a resumed answer, in English
+// and Chinese. Each one needs an explicit continuation phrase ("continuing from where I left
+// off", "继续回答", "接着上文") closed by punctuation, so an answer that starts with a bare
+// connective ("Continuing. The loop runs", "接着，我们把锅加热", "继续，直到水沸腾") or with
+// "Continue stirring" is left alone.
+var builtinPreambles = []*regexp.Regexp{
+	regexp.MustCompile(`^(?i)\s*(?:(?:sure|okay|ok|certainly|of course|alright|all right)[,!.]?\s+)?(?:(?:i'?ll|i will|let me|let's)\s+)?(?:continue|continuing|resuming|picking up)(?:\s+(?:from\s+)?where\s+(?:i|we)\s+left\s+off|\s+(?:with\s+|from\s+)?the\s+(?:rest|remainder|previous\s+(?:answer|response)|answer|response|code|text|list|story)(?:\s+of\s+the\s+\w+)?)\s*[:.!…]+[ \t]*\n?`),
+	regexp.MustCompile(`^(?i)\s*(?:(?:sure|okay|ok|certainly|of course|alright|all right)[,!.]?\s+)?here(?:'s|\s+is)\s+the\s+(?:rest|remainder|continuation)\b[^\n:]{0,40}:[ \t]*\n?`),
+	regexp.MustCompile(`^\s*(?:(?:好的|好|当然|没问题)[，,。！!]?\s*)?我?(?:继续|接着)(?:(?:上文|之前的内容|刚才的内容|上面的内容|往下)(?:写|说|回答|输出)?|写|说|回答|输出)[：:。，,！!]\s*`),
+	regexp.MustCompile(`^(?i)\s*(?:[（(](?:续|continued)[）)]|接上文[：:]?)\s*`),
+}
+
+// preambles returns the built-in preamble patterns followed by the configured ones, compiled
+// on first use. Configured patterns are anchored at the beginning of the attempt.
+func (s *streamSession) preambles() []*regexp.Regexp {
+	if s.preamblePatterns != nil {
+		return s.preamblePatterns
+	}
+
+	patterns := append([]*regexp.Regexp{}, builtinPreambles...)
+	for _, pattern := range s.cfg.ResumePreamblePatterns {
+		re, err := regexp.Compile(`^(?:` + pattern + `)`)
+		if err != nil {
+			logger.LogError(fmt.Sprintf("Ignoring invalid preamble pattern %q: %v", pattern, err))
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+	s.preamblePatterns = patterns
+	return patterns
+}
+
+// preambleLength returns the length of the preamble at the beginning of a resumed attempt's
+// text: any run of preamble phrases and a reopened code fence that ends within the first
+// ResumePreambleWindow characters
+func (s *streamSession) preambleLength(c *candidateState, text string) int {
+	if s.cfg.ResumePreambleWindow <= 0 {
+		return 0
+	}
+
+	limit := 0
+	for n := 0; n < s.cfg.ResumePreambleWindow && limit < len(text); n++ {
+		_, size := utf8.DecodeRuneInString(text[limit:])
+		limit += size
+	}
+
+	length := 0
+	for matched := true; matched; {
+		matched = false
+		if fence := reopenedFence(c.accumulator.Text(), text[length:]); fence > 0 && length+fence <= limit {
+			length += fence
+			matched = true
+			continue
+		}
+		for _, re := range s.preambles() {
+			if loc := re.FindStringIndex(text[length:]); loc != nil && loc[1] > 0 && length+loc[1] <= limit {
+				length += loc[1]
+				matched = true
+				break
+			}
+		}
+	}
+	return length
+}
+
+// reopenedFence returns the length of the code fence opener (e.g. "```python\n") at the start
+// of text when the accumulated output is inside a code block already: the resumed attempt
+// opened the block a second time. A bare fence closes the open block and is kept.
+func reopenedFence(accumulated, text string) int {
+	trimmed := strings.TrimLeft(text, " \t\r\n")
+	if !strings.HasPrefix(trimmed, "```") || !insideCodeFence(accumulated) {
+		return 0
+	}
+
+	line, _, complete := strings.Cut(trimmed, "\n")
+	info := strings.TrimSpace(strings.TrimLeft(line, "`"))
+	if !complete || info == "" || strings.Contains(info, "`") {
+		return 0
+	}
+	return len(text) - len(trimmed) + len(line) + 1
+}
+
+// insideCodeFence reports whether text leaves a ``` code block open
+func insideCodeFence(text string) bool {
+	open := false
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			open = !open
+		}
+	}
+	return open
+}
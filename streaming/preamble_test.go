@@ -0,0 +1,79 @@
+package streaming
+
+import (
+	"testing"
+
+	"gemini-antiblock/config"
+)
+
+func TestPreambleLength(t *testing.T) {
+	tests := []struct {
+		name string
+		// accumulated is the output before the resumed attempt
+		accumulated string
+		text        string
+		want        string
+	}{
+		// Preambles
+		{"continuing from where I left off", "", "Sure, continuing from where I left off:\nThe loop runs", "The loop runs"},
+		{"let me continue with the rest", "", "Let me continue with the rest of the list:\n- item", "- item"},
+		{"picking up the previous answer", "", "Picking up from the previous answer... the loop runs", "the loop runs"},
+		{"here is the rest", "", "Here's the rest of the code:\nreturn x", "return x"},
+		{"继续回答", "", "好的，我继续回答：水开后", "水开后"},
+		{"接着上文", "", "接着上文：水开后", "水开后"},
+		{"继续写", "", "继续写：水开后", "水开后"},
+		{"续", "", "（续）水开后", "水开后"},
+		{"continued", "", "(continued) the loop runs", "the loop runs"},
+		{"reopened fence", "```go\nfunc main() {\n", "```go\n\tfmt.Println()\n", "\tfmt.Println()\n"},
+		{"preamble and reopened fence", "```go\nfunc main() {\n", "Continuing the code:\n```go\n\tfmt.Println()\n", "\tfmt.Println()\n"},
+
+		// Answer text
+		{"接着 as a connective", "", "接着，我们把锅加热。", "接着，我们把锅加热。"},
+		{"继续 as a connective", "", "继续，直到水沸腾。", "继续，直到水沸腾。"},
+		{"继续 as an instruction", "", "继续加热五分钟。", "继续加热五分钟。"},
+		{"bare continuing", "", "Continuing. The loop runs", "Continuing. The loop runs"},
+		{"bare sure continuing", "", "Sure, continuing: the loop runs", "Sure, continuing: the loop runs"},
+		{"continue stirring", "", "Continue stirring until thick.", "Continue stirring until thick."},
+		{"sure", "", "Sure! Here is how it works.", "Sure! Here is how it works."},
+		{"fence outside a code block", "Some text.\n", "```go\nfunc main() {}\n", "```go\nfunc main() {}\n"},
+		{"closing fence", "```go\nfunc main() {\n", "```\nDone.", "```\nDone."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &streamSession{cfg: &config.Config{ResumePreambleWindow: 120}}
+			c := &candidateState{accumulator: &ResponseAccumulator{}}
+			c.accumulator.AddText(tt.accumulated)
+
+			n := s.preambleLength(c, tt.text)
+			if got := tt.text[n:]; got != tt.want {
+				t.Errorf("text after preamble = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreambleLengthWindow(t *testing.T) {
+	s := &streamSession{cfg: &config.Config{ResumePreambleWindow: 10}}
+	c := &candidateState{accumulator: &ResponseAccumulator{}}
+
+	// The preamble ends past the window
+	if n := s.preambleLength(c, "Sure, continuing from where I left off: x"); n != 0 {
+		t.Errorf("preamble ending past the window was stripped (%d bytes)", n)
+	}
+}
+
+func TestPreambleLengthCustomPattern(t *testing.T) {
+	s := &streamSession{cfg: &config.Config{ResumePreambleWindow: 120, ResumePreamblePatterns: []string{`(?i)as I was saying,\s*`, `(`}}}
+	c := &candidateState{accumulator: &ResponseAccumulator{}}
+
+	text := "As I was saying, the loop runs"
+	if got := text[s.preambleLength(c, text):]; got != "the loop runs" {
+		t.Errorf("text after custom preamble = %q", got)
+	}
+	// Custom patterns are anchored at the beginning
+	text = "The loop, as I was saying, runs"
+	if n := s.preambleLength(c, text); n != 0 {
+		t.Errorf("unanchored match stripped %q", text[:n])
+	}
+}
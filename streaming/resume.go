@@ -0,0 +1,155 @@
+package streaming
+
+import (
+	"fmt"
+	"strings"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// Resume strategies decide how a retry request asks the model to continue its partial answer
+const (
+	// ResumeTwoTurn replays the partial answer as a model turn followed by a user turn asking
+	// the model to continue
+	ResumeTwoTurn = "two-turn"
+	// ResumePrefill replays the partial answer as the last turn, which the model extends
+	ResumePrefill = "prefill"
+	// ResumeSystem replays the partial answer as the last turn and asks the model to continue in
+	// the system instruction
+	ResumeSystem = "system"
+	// ResumeTemplate is ResumeTwoTurn with the user turn rendered from RESUME_PROMPT_TEMPLATE
+	ResumeTemplate = "template"
+)
+
+// defaultContinuationPrompt asks the model to continue its partial answer
+const defaultContinuationPrompt = "Continue exactly where you left off without any preamble or repetition."
+
+// languageNames spell out the languages DetectLanguage tells apart, for the {language} placeholder
+var languageNames = map[string]string{
+	"en": "English",
+	"zh": "Chinese",
+	"ja": "Japanese",
+	"ko": "Korean",
+}
+
+// ResumeStrategy is how the resumed attempts of a session ask the model to continue
+type ResumeStrategy struct {
+	Name string
+	// Language is the language of the conversation, e.g. "zh"
+	Language string
+
+	template  string
+	tailChars int
+}
+
+// ResolveResumeStrategy picks the resume strategy for a request: the per-model configuration or
+// the configured default. An unknown strategy, or the template strategy without a template,
+// falls back to ResumeTwoTurn.
+func ResolveResumeStrategy(cfg *config.Config, model, language string) ResumeStrategy {
+	name := cfg.ResumeStrategy
+	source := "default"
+	if modelName, ok := cfg.ResumeStrategyModels[model]; ok && model != "" {
+		name = modelName
+		source = "model " + model
+	}
+
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case ResumeTwoTurn, ResumePrefill, ResumeSystem:
+	case ResumeTemplate:
+		if cfg.ResumePromptTemplate == "" {
+			logger.LogError("Resume strategy 'template' needs RESUME_PROMPT_TEMPLATE. Using two-turn.")
+			name = ResumeTwoTurn
+		}
+	default:
+		logger.LogError(fmt.Sprintf("Unknown resume strategy '%s'. Using two-turn.", name))
+		name = ResumeTwoTurn
+	}
+
+	logger.LogInfo(fmt.Sprintf("Resume strategy: %s (selected by %s)", name, source))
+	return ResumeStrategy{
+		Name:      name,
+		Language:  language,
+		template:  cfg.ResumePromptTemplate,
+		tailChars: cfg.ResumePromptTailChars,
+	}
+}
+
+// prompt returns the text asking the model to continue. basePrompt is the built-in prompt for
+// the request (plain or JSON mode); the template strategy renders its template instead, with
+// the {prompt}, {tail} and {language} placeholders filled in.
+func (r ResumeStrategy) prompt(basePrompt, accumulatedText string) string {
+	if r.Name != ResumeTemplate {
+		return basePrompt
+	}
+
+	language := languageNames[r.Language]
+	if language == "" {
+		language = r.Language
+	}
+	return strings.NewReplacer(
+		"{prompt}", basePrompt,
+		"{tail}", lastRunes(accumulatedText, r.tailChars),
+		"{language}", language,
+	).Replace(r.template)
+}
+
+// name returns the strategy name for log messages; the zero strategy is ResumeTwoTurn
+func (r ResumeStrategy) name() string {
+	if r.Name == "" {
+		return ResumeTwoTurn
+	}
+	return r.Name
+}
+
+// appendResumeTurns adds the partial answer to the end of the conversation, followed by the
+// request to continue it as the strategy asks for. The partial answer continues the last turn
+// of the request: when that is a model turn (a prefill the client sent, which the model was
+// extending) the partial answer is merged into it, otherwise it follows the last user or
+// function turn as a new model turn. Either way user and model turns keep alternating.
+func appendResumeTurns(request *gemini.GenerateContentRequest, parts []*gemini.Part, prompt string, strategy ResumeStrategy) {
+	last := len(request.Contents) - 1
+	if trailing := request.Contents[last]; trailing != nil && trailing.Role == "model" {
+		trailing.Parts = mergeParts(trailing.Parts, parts)
+		logger.LogDebug(fmt.Sprintf("Merged the partial answer into the trailing model turn at index %d", last))
+	} else {
+		request.Contents = append(request.Contents, &gemini.Content{Role: "model", Parts: parts})
+		logger.LogDebug(fmt.Sprintf("Appended the partial answer after the %s turn at index %d", roleOf(trailing), last))
+	}
+
+	switch strategy.Name {
+	case ResumePrefill:
+		// The model extends its own partial turn
+	case ResumeSystem:
+		request.AddSystemInstruction(prompt)
+	default:
+		request.Contents = append(request.Contents, &gemini.Content{Role: "user", Parts: []*gemini.Part{gemini.TextPart(prompt)}})
+	}
+	logger.LogDebug(fmt.Sprintf("Resume strategy %s: continuation prompt %q", strategy.name(), prompt))
+}
+
+// mergeParts appends parts to the parts of a turn of the retry request. Plain text continuing
+// plain text is joined into one part, so a prefill and the answer extending it read as one text.
+func mergeParts(turn, parts []*gemini.Part) []*gemini.Part {
+	if len(turn) > 0 && len(parts) > 0 && plainTextPart(turn[len(turn)-1]) && plainTextPart(parts[0]) {
+		previous := turn[len(turn)-1]
+		previous.SetText(previous.TextValue() + parts[0].TextValue())
+		parts = parts[1:]
+	}
+	return append(turn, parts...)
+}
+
+// plainTextPart reports whether part is formal text without a thought signature
+func plainTextPart(part *gemini.Part) bool {
+	return part != nil && part.HasText() && !part.Thought && part.ThoughtSignature == ""
+}
+
+// roleOf returns the role of a turn for log messages; the API reads a missing role as user
+func roleOf(content *gemini.Content) string {
+	if content == nil || content.Role == "" {
+		return "user"
+	}
+	return content.Role
+}
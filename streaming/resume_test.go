@@ -0,0 +1,276 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gemini-antiblock/gemini"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the retry request bodies")
+
+const questionRequest = `{
+	"contents": [
+		{"role": "user", "parts": [{"text": "Write a haiku about the sea."}]}
+	]
+}`
+
+// resumeCases are the retry request bodies checked against testdata/resume/<name>.golden
+var resumeCases = []struct {
+	name     string
+	request  string
+	partial  func(*ResponseAccumulator)
+	strategy ResumeStrategy
+}{
+	{
+		name:     "two-turn",
+		request:  questionRequest,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name:     "prefill",
+		request:  questionRequest,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{Name: ResumePrefill},
+	},
+	{
+		name: "system",
+		request: `{
+			"systemInstruction": {"parts": [{"text": "Answer in verse."}]},
+			"contents": [
+				{"role": "user", "parts": [{"text": "Write a haiku about the sea."}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{Name: ResumeSystem},
+	},
+	{
+		name: "template",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "用三句话介绍长城。"}]}
+			]
+		}`,
+		partial: func(a *ResponseAccumulator) { a.AddText("长城是中国古代的军事防御工程，") },
+		strategy: ResumeStrategy{
+			Name:      ResumeTemplate,
+			Language:  "zh",
+			template:  "{prompt} Keep writing in {language}, right after: {tail}",
+			tailChars: 6,
+		},
+	},
+	{
+		name:     "zero-strategy",
+		request:  questionRequest,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{},
+	},
+	{
+		name: "prefill-merge-two-turn",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "List three primes."}]},
+				{"role": "model", "parts": [{"text": "Sure: 2,"}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText(" 3,") },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "prefill-merge-prefill",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "List three primes."}]},
+				{"role": "model", "parts": [{"text": "Sure: 2,"}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText(" 3,") },
+		strategy: ResumeStrategy{Name: ResumePrefill},
+	},
+	{
+		name: "prefill-merge-system",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "List three primes."}]},
+				{"role": "model", "parts": [{"text": "Sure: 2,"}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText(" 3,") },
+		strategy: ResumeStrategy{Name: ResumeSystem},
+	},
+	{
+		name: "prefill-signed",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "List three primes."}]},
+				{"role": "model", "parts": [{"text": "Sure: 2,", "thoughtSignature": "c2ln"}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText(" 3,") },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "prefill-thought",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "List three primes."}]},
+				{"role": "model", "parts": [{"text": "Sure: 2,"}]}
+			]
+		}`,
+		partial: func(a *ResponseAccumulator) {
+			a.AddThought("The next prime is 3.", "dGhvdWdodA==")
+			a.AddText(" 3,")
+		},
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "function-call-turns",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "What is the weather in Paris and in Rome?"}]},
+				{"role": "model", "parts": [{"functionCall": {"name": "weather", "args": {"city": "Paris"}}}]},
+				{"role": "user", "parts": [{"functionResponse": {"name": "weather", "response": {"celsius": 18}}}]}
+			],
+			"tools": [{"functionDeclarations": [{"name": "weather"}]}]
+		}`,
+		partial: func(a *ResponseAccumulator) {
+			a.AddSignedText("Paris is at 18°C. Checking Rome.", "c2lnbmVk")
+			a.AddPart(&gemini.Part{FunctionCall: json.RawMessage(`{"name":"weather","args":{"city":"Rome"}}`)})
+		},
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "function-turn-trailing",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "What is the weather in Paris?"}]},
+				{"role": "model", "parts": [{"functionCall": {"name": "weather", "args": {"city": "Paris"}}}]},
+				{"role": "function", "parts": [{"functionResponse": {"name": "weather", "response": {"celsius": 18}}}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText("It is 18°C") },
+		strategy: ResumeStrategy{Name: ResumePrefill},
+	},
+	{
+		name: "role-missing",
+		request: `{
+			"contents": [
+				{"parts": [{"text": "Write a haiku about the sea."}]}
+			]
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "multiple-candidates",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "Write a haiku about the sea."}]}
+			],
+			"generationConfig": {"candidateCount": 3, "temperature": 0.7}
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText("Waves fold into foam,") },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name: "json-mode",
+		request: `{
+			"contents": [
+				{"role": "user", "parts": [{"text": "Name a sea."}]}
+			],
+			"generationConfig": {
+				"responseMimeType": "application/json",
+				"responseSchema": {"type": "OBJECT", "properties": {"name": {"type": "STRING"}}}
+			}
+		}`,
+		partial:  func(a *ResponseAccumulator) { a.AddText(`{"name": "Bal`) },
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+	{
+		name:     "nothing-accumulated",
+		request:  questionRequest,
+		partial:  func(a *ResponseAccumulator) {},
+		strategy: ResumeStrategy{Name: ResumeTwoTurn},
+	},
+}
+
+func TestBuildRetryRequestBody(t *testing.T) {
+	for _, tc := range resumeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request, err := gemini.ParseRequest([]byte(tc.request))
+			if err != nil {
+				t.Fatalf("invalid request: %v", err)
+			}
+			original, err := json.Marshal(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			accumulator := &ResponseAccumulator{}
+			tc.partial(accumulator)
+			retryRequest, err := BuildRetryRequestBody(request, accumulator, tc.strategy)
+			if err != nil {
+				t.Fatalf("BuildRetryRequestBody: %v", err)
+			}
+			body, err := json.MarshalIndent(retryRequest, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = append(body, '\n')
+
+			if after, _ := json.Marshal(request); !bytes.Equal(after, original) {
+				t.Errorf("the original request was modified:\n%s", after)
+			}
+			checkRoleAlternation(t, retryRequest.Contents)
+
+			golden := filepath.Join("testdata", "resume", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, body, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("retry request body differs from %s:\n%s", golden, body)
+			}
+		})
+	}
+}
+
+func TestBuildRetryRequestBodyEmptyContents(t *testing.T) {
+	request, err := gemini.ParseRequest([]byte(`{"contents": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accumulator := &ResponseAccumulator{}
+	accumulator.AddText("partial")
+	if _, err := BuildRetryRequestBody(request, accumulator, ResumeStrategy{Name: ResumeTwoTurn}); err == nil {
+		t.Error("BuildRetryRequestBody accepted a request without contents")
+	}
+}
+
+// checkRoleAlternation fails the test when two consecutive turns come from the same side. Turns
+// without a role and function turns count as user turns, as the API reads them.
+func checkRoleAlternation(t *testing.T, contents []*gemini.Content) {
+	t.Helper()
+	side := func(content *gemini.Content) string {
+		if roleOf(content) == "model" {
+			return "model"
+		}
+		return "user"
+	}
+	for i := 1; i < len(contents); i++ {
+		if side(contents[i]) == side(contents[i-1]) {
+			t.Errorf("turns %d and %d are both %s turns", i-1, i, side(contents[i]))
+		}
+	}
+}
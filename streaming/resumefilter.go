@@ -0,0 +1,96 @@
+package streaming
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"gemini-antiblock/logger"
+)
+
+// heldEvent is an event of a resumed attempt held back until it is known how much of the
+// beginning of the attempt has to be cut
+type heldEvent struct {
+	event SSEEvent
+	chunk CandidateChunk
+}
+
+// armResumeFilter makes a resumed attempt of a candidate hold back its beginning. Despite the
+// continuation prompt, models often open a resumed attempt with a preamble ("Sure, continuing:",
+// a reopened code fence) or by repeating the last sentence or paragraph they already sent.
+func (s *streamSession) armResumeFilter(c *candidateState) {
+	enabled := s.cfg.ResumeOverlapWindow > 0 || s.cfg.ResumePreambleWindow > 0
+	c.holdingStart = enabled && c.retries > 0 && c.accumulator.Text() != ""
+}
+
+// holdResumeStart holds back the chunks of a resumed attempt from its first formal text on. They
+// are released once the preamble window is full and the text after any preamble can no longer
+// grow into a repetition of the previous output (it no longer occurs in the tail of the
+// accumulated text), or as soon as a chunk brings something other than text.
+func (s *streamSession) holdResumeStart(c *candidateState, event SSEEvent, candidateChunk CandidateChunk, content ChunkContent) error {
+	chunk := candidateChunk.Chunk
+	final := ExtractFinishReason(chunk) != "" || IsBlockedChunk(chunk) || len(content.DataParts) > 0
+
+	if len(c.held) == 0 && content.Text == "" && !final {
+		// Nothing to look at yet
+		return s.deliverEvent(c, event, candidateChunk, content)
+	}
+
+	c.held = append(c.held, heldEvent{event: event, chunk: candidateChunk})
+	c.heldText.WriteString(content.Text)
+
+	text := c.heldText.String()
+	if final || utf8.RuneCountInString(text) >= s.cfg.ResumePreambleWindow && !mayOverlap(s.overlapTail(c), text[s.preambleLength(c, text):]) {
+		return s.releaseHeld(c)
+	}
+	return nil
+}
+
+// releaseHeld cuts the preamble and the repeated text from the beginning of the held chunks and
+// delivers them
+func (s *streamSession) releaseHeld(c *candidateState) error {
+	held := c.held
+	heldText := c.heldText.String()
+	c.holdingStart = false
+	c.held = nil
+	c.heldText.Reset()
+
+	preamble := s.preambleLength(c, heldText)
+	if preamble > 0 {
+		logger.LogInfo(fmt.Sprintf("%sStripped preamble %q from the resumed attempt", s.label(c), heldText[:preamble]))
+	}
+
+	overlap, normalized := findOverlap(s.overlapTail(c), heldText[preamble:])
+	repeated := heldText[preamble : preamble+overlap]
+	if utf8.RuneCountInString(repeated) < s.cfg.ResumeOverlapMinChars {
+		overlap = 0
+	}
+	if overlap > 0 {
+		match := "exact"
+		if normalized {
+			match = "whitespace-normalized"
+		}
+		logger.LogInfo(fmt.Sprintf("%sResumed attempt repeated %d characters of the previous output (%s match). Trimmed before forwarding.", s.label(c), utf8.RuneCountInString(repeated), match))
+		logger.LogDebug("Trimmed repetition:", repeated)
+	}
+
+	cut := preamble + overlap
+	for _, h := range held {
+		if c.settled() {
+			break
+		}
+
+		chunk := h.chunk.Chunk
+		if cut > 0 {
+			var emptied bool
+			cut, emptied = trimLeadingText(chunk, cut)
+			if emptied && ExtractFinishReason(chunk) == "" {
+				// Nothing but preamble or repeated text
+				continue
+			}
+		}
+		if err := s.deliverEvent(c, h.event, h.chunk, ParseChunkContent(chunk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
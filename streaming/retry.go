@@ -2,22 +2,22 @@ package streaming
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
 	"gemini-antiblock/logger"
 )
 
-var nonRetryableStatuses = map[int]bool{
-	400: true, 401: true, 403: true, 404: true, 429: true,
-}
-
 // endsWithSentencePunctuation returns true if the given text ends with a sentence-ending punctuation.
 // The set includes common Chinese and English sentence terminators and closing quotes.
 func endsWithSentencePunctuation(text string) bool {
@@ -40,495 +40,826 @@ func endsWithSentencePunctuation(text string) bool {
 	return strings.ContainsRune(punctuations, last)
 }
 
-// isValidResponseStructure checks if an SSE data line has valid response structure
-func isValidResponseStructure(line string) bool {
-	if !strings.HasPrefix(line, "data: ") {
-		return true // Non-data lines are considered valid
+// BuildRetryRequestBody builds a new request body for retry with accumulated context.
+// The partial model turn replays every accumulated part, including function calls and code execution.
+// The strategy decides how the model is asked to continue it (see ResumeStrategy).
+// The retry body is a deep copy: the original request is never modified.
+func BuildRetryRequestBody(originalRequest *gemini.GenerateContentRequest, accumulator *ResponseAccumulator, strategy ResumeStrategy) (*gemini.GenerateContentRequest, error) {
+	accumulatedText := accumulator.Text()
+	logger.LogDebug(fmt.Sprintf("Building retry request body. Accumulated text length: %d", len(accumulatedText)))
+	logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", func() string {
+		if len(accumulatedText) > 200 {
+			return accumulatedText[:200] + "..."
+		}
+		return accumulatedText
+	}()))
+
+	retryRequest := originalRequest.Clone()
+	if RequestedCandidateCount(originalRequest) > 1 {
+		// Only the candidate being resumed is requested again
+		retryRequest.GenerationConfig.CandidateCount = 1
 	}
 
-	// Extract JSON content from data line
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return false // No JSON content found
+	if len(retryRequest.Contents) == 0 {
+		logger.LogError("Retry body contains empty contents array")
+		return nil, fmt.Errorf("retry request cannot have empty contents")
+	}
+	if accumulator.Empty() {
+		// Nothing to continue: the attempt broke before its first part
+		logger.LogDebug("Nothing accumulated yet. Retrying the original request.")
+		return retryRequest, nil
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("JSON parsing failed during structure validation:", err)
-		return false
+	continuationPrompt := defaultContinuationPrompt
+	if IsJSONMode(originalRequest) {
+		// Structured output would force the resumed attempt to start a brand new document,
+		// so drop the constraint and describe the expected fragment in the prompt instead.
+		continuationPrompt = jsonResumePrompt(originalRequest)
+		withoutJSONConstraints(retryRequest.GenerationConfig)
+		logger.LogDebug("JSON mode: relaxed structured output constraints for the resumed attempt")
 	}
 
-	// Check if candidates field exists and is a valid array
-	candidates, exists := data["candidates"]
-	if !exists {
-		logger.LogDebug("Missing candidates field in response structure")
-		return false
+	continuationPrompt = strategy.prompt(continuationPrompt, accumulatedText)
+	appendResumeTurns(retryRequest, accumulator.Parts(), continuationPrompt, strategy)
+
+	finalContents := retryRequest.Contents
+	logger.LogDebug(fmt.Sprintf("Final retry request has %d messages", len(finalContents)))
+	// 记录第一条和最后一条消息的基本信息用于调试
+	if finalContents[0] != nil {
+		logger.LogDebug(fmt.Sprintf("First message role: %v", finalContents[0].Role))
 	}
+	if len(finalContents) > 1 && finalContents[len(finalContents)-1] != nil {
+		logger.LogDebug(fmt.Sprintf("Last message role: %v", finalContents[len(finalContents)-1].Role))
+	}
+	return retryRequest, nil
+}
 
-	candidatesArray, isArray := candidates.([]interface{})
-	if !isArray {
-		logger.LogDebug("Candidates field is not an array")
-		return false
+// candidateState tracks one response candidate across all attempts of a session
+type candidateState struct {
+	index       int
+	detector    CompletionDetector
+	accumulator *ResponseAccumulator
+	retries     int
+	done        bool
+	// outputTokens counts the tokens the candidate generated in the finished attempts
+	outputTokens int
+
+	isOutputtingFormalText bool
+	swallowModeActive      bool
+
+	// Per-attempt state
+	interruptionReason           string
+	cleanExit                    bool
+	textInThisStream             string
+	attemptLastFormalText        string
+	attemptLastFormalEvent       SSEEvent
+	attemptLastFormalChunk       *Chunk
+	attemptLastFormalTextFlushed bool
+	// holdingStart is set while the beginning of a resumed attempt is held back to strip its
+	// preamble and the text it repeats; held keeps those events and heldText their formal text
+	holdingStart bool
+	held         []heldEvent
+	heldText     strings.Builder
+}
+
+// resetAttempt clears the per-attempt state before the candidate takes part in a new attempt
+func (c *candidateState) resetAttempt() {
+	c.interruptionReason = ""
+	c.cleanExit = false
+	c.textInThisStream = ""
+	c.attemptLastFormalText = ""
+	c.attemptLastFormalEvent = SSEEvent{}
+	c.attemptLastFormalChunk = nil
+	c.attemptLastFormalTextFlushed = false
+	c.holdingStart = false
+	c.held = nil
+	c.heldText.Reset()
+}
+
+// settled reports whether the candidate finished or was interrupted in the current attempt
+func (c *candidateState) settled() bool {
+	return c.cleanExit || c.interruptionReason != ""
+}
+
+// streamSession holds the state shared by all candidates of one proxied request
+type streamSession struct {
+	cfg           *config.Config
+	writer        StreamWriter
+	hasSentinel   bool
+	sentinelToken string
+	multi         bool
+	// retryHint is the reconnection time announced by the last SSE retry field
+	retryHint time.Duration
+	// tokenBudget is the maxOutputTokens of the request, shared by all attempts (0 = none)
+	tokenBudget int
+	// attemptUsage is the latest usageMetadata of the current attempt, usageHistory the latest
+	// one of every finished attempt that reported any
+	attemptUsage *gemini.UsageMetadata
+	usageHistory []*gemini.UsageMetadata
+	// preamblePatterns are compiled when a resumed attempt is first checked for a preamble
+	preamblePatterns []*regexp.Regexp
+	// hedgeExtraRequests counts the requests hedged retries sent on top of one per retry
+	hedgeExtraRequests int
+}
+
+// label prefixes log messages with the candidate index when the response has several candidates
+func (s *streamSession) label(c *candidateState) string {
+	if !s.multi {
+		return ""
 	}
+	return fmt.Sprintf("[candidate %d] ", c.index)
+}
 
-	if len(candidatesArray) == 0 {
-		logger.LogDebug("Candidates array is empty")
-		return false
+// forward sends an event to the client
+func (s *streamSession) forward(event SSEEvent) error {
+	return s.writer.WriteEvent(event)
+}
+
+// processEvent applies the retry decision logic to one event of a candidate and forwards it when
+// it is good. candidateChunk is the candidate's share of the event's chunk, with the index
+// upstream gave it. The returned error is only set when writing to the client fails.
+func (s *streamSession) processEvent(c *candidateState, event SSEEvent, candidateChunk CandidateChunk) error {
+	if event.Retry > 0 {
+		s.retryHint = time.Duration(event.Retry) * time.Millisecond
+	}
+	if !event.IsMessage() {
+		// Only message events carry response chunks
+		return s.forward(event)
 	}
 
-	// Check if first candidate has valid structure
-	if _, ok := candidatesArray[0].(map[string]interface{}); ok {
-		// Basic structure validation - candidate should be a map
-		logger.LogDebug("Response structure validation passed")
-		return true
+	chunk := candidateChunk.Chunk
+	content := ParseChunkContent(chunk)
+	isThought := content.IsThought
+
+	// Thought swallowing logic
+	if c.swallowModeActive {
+		if isThought {
+			logger.LogDebug("Swallowing thought chunk due to post-retry filter:", chunk.Data())
+			finishReason := ExtractFinishReason(chunk)
+			if finishReason != "" {
+				logger.LogError(fmt.Sprintf("%sStream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", s.label(c), finishReason))
+				c.interruptionReason = "FINISH_DURING_THOUGHT"
+			}
+			return nil
+		} else {
+			logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
+			c.swallowModeActive = false
+			if content.HasThought {
+				// Thoughts sharing a chunk with the first formal part are swallowed as well
+				RemoveThoughtParts(chunk)
+			}
+		}
 	}
 
-	logger.LogDebug("First candidate has invalid structure")
-	return false
+	// The beginning of a resumed attempt is held back until it is known whether it opens with
+	// a preamble or repeats the previous output
+	if c.holdingStart {
+		return s.holdResumeStart(c, event, candidateChunk, content)
+	}
+	return s.deliverEvent(c, event, candidateChunk, content)
 }
 
-// BuildRetryRequestBody builds a new request body for retry with accumulated context
-func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText string) (map[string]interface{}, error) {
-	logger.LogDebug(fmt.Sprintf("Building retry request body. Accumulated text length: %d", len(accumulatedText)))
-	logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", func() string {
-		if len(accumulatedText) > 200 {
-			return accumulatedText[:200] + "..."
+// deliverEvent judges a message event of a candidate, with its parsed content, and forwards it
+// when it is good
+func (s *streamSession) deliverEvent(c *candidateState, event SSEEvent, candidateChunk CandidateChunk, content ChunkContent) error {
+	chunk := candidateChunk.Chunk
+	textChunk := content.Text
+	isThought := content.IsThought
+
+	// Record the last formal text chunk for this attempt as early as possible,
+	// so even if this chunk triggers a retry (e.g., STOP but considered incomplete),
+	// it is still considered in cross-attempt punctuation heuristic.
+	if textChunk != "" && !isThought {
+		c.attemptLastFormalText = textChunk
+		c.attemptLastFormalEvent = SSEEvent{Event: event.Event, ID: event.ID}
+		c.attemptLastFormalChunk = chunk
+		c.attemptLastFormalTextFlushed = false
+	}
+
+	// Retry decision logic
+	finishReason := ExtractFinishReason(chunk)
+
+	if finishReason != "" && isThought {
+		logger.LogError(fmt.Sprintf("%sStream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", s.label(c), finishReason))
+		c.interruptionReason = "FINISH_DURING_THOUGHT"
+	} else if IsBlockedChunk(chunk) {
+		logger.LogError(fmt.Sprintf("%sContent blocked detected in chunk: %s", s.label(c), chunk.Data()))
+		c.interruptionReason = "BLOCK"
+	} else if finishReason == "STOP" {
+		tempAccumulatedText := c.accumulator.Text() + textChunk
+		trimmedText := strings.TrimSpace(tempAccumulatedText)
+		endsWithFunctionCall := chunkEndsWithFunctionCall(content.Parts, c.accumulator)
+
+		// A turn ending in a complete function call is finished without any sentinel
+		if endsWithFunctionCall {
+			logger.LogInfo(s.label(c) + "Finish reason 'STOP' after a function call. Accepting as complete.")
+		} else if len(trimmedText) == 0 {
+			// Check for empty response - if we have STOP but no accumulated output at all, it's incomplete
+			logger.LogError(s.label(c) + "Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
+			c.interruptionReason = "FINISH_EMPTY_RESPONSE"
+		} else if err := c.detector.CheckComplete(trimmedText); err != nil {
+			logger.LogError(fmt.Sprintf("%sFinish reason 'STOP' treated as incomplete by the %s detector: %v. Triggering retry.", s.label(c), c.detector.Name(), err))
+			c.interruptionReason = "FINISH_INCOMPLETE"
 		}
-		return accumulatedText
-	}()))
+	} else if finishReason != "" && finishReason != "MAX_TOKENS" && finishReason != "STOP" {
+		logger.LogError(fmt.Sprintf("%sAbnormal finish reason: %s. Triggering retry.", s.label(c), finishReason))
+		c.interruptionReason = "FINISH_ABNORMAL"
+	}
 
-	retryBody := make(map[string]interface{})
-	for k, v := range originalBody {
-		retryBody[k] = v
+	if c.interruptionReason != "" {
+		return nil
 	}
 
-	contents, ok := retryBody["contents"].([]interface{})
-	if !ok {
-		logger.LogError("Failed to extract contents from retry body - contents field missing or invalid type")
-		return nil, fmt.Errorf("invalid contents field in retry request")
+	// Chunk is good: forward and update state
+	isEndOfResponse := s.hasSentinel && (finishReason == "STOP" || finishReason == "MAX_TOKENS")
+	RemoveDoneTokenFromChunk(chunk, s.sentinelToken, isEndOfResponse)
+	s.applySessionUsage(chunk)
+	if candidateChunk.Index != noCandidateIndex && candidateChunk.Index != c.index {
+		ReindexCandidate(chunk, c.index)
 	}
 
-	if len(contents) == 0 {
-		logger.LogError("Retry body contains empty contents array")
-		return nil, fmt.Errorf("retry request cannot have empty contents")
+	event.Data = chunk.Data()
+	if err := s.forward(event); err != nil {
+		return err
 	}
 
-	// Find last user message index
-	lastUserIndex := -1
-	for i := len(contents) - 1; i >= 0; i-- {
-		if content, ok := contents[i].(map[string]interface{}); ok {
-			if role, ok := content["role"].(string); ok && role == "user" {
-				lastUserIndex = i
-				break
+	// Accumulate the parts in order; thoughts and signatures are only replayed when configured
+	for _, part := range content.Parts {
+		signature := ""
+		if s.cfg.ResumeThoughtSignatures {
+			signature = part.Signature
+		}
+
+		switch {
+		case !part.IsFormal():
+			if s.cfg.ResumeThoughtText {
+				c.accumulator.AddThought(part.Text, signature)
+			} else if signature != "" {
+				c.accumulator.AddThought("", signature)
 			}
+		case part.HasText:
+			c.isOutputtingFormalText = true
+			c.accumulator.AddSignedText(part.Text, signature)
+		default:
+			c.isOutputtingFormalText = true
+			c.accumulator.AddPart(part.Part)
 		}
 	}
+	if textChunk != "" {
+		c.textInThisStream += textChunk
+		c.attemptLastFormalTextFlushed = true
+	}
 
-	// Build retry context
-	history := []interface{}{
-		map[string]interface{}{
-			"role": "model",
-			"parts": []interface{}{
-				map[string]interface{}{"text": accumulatedText},
-			},
-		},
-		map[string]interface{}{
-			"role": "user",
-			"parts": []interface{}{
-				map[string]interface{}{"text": "Continue exactly where you left off without any preamble or repetition."},
-			},
-		},
+	if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
+		logger.LogInfo(fmt.Sprintf("%sFinish reason '%s' accepted as final. Stream complete.", s.label(c), finishReason))
+		c.cleanExit = true
+	}
+	return nil
+}
+
+// settleAttempt decides the outcome of an attempt for a candidate once its stream has ended
+func (s *streamSession) settleAttempt(c *candidateState) {
+	if c.holdingStart {
+		// The stream ended while the beginning of the attempt was held back
+		if err := s.releaseHeld(c); err != nil {
+			logger.LogError(s.label(c)+"Failed to forward the held chunks:", err)
+		}
 	}
 
-	// Insert history after last user message
-	if lastUserIndex != -1 {
-		newContents := make([]interface{}, 0, len(contents)+2)
-		newContents = append(newContents, contents[:lastUserIndex+1]...)
-		newContents = append(newContents, history...)
-		newContents = append(newContents, contents[lastUserIndex+1:]...)
-		retryBody["contents"] = newContents
-		logger.LogDebug(fmt.Sprintf("Inserted retry context after user message at index %d", lastUserIndex))
-	} else {
-		newContents := append(contents, history...)
-		retryBody["contents"] = newContents
-		logger.LogDebug("Appended retry context to end of conversation")
+	if !c.cleanExit && c.interruptionReason == "" {
+		logger.LogError(s.label(c) + "Stream ended without finish reason - detected as DROP")
+		c.interruptionReason = "DROP"
 	}
 
-	finalContents := retryBody["contents"].([]interface{})
-	if len(finalContents) == 0 {
-		logger.LogError("CRITICAL: Final retry request body has empty contents array")
-		return nil, fmt.Errorf("final retry body validation failed: empty contents")
+	logger.LogDebug(fmt.Sprintf("  %sText generated this stream: %d chars", s.label(c), len(c.textInThisStream)))
+	logger.LogDebug(fmt.Sprintf("  %sTotal accumulated text: %d chars", s.label(c), len(c.accumulator.Text())))
+
+	// A function call cannot be resumed without its response, so a turn that already ends in a
+	// complete function call is handed back to the client as finished.
+	if !c.cleanExit && c.accumulator.EndsWithFunctionCall() {
+		logger.LogInfo(fmt.Sprintf("%sStream interrupted (%s) right after a complete function call. Treating the turn as complete.", s.label(c), c.interruptionReason))
+		c.cleanExit = true
 	}
 
-	logger.LogDebug(fmt.Sprintf("Final retry request has %d messages", len(finalContents)))
-	// 记录第一条和最后一条消息的基本信息用于调试
-	if len(finalContents) > 0 {
-		if firstMsg, ok := finalContents[0].(map[string]interface{}); ok {
-			logger.LogDebug(fmt.Sprintf("First message role: %v", firstMsg["role"]))
-		}
-		if len(finalContents) > 1 {
-			if lastMsg, ok := finalContents[len(finalContents)-1].(map[string]interface{}); ok {
-				logger.LogDebug(fmt.Sprintf("Last message role: %v", lastMsg["role"]))
+	// Cross-attempt heuristic (optional): if we are in a resumed attempt (after at least one retry),
+	// the detector may accept the interrupted attempt as a finished answer, e.g. after several
+	// consecutive resume attempts ending with sentence punctuation.
+	if attemptJudge, ok := c.detector.(AttemptJudge); ok && !c.cleanExit && c.retries > 0 {
+		if attemptJudge.AcceptInterruptedAttempt(c.attemptLastFormalText) {
+			// If the last formal text of this attempt was not flushed due to early interruption,
+			// flush it now so the client receives the most recent block.
+			if !c.attemptLastFormalTextFlushed && c.attemptLastFormalChunk != nil {
+				last := c.attemptLastFormalEvent
+				lastChunk := c.attemptLastFormalChunk
+				isEnd := ExtractFinishReason(lastChunk)
+				shouldRemove := s.hasSentinel && (isEnd == "STOP" || isEnd == "MAX_TOKENS")
+				RemoveDoneTokenFromChunk(lastChunk, s.sentinelToken, shouldRemove)
+				s.applySessionUsage(lastChunk)
+				if s.multi {
+					ReindexCandidate(lastChunk, c.index)
+				}
+				last.Data = lastChunk.Data()
+				if err := s.forward(last); err == nil {
+					// Keep accounting consistent
+					c.accumulator.AddText(c.attemptLastFormalText)
+					c.textInThisStream += c.attemptLastFormalText
+					c.isOutputtingFormalText = true
+				}
 			}
+			c.cleanExit = true
+		}
+	}
+
+	// Without budget left there is nothing to resume: the answer ends as if upstream had hit the limit
+	if !c.cleanExit && s.budgetExhausted(c) {
+		logger.LogInfo(fmt.Sprintf("%sOutput token budget (%d) exhausted after %s. Finishing with MAX_TOKENS.", s.label(c), s.tokenBudget, c.interruptionReason))
+		if err := s.finishWithMaxTokens(c); err != nil {
+			logger.LogError(s.label(c)+"Failed to write the final chunk:", err)
 		}
+		c.cleanExit = true
+	}
+
+	if c.cleanExit {
+		c.done = true
 	}
-	return retryBody, nil
 }
 
-// ProcessStreamAndRetryInternally handles streaming with internal retry logic
-func ProcessStreamAndRetryInternally(cfg *config.Config, initialReader io.Reader, writer io.Writer, originalRequestBody map[string]interface{}, upstreamURL string, originalHeaders http.Header) error {
-	var accumulatedText string
-	consecutiveRetryCount := 0
-	currentReader := initialReader
-	totalLinesProcessed := 0
+// ProcessStreamAndRetryInternally handles streaming with internal retry logic.
+// The session stops as soon as ctx is done (e.g. the downstream client disconnected);
+// every upstream request and wait is bound to ctx, and the body of each attempt is closed
+// before the next one starts.
+//
+// When the request asks for several candidates, each one is accumulated and judged on its own.
+// Broken candidates are resumed one at a time with a single-candidate request whose chunks are
+// renumbered to the index of the candidate they continue.
+//
+// route picks the model of each retry and records the model that finished the answer.
+func ProcessStreamAndRetryInternally(ctx context.Context, cfg *config.Config, detector CompletionDetector, strategy ResumeStrategy, route *ModelRoute, initialBody io.ReadCloser, writer StreamWriter, originalRequest *gemini.GenerateContentRequest, upstreamURL string, originalHeaders http.Header) error {
+	currentBody := initialBody
+	totalEventsProcessed := 0
 	sessionStartTime := time.Now()
 
-	isOutputtingFormalText := false
-	swallowModeActive := false
-	// Counts consecutive resume attempts (after at least one retry) whose last formal text ends with sentence punctuation
-	resumePunctStreak := 0
-
-	// Get maxOutputTokens from client request, with a default fallback
-	maxOutputChars := 65535 // Default value
-	if genConfig, ok := originalRequestBody["generationConfig"].(map[string]interface{}); ok {
-		if maxTokens, ok := genConfig["maxOutputTokens"].(float64); ok && maxTokens > 0 {
-			maxOutputChars = int(maxTokens)
-			logger.LogInfo(fmt.Sprintf("Client-specified maxOutputTokens found, character limit set to: %d", maxOutputChars))
-		}
-	}
+	retryPolicy := NewRetryPolicy(cfg)
+	backoff := NewBackoff(cfg)
 
-	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d", cfg.MaxConsecutiveRetries))
+	session := &streamSession{cfg: cfg, writer: writer}
 
-	for {
-		interruptionReason := ""
-		cleanExit := false
-		streamStartTime := time.Now()
-		linesInThisStream := 0
-		textInThisStream := ""
+	// Detectors that mark completion in-band have their token stripped from the final chunk
+	if stripper, ok := detector.(SentinelStripper); ok {
+		session.hasSentinel = true
+		session.sentinelToken = stripper.Sentinel()
+	}
 
-		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", consecutiveRetryCount+1, cfg.MaxConsecutiveRetries+1))
+	// maxOutputTokens of the client request is a budget for the whole session, not for each attempt
+	if genConfig := originalRequest.GenerationConfig; genConfig != nil && genConfig.MaxOutputTokens > 0 {
+		session.tokenBudget = genConfig.MaxOutputTokens
+		logger.LogInfo(fmt.Sprintf("Client-specified maxOutputTokens found, output token budget set to: %d", session.tokenBudget))
+	}
 
-		// Create channel for SSE lines
-		lineCh := make(chan string, 100)
-		go SSELineIterator(currentReader, lineCh)
+	candidateCount := RequestedCandidateCount(originalRequest)
+	session.multi = candidateCount > 1
+	candidates := make([]*candidateState, candidateCount)
+	for i := range candidates {
+		candidates[i] = &candidateState{index: i, detector: detector, accumulator: &ResponseAccumulator{}}
+		if i > 0 {
+			candidates[i].detector = cloneDetector(detector)
+		}
+	}
+	if session.multi {
+		logger.LogInfo(fmt.Sprintf("Request asks for %d candidates; each candidate is tracked separately", candidateCount))
+	}
 
-		// Track the last formal text chunk seen in this attempt
-		attemptLastFormalText := ""
-		attemptLastFormalDataLine := ""
-		attemptLastFormalTextFlushed := false
+	// The first attempt streams every candidate; resumed attempts stream a single one
+	active := candidates
 
-		// Process lines
-		for line := range lineCh {
-			totalLinesProcessed++
-			linesInThisStream++
+	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d", cfg.MaxConsecutiveRetries))
 
-			var textChunk string
-			var isThought bool
+	for {
+		streamStartTime := time.Now()
+		eventsInThisStream := 0
+		for _, c := range active {
+			c.resetAttempt()
+			session.armResumeFilter(c)
+		}
+		session.closeAttemptUsage()
+		current := active[0]
+		resumed := len(active) == 1 && active[0].retries > 0
+		writer.BeginAttempt()
+
+		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", current.retries+1, cfg.MaxConsecutiveRetries+1))
+
+		// Create channel for SSE events (JSON array streams are converted to message events).
+		// The iterator stops when the attempt is cancelled.
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		eventCh := make(chan SSEEvent, 100)
+		if raced, ok := currentBody.(*raceBody); ok && raced.rest != nil {
+			// The stream of a hedged retry was read up to its first formal output already
+			go raced.replay(attemptCtx, eventCh)
+		} else {
+			go StreamEventIterator(attemptCtx, currentBody, cfg.SSEMaxEventBytes, eventCh)
+		}
 
-			if IsDataLine(line) {
-				content := ParseLineContent(line)
-				textChunk = content.Text
-				isThought = content.IsThought
+		// Process events
+		var writeErr error
+	events:
+		for event := range eventCh {
+			totalEventsProcessed++
+			eventsInThisStream++
+
+			// Every chunk is decoded once here; it is only encoded again if it gets modified
+			chunks := []CandidateChunk{{Index: noCandidateIndex, Chunk: rawChunk(event.Data)}}
+			if event.IsMessage() {
+				parsed := ParseChunk(event.Data)
+				session.recordUsage(parsed)
+				chunks = SplitCandidates(parsed)
 			}
 
-			// Thought swallowing logic
-			if swallowModeActive {
-				if isThought {
-					logger.LogDebug("Swallowing thought chunk due to post-retry filter:", line)
-					finishReason := ExtractFinishReason(line)
-					if finishReason != "" {
-						logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
-						interruptionReason = "FINISH_DURING_THOUGHT"
-						break
+			for _, chunk := range chunks {
+				var targets []*candidateState
+				switch {
+				case len(active) == 1:
+					// A single active candidate receives every event, whatever index upstream gave it
+					targets = active
+				case chunk.Index == noCandidateIndex && IsBlockedChunk(chunk.Chunk):
+					// A blocked prompt interrupts every candidate
+					targets = active
+				case chunk.Index == noCandidateIndex:
+					if writeErr = session.forward(SSEEvent{Event: event.Event, ID: event.ID, Data: chunk.Chunk.Data()}); writeErr != nil {
+						break events
 					}
 					continue
-				} else {
-					logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
-					swallowModeActive = false
+				case chunk.Index < len(candidates) && !resumed:
+					targets = []*candidateState{candidates[chunk.Index]}
+				default:
+					logger.LogDebug(fmt.Sprintf("Ignoring chunk for unexpected candidate index %d", chunk.Index))
+					continue
 				}
-			}
-
-			// Record the last formal text chunk for this attempt as early as possible,
-			// so even if this line triggers a retry (e.g., STOP but considered incomplete),
-			// it is still considered in cross-attempt punctuation heuristic.
-			if textChunk != "" && !isThought {
-				attemptLastFormalText = textChunk
-				attemptLastFormalDataLine = line
-				attemptLastFormalTextFlushed = false
-			}
 
-			// Retry decision logic
-			finishReason := ExtractFinishReason(line)
-			needsRetry := false
-
-			if finishReason != "" && isThought {
-				logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_DURING_THOUGHT"
-				needsRetry = true
-			} else if IsBlockedLine(line) {
-				logger.LogError(fmt.Sprintf("Content blocked detected in line: %s", line))
-				interruptionReason = "BLOCK"
-				needsRetry = true
-			} else if finishReason == "STOP" {
-				tempAccumulatedText := accumulatedText + textChunk
-				trimmedText := strings.TrimSpace(tempAccumulatedText)
-
-				// Check for empty response - if we have STOP but no accumulated text at all, it's incomplete
-				if len(trimmedText) == 0 {
-					logger.LogError("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
-					interruptionReason = "FINISH_EMPTY_RESPONSE"
-					needsRetry = true
-				} else if !strings.HasSuffix(trimmedText, "[done]") {
-					runes := []rune(trimmedText)
-					lastChar := string(runes[len(runes)-1])
-					logger.LogError(fmt.Sprintf("Finish reason 'STOP' treated as incomplete because text ends with '%s'. Triggering retry.", lastChar))
-					interruptionReason = "FINISH_INCOMPLETE"
-					needsRetry = true
+				for _, c := range targets {
+					if c.settled() {
+						continue
+					}
+					if writeErr = session.processEvent(c, event, chunk); writeErr != nil {
+						break events
+					}
 				}
-			} else if finishReason != "" && finishReason != "MAX_TOKENS" && finishReason != "STOP" {
-				logger.LogError(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
-				interruptionReason = "FINISH_ABNORMAL"
-				needsRetry = true
 			}
 
-			if needsRetry {
-				break
-			}
-
-			// Line is good: forward and update state
-			isEndOfResponse := finishReason == "STOP" || finishReason == "MAX_TOKENS"
-			processedLine := RemoveDoneTokenFromLine(line, isEndOfResponse)
-
-			if _, err := writer.Write([]byte(processedLine + "\n\n")); err != nil {
-				return fmt.Errorf("failed to write to output stream: %w", err)
-			}
-
-			// Flush the response to ensure data is sent immediately to the client
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
+			allSettled := true
+			for _, c := range active {
+				allSettled = allSettled && c.settled()
 			}
-
-			if textChunk != "" && !isThought {
-				isOutputtingFormalText = true
-				accumulatedText += textChunk
-				textInThisStream += textChunk
-				attemptLastFormalTextFlushed = true
-			}
-
-			// Check for total output character limit
-			if maxOutputChars > 0 && len(accumulatedText) >= maxOutputChars {
-				logger.LogInfo(fmt.Sprintf("Total output character limit (%d) reached. Treating as a clean exit.", maxOutputChars))
-				cleanExit = true
+			if allSettled {
 				break
 			}
+		}
 
-			if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
-				logger.LogInfo(fmt.Sprintf("Finish reason '%s' accepted as final. Stream complete.", finishReason))
-				cleanExit = true
-				break
-			}
+		// Release this attempt: stop the iterator goroutine and the upstream connection
+		cancelAttempt()
+		currentBody.Close()
+		currentBody = http.NoBody
+
+		if writeErr != nil {
+			return fmt.Errorf("failed to write to output stream: %w", writeErr)
 		}
 
-		if !cleanExit && interruptionReason == "" {
-			logger.LogError("Stream ended without finish reason - detected as DROP")
-			interruptionReason = "DROP"
+		if err := ctx.Err(); err != nil {
+			return sessionCanceled(err, current.retries)
 		}
 
 		streamDuration := time.Since(streamStartTime)
 		logger.LogDebug("Stream attempt summary:")
 		logger.LogDebug(fmt.Sprintf("  Duration: %v", streamDuration))
-		logger.LogDebug(fmt.Sprintf("  Lines processed: %d", linesInThisStream))
-		logger.LogDebug(fmt.Sprintf("  Text generated this stream: %d chars", len(textInThisStream)))
-		logger.LogDebug(fmt.Sprintf("  Total accumulated text: %d chars", len(accumulatedText)))
-
-		// Cross-attempt heuristic (optional): if we are in a resumed attempt (after at least one retry)
-		// and the last formal text of this attempt ends with sentence punctuation, count streak.
-		// If we reach 3 such consecutive resume attempts, treat as success and finish.
-		if cfg.EnablePunctuationHeuristic && !cleanExit && consecutiveRetryCount > 0 {
-			if attemptLastFormalText != "" && endsWithSentencePunctuation(attemptLastFormalText) {
-				resumePunctStreak++
-				logger.LogInfo(fmt.Sprintf("Resume punctuation streak incremented to %d (last formal text ends with sentence punctuation)", resumePunctStreak))
-			} else {
-				if attemptLastFormalText == "" {
-					logger.LogDebug("No formal text in this attempt; resetting resume punctuation streak to 0")
-				} else {
-					logger.LogDebug("Last formal text does not end with sentence punctuation; resetting resume punctuation streak to 0")
-				}
-				resumePunctStreak = 0
+		logger.LogDebug(fmt.Sprintf("  Events processed: %d", eventsInThisStream))
+		session.chargeAttempt(active)
+		for _, c := range active {
+			session.settleAttempt(c)
+		}
+
+		// The backoff grows over consecutive failures, whether a request failed or its stream
+		// broke off, and only starts over once an attempt completes a candidate
+		for _, c := range active {
+			if c.done {
+				backoff.Reset()
+				break
 			}
+		}
 
-			if resumePunctStreak >= 3 {
-				logger.LogInfo("Treating stream as successful due to 3 consecutive resume attempts ending with sentence punctuation.")
-				// If the last formal text of this attempt was not flushed due to early interruption,
-				// flush it now so the client receives the most recent block.
-				if !attemptLastFormalTextFlushed && attemptLastFormalDataLine != "" {
-					isEnd := ExtractFinishReason(attemptLastFormalDataLine)
-					shouldRemove := isEnd == "STOP" || isEnd == "MAX_TOKENS"
-					processed := RemoveDoneTokenFromLine(attemptLastFormalDataLine, shouldRemove)
-					if _, err := writer.Write([]byte(processed + "\n\n")); err == nil {
-						if flusher, ok := writer.(http.Flusher); ok {
-							flusher.Flush()
-						}
-						// Keep accounting consistent
-						accumulatedText += attemptLastFormalText
-						textInThisStream += attemptLastFormalText
-						isOutputtingFormalText = true
-					}
-				}
-				cleanExit = true
+		// Pick the next candidate to resume, in index order
+		var broken *candidateState
+		totalRetries := 0
+		totalText := 0
+		for _, c := range candidates {
+			totalRetries += c.retries
+			totalText += len(c.accumulator.Text())
+			if broken == nil && !c.done {
+				broken = c
 			}
 		}
 
-		if cleanExit {
+		if broken == nil {
 			sessionDuration := time.Since(sessionStartTime)
 			logger.LogInfo("=== STREAM COMPLETED SUCCESSFULLY ===")
 			logger.LogInfo(fmt.Sprintf("Total session duration: %v", sessionDuration))
-			logger.LogInfo(fmt.Sprintf("Total lines processed: %d", totalLinesProcessed))
-			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", len(accumulatedText)))
-			logger.LogInfo(fmt.Sprintf("Total retries needed: %d", consecutiveRetryCount))
+			logger.LogInfo(fmt.Sprintf("Total events processed: %d", totalEventsProcessed))
+			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", totalText))
+			logger.LogInfo(fmt.Sprintf("Total retries needed: %d", totalRetries))
+			if totalRetries > 0 {
+				logger.LogInfo(fmt.Sprintf("Resume strategy: %s", strategy.name()))
+			}
+			logger.LogInfo(fmt.Sprintf("Answer finished by model: %s", route.Served()))
 			return nil
 		}
 
+		current = broken
+		active = []*candidateState{current}
+		interruptionReason := current.interruptionReason
+		accumulator := current.accumulator
+
 		// Interruption & Retry Activation
 		logger.LogError("=== STREAM INTERRUPTED ===")
-		logger.LogError(fmt.Sprintf("Reason: %s", interruptionReason))
+		logger.LogError(fmt.Sprintf("%sReason: %s", session.label(current), interruptionReason))
 
-		if cfg.SwallowThoughtsAfterRetry && isOutputtingFormalText {
+		if cfg.SwallowThoughtsAfterRetry && current.isOutputtingFormalText {
 			logger.LogInfo("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
-			swallowModeActive = true
+			current.swallowModeActive = true
 		}
 
-		logger.LogError(fmt.Sprintf("Current retry count: %d", consecutiveRetryCount))
-		logger.LogError(fmt.Sprintf("Max retries allowed: %d", cfg.MaxConsecutiveRetries))
-		logger.LogError(fmt.Sprintf("Text accumulated so far: %d characters", len(accumulatedText)))
-
-		if consecutiveRetryCount >= cfg.MaxConsecutiveRetries {
+		interruptionDecision := retryPolicy.DecideInterruption(interruptionReason)
+		if interruptionDecision.Action == RetryActionAbort {
+			logger.LogError(fmt.Sprintf("Retry policy (%s) forbids retrying after %s. Aborting stream.", interruptionDecision.Source, interruptionReason))
 			errorPayload := map[string]interface{}{
 				"error": map[string]interface{}{
-					"code":    504,
-					"status":  "DEADLINE_EXCEEDED",
-					"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", cfg.MaxConsecutiveRetries, interruptionReason),
+					"code":    500,
+					"status":  "INTERNAL",
+					"message": fmt.Sprintf("Stream interrupted (%s) and the retry policy does not allow retrying.", interruptionReason),
 					"details": []interface{}{
 						map[string]interface{}{
 							"@type":                  "proxy.debug",
-							"accumulated_text_chars": len(accumulatedText),
+							"accumulated_text_chars": len(accumulator.Text()),
+							"candidate_index":        current.index,
 						},
 					},
 				},
 			}
-
 			errorBytes, _ := json.Marshal(errorPayload)
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+			writer.WriteError(errorBytes)
+			return fmt.Errorf("retry aborted by policy after %s", interruptionReason)
+		}
 
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
-			}
+		logger.LogError(fmt.Sprintf("Current retry count: %d", current.retries))
+		logger.LogError(fmt.Sprintf("Max retries allowed: %d", cfg.MaxConsecutiveRetries))
+		logger.LogError(fmt.Sprintf("Text accumulated so far: %d characters", len(accumulator.Text())))
 
-			return fmt.Errorf("retry limit exceeded")
+		if current.retries >= cfg.MaxConsecutiveRetries {
+			return session.retryLimitExceeded(current, interruptionReason)
 		}
 
-		consecutiveRetryCount++
-		logger.LogInfo(fmt.Sprintf("=== STARTING RETRY %d/%d ===", consecutiveRetryCount, cfg.MaxConsecutiveRetries))
-
-		// Build retry request
-		retryBody, err := BuildRetryRequestBody(originalRequestBody, accumulatedText)
-		if err != nil {
-			logger.LogError("Failed to build retry request body:", err)
-			// 发送错误到客户端而不是继续重试
-			errorPayload := map[string]interface{}{
-				"error": map[string]interface{}{
-					"code":    400,
-					"status":  "INVALID_ARGUMENT",
-					"message": "Failed to build retry request: " + err.Error(),
-				},
+		route.Fail(interruptionReason)
+		current.retries++
+		consecutiveRetryCount := current.retries
+		logger.LogInfo(fmt.Sprintf("=== %sSTARTING RETRY %d/%d ===", session.label(current), consecutiveRetryCount, cfg.MaxConsecutiveRetries))
+
+		interruptionDelay := interruptionDecision.Delay
+		if interruptionDecision.HasDelay {
+			logger.LogInfo(fmt.Sprintf("Retry policy (%s) delays retry by %v", interruptionDecision.Source, interruptionDelay))
+		} else {
+			interruptionDelay = backoff.Next()
+			logger.LogInfo(fmt.Sprintf("Backing off %v before retrying after %s", interruptionDelay, interruptionReason))
+		}
+		if cfg.HonorRetryAfter && session.retryHint > interruptionDelay {
+			// The stream announced a reconnection time with the SSE retry field
+			interruptionDelay = session.retryHint
+			if cfg.RetryAfterMaxMs > 0 && interruptionDelay > cfg.RetryAfterMaxMs {
+				interruptionDelay = cfg.RetryAfterMaxMs
 			}
-			errorBytes, _ := json.Marshal(errorPayload)
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
+			logger.LogInfo(fmt.Sprintf("Honoring SSE retry field: waiting %v before reconnecting", interruptionDelay))
+		}
+		if interruptionDelay > 0 {
+			if err := pause(ctx, interruptionDelay); err != nil {
+				return sessionCanceled(err, consecutiveRetryCount)
 			}
-			return fmt.Errorf("retry request validation failed: %w", err)
 		}
 
-		// Log the retry request body for debugging
-		prettyBodyBytes, _ := json.MarshalIndent(retryBody, "  ", "  ")
-		f, err := os.OpenFile("debug.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err == nil {
-			f.WriteString("\n--- RETRY REQUEST ---")
-			f.Write(prettyBodyBytes)
-			f.Close()
-		}
+		// Send retry requests until one yields a new stream. A failed request is a retry of its
+		// own, judged by its status code: it never opened a stream, so it is not an interruption.
+		for {
+			// Build retry request
+			logger.LogInfo(fmt.Sprintf("%sResume strategy: %s", session.label(current), strategy.name()))
+			retryBody, err := BuildRetryRequestBody(originalRequest, accumulator, strategy)
+			if err != nil {
+				logger.LogError("Failed to build retry request body:", err)
+				// 发送错误到客户端而不是继续重试
+				errorPayload := map[string]interface{}{
+					"error": map[string]interface{}{
+						"code":    400,
+						"status":  "INVALID_ARGUMENT",
+						"message": "Failed to build retry request: " + err.Error(),
+					},
+				}
+				errorBytes, _ := json.Marshal(errorPayload)
+				writer.WriteError(errorBytes)
+				return fmt.Errorf("retry request validation failed: %w", err)
+			}
+			if session.tokenBudget > 0 {
+				// The resumed attempt may only spend what is left of the budget
+				retryBody.GenerationConfig.MaxOutputTokens = session.remainingTokens(current)
+				logger.LogInfo(fmt.Sprintf("%sOutput tokens used: %d of %d. Retry limited to maxOutputTokens=%d", session.label(current), current.outputTokens, session.tokenBudget, retryBody.GenerationConfig.MaxOutputTokens))
+			}
 
-		retryBodyBytes, err := json.Marshal(retryBody)
-		if err != nil {
-			logger.LogError("Failed to marshal retry body:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+			// Log the retry request body for debugging
+			prettyBodyBytes, _ := json.MarshalIndent(retryBody, "  ", "  ")
+			f, err := os.OpenFile("debug.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err == nil {
+				f.WriteString("\n--- RETRY REQUEST ---")
+				f.Write(prettyBodyBytes)
+				f.Close()
+			}
 
-		// Create retry request
-		retryReq, err := http.NewRequest("POST", upstreamURL, bytes.NewReader(retryBodyBytes))
-		if err != nil {
-			logger.LogError("Failed to create retry request:", err)
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+			var retryResponse *http.Response
+			retryBodyBytes, err := json.Marshal(retryBody)
+			if err != nil {
+				err = fmt.Errorf("failed to marshal retry body: %w", err)
+			} else {
+				retryURL := route.URL(upstreamURL)
+				logger.LogDebug(fmt.Sprintf("Making retry request to: %s", retryURL))
+				logger.LogDebug(fmt.Sprintf("Retry request body size: %d bytes", len(retryBodyBytes)))
+				retryResponse, err = session.sendRetry(ctx, retryURL, retryBodyBytes, originalHeaders)
+			}
+
+			var failure string
+			var delay time.Duration
+			if err != nil {
+				if ctx.Err() != nil {
+					return sessionCanceled(ctx.Err(), consecutiveRetryCount)
+				}
+				logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", consecutiveRetryCount))
+				logger.LogError("Exception during retry:", err)
+				failure = "request error"
+				delay = backoff.Next()
+			} else {
+				logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+
+				if retryResponse.StatusCode == http.StatusOK {
+					logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", consecutiveRetryCount))
+					logger.LogInfo(fmt.Sprintf("Continuing with accumulated context (%d chars)", len(accumulator.Text())))
+
+					route.serve(retryResponse.Request.URL.String())
+					currentBody = retryResponse.Body
+					break
+				}
+
+				errorBytes, _ := io.ReadAll(retryResponse.Body)
+				retryResponse.Body.Close()
+
+				upstreamStatus := ExtractUpstreamErrorStatus(errorBytes)
+				decision := retryPolicy.DecideHTTPStatus(retryResponse.StatusCode, upstreamStatus)
 
-		// Copy headers
-		for name, values := range originalHeaders {
-			if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
-				for _, value := range values {
-					retryReq.Header.Add(name, value)
+				if decision.Action == RetryActionAbort {
+					logger.LogError("=== FATAL ERROR DURING RETRY ===")
+					logger.LogError(fmt.Sprintf("Received non-retryable status %d (%s) during retry attempt %d. Matched rule: %s", retryResponse.StatusCode, upstreamStatus, consecutiveRetryCount, decision.Source))
+
+					// Report the upstream error to the client
+					writer.WriteError(errorBytes)
+
+					return fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
 				}
+
+				logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d (%s)", consecutiveRetryCount, retryResponse.StatusCode, upstreamStatus))
+				failure = strconv.Itoa(retryResponse.StatusCode)
+				route.Fail(failure)
+				delay = retryDelayFor(cfg, decision, backoff, retryResponse.Header, errorBytes)
+				logger.LogError(fmt.Sprintf("This is considered a retryable error (rule: %s)", decision.Source))
+			}
+
+			if current.retries >= cfg.MaxConsecutiveRetries {
+				return session.retryLimitExceeded(current, failure)
+			}
+			current.retries++
+			consecutiveRetryCount = current.retries
+			logger.LogInfo(fmt.Sprintf("=== %sSTARTING RETRY %d/%d ===", session.label(current), consecutiveRetryCount, cfg.MaxConsecutiveRetries))
+			logger.LogError(fmt.Sprintf("Will wait %v before the next request", delay))
+			if err := pause(ctx, delay); err != nil {
+				return sessionCanceled(err, consecutiveRetryCount)
 			}
 		}
+	}
+}
 
-		logger.LogDebug(fmt.Sprintf("Making retry request to: %s", upstreamURL))
-		logger.LogDebug(fmt.Sprintf("Retry request body size: %d bytes", len(retryBodyBytes)))
-
-		// Make retry request
-		client := &http.Client{}
-		retryResponse, err := client.Do(retryReq)
-		if err != nil {
-			logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", consecutiveRetryCount))
-			logger.LogError("Exception during retry:", err)
-			logger.LogError(fmt.Sprintf("Will wait %v before next attempt (if any)", cfg.RetryDelayMs))
-			time.Sleep(cfg.RetryDelayMs)
+// chunkEndsWithFunctionCall reports whether the model output, including the parts of the chunk
+// being processed, ends with a function call part
+func chunkEndsWithFunctionCall(parts []ChunkPart, accumulator *ResponseAccumulator) bool {
+	for i := len(parts) - 1; i >= 0; i-- {
+		part := parts[i]
+		if !part.IsFormal() || (part.HasText && part.Text == "") {
 			continue
 		}
+		return !part.HasText && part.Part.IsFunctionCall()
+	}
+	return accumulator.EndsWithFunctionCall()
+}
 
-		logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+// sendRetry sends a retry request, or several at once when retries are hedged
+func (s *streamSession) sendRetry(ctx context.Context, upstreamURL string, body []byte, headers http.Header) (*http.Response, error) {
+	if width := s.hedgeWidth(); width > 1 {
+		return s.hedgedRetry(ctx, width, upstreamURL, body, headers)
+	}
 
-		if nonRetryableStatuses[retryResponse.StatusCode] {
-			logger.LogError("=== FATAL ERROR DURING RETRY ===")
-			logger.LogError(fmt.Sprintf("Received non-retryable status %d during retry attempt %d", retryResponse.StatusCode, consecutiveRetryCount))
+	request, err := newRetryRequest(ctx, upstreamURL, body, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retry request: %w", err)
+	}
+	client := &http.Client{}
+	return client.Do(request)
+}
 
-			// Write SSE error from upstream
-			errorBytes, _ := io.ReadAll(retryResponse.Body)
-			retryResponse.Body.Close()
+// retryLimitExceeded reports to the client that candidate c used up its retries, the last one
+// failing for reason
+func (s *streamSession) retryLimitExceeded(c *candidateState, reason string) error {
+	errorPayload := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    504,
+			"status":  "DEADLINE_EXCEEDED",
+			"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", s.cfg.MaxConsecutiveRetries, reason),
+			"details": []interface{}{
+				map[string]interface{}{
+					"@type":                  "proxy.debug",
+					"accumulated_text_chars": len(c.accumulator.Text()),
+					"candidate_index":        c.index,
+				},
+			},
+		},
+	}
 
-			writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+	errorBytes, _ := json.Marshal(errorPayload)
+	s.writer.WriteError(errorBytes)
 
-			// Flush the error response to ensure it's sent immediately
-			if flusher, ok := writer.(http.Flusher); ok {
-				flusher.Flush()
-			}
+	return fmt.Errorf("retry limit exceeded")
+}
 
-			return fmt.Errorf("non-retryable error: %d", retryResponse.StatusCode)
+// newRetryRequest creates a retry request carrying the client's credentials and content headers
+func newRetryRequest(ctx context.Context, upstreamURL string, body []byte, headers http.Header) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
+			for _, value := range values {
+				request.Header.Add(name, value)
+			}
 		}
+	}
+	return request, nil
+}
 
-		if retryResponse.StatusCode != http.StatusOK {
-			logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d", consecutiveRetryCount, retryResponse.StatusCode))
-			logger.LogError("This is considered a retryable error - will try again if retries remain")
-			retryResponse.Body.Close()
-			time.Sleep(cfg.RetryDelayMs)
-			continue
-		}
+// pause waits between the attempts of a session; tests replace it to record the waits
+var pause = sleepContext
+
+// sleepContext waits for d or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
 
-		logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", consecutiveRetryCount))
-		logger.LogInfo(fmt.Sprintf("Continuing with accumulated context (%d chars)", len(accumulatedText)))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-		currentReader = retryResponse.Body
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
 }
+
+// sessionCanceled logs that the downstream client went away and wraps the context error
+func sessionCanceled(err error, retries int) error {
+	logger.LogInfo(fmt.Sprintf("=== CLIENT DISCONNECTED === Abandoning stream session after %d retries", retries))
+	return fmt.Errorf("stream session canceled: %w", err)
+}
+
+// retryDelayFor picks the wait before retrying a failed upstream request. An explicit policy delay
+// takes precedence over the backoff schedule, and a server-provided Retry-After/RetryInfo hint
+// extends the delay when it asks for a longer wait (capped by RetryAfterMaxMs).
+func retryDelayFor(cfg *config.Config, decision RetryDecision, backoff *Backoff, header http.Header, body []byte) time.Duration {
+	delay := decision.Delay
+	if !decision.HasDelay {
+		delay = backoff.Next()
+	}
+
+	if cfg.HonorRetryAfter {
+		if hint, ok := ParseRetryHint(header, body); ok {
+			if cfg.RetryAfterMaxMs > 0 && hint > cfg.RetryAfterMaxMs {
+				logger.LogInfo(fmt.Sprintf("Upstream asked to retry after %v; capping at %v", hint, cfg.RetryAfterMaxMs))
+				hint = cfg.RetryAfterMaxMs
+			}
+			if hint > delay {
+				logger.LogInfo(fmt.Sprintf("Honoring upstream retry hint of %v", hint))
+				delay = hint
+			}
+		}
+	}
+
+	return delay
+}
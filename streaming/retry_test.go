@@ -0,0 +1,246 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+const testRequest = `{"contents": [{"role": "user", "parts": [{"text": "Count to three."}]}]}`
+
+// testSessionConfig is the configuration of the session tests: a 10ms exponential backoff
+// without jitter, no resume filter and no hedging
+func testSessionConfig() *config.Config {
+	return &config.Config{
+		MaxConsecutiveRetries:  5,
+		RetryDelayMs:           10 * time.Millisecond,
+		RetryBackoffStrategy:   BackoffExponential,
+		RetryBackoffMultiplier: 2,
+		RetryMaxDelayMs:        time.Second,
+		RetryJitter:            JitterNone,
+		NoRetryErrorCodes:      []int{400, 401, 403, 404},
+		SSEMaxEventBytes:       1 << 20,
+		HedgedRetryRequests:    1,
+	}
+}
+
+// sseChunk returns an SSE message event carrying one text chunk of candidate 0, finished with
+// finishReason unless that is empty
+func sseChunk(text, finishReason string) string {
+	candidate := fmt.Sprintf(`{"content":{"role":"model","parts":[{"text":%q}]}`, text)
+	if finishReason != "" {
+		candidate += fmt.Sprintf(`,"finishReason":%q`, finishReason)
+	}
+	return "data: {\"candidates\":[" + candidate + "}]}\n\n"
+}
+
+// upstreamResponse is one answer of a test upstream
+type upstreamResponse struct {
+	status int
+	body   string
+}
+
+// testUpstream answers the retry requests of a session with its responses in turn, repeating
+// the last one
+type testUpstream struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []upstreamResponse
+	requests  []string
+}
+
+func newTestUpstream(t *testing.T, responses ...upstreamResponse) *testUpstream {
+	t.Helper()
+	upstream := &testUpstream{responses: responses}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstream.mu.Lock()
+		response := upstream.responses[min(len(upstream.requests), len(upstream.responses)-1)]
+		upstream.requests = append(upstream.requests, string(body))
+		upstream.mu.Unlock()
+
+		if response.status == http.StatusOK {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(response.status)
+		io.WriteString(w, response.body)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// URL returns the streaming URL of model
+func (u *testUpstream) URL(model string) string {
+	return u.Server.URL + "/v1beta/models/" + model + ":streamGenerateContent?alt=sse"
+}
+
+// Requests returns the bodies of the requests received so far
+func (u *testUpstream) Requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.requests...)
+}
+
+// recordingWriter keeps what a session sends to the client
+type recordingWriter struct {
+	attempts int
+	events   []SSEEvent
+	errors   []string
+}
+
+func (w *recordingWriter) BeginAttempt() { w.attempts++ }
+
+func (w *recordingWriter) WriteEvent(event SSEEvent) error {
+	w.events = append(w.events, event)
+	return nil
+}
+
+func (w *recordingWriter) WriteError(payload []byte) {
+	w.errors = append(w.errors, string(payload))
+}
+
+// text returns the formal text of the events sent to the client
+func (w *recordingWriter) text() string {
+	var b strings.Builder
+	for _, event := range w.events {
+		if event.IsMessage() {
+			b.WriteString(ParseChunkContent(ParseChunk(event.Data)).Text)
+		}
+	}
+	return b.String()
+}
+
+// recordPauses replaces the waits between attempts with a recorder that returns at once
+func recordPauses(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var pauses []time.Duration
+	pause = func(ctx context.Context, d time.Duration) error {
+		pauses = append(pauses, d)
+		return ctx.Err()
+	}
+	t.Cleanup(func() { pause = sleepContext })
+	return &pauses
+}
+
+// runSession runs a stream session for testRequest, starting with the stream initial
+func runSession(ctx context.Context, t *testing.T, cfg *config.Config, route *ModelRoute, upstreamURL, initial string) (*recordingWriter, error) {
+	t.Helper()
+	return runSessionBody(ctx, t, cfg, route, upstreamURL, io.NopCloser(strings.NewReader(initial)))
+}
+
+// runSessionBody runs a stream session for testRequest, starting with the stream read from initial
+func runSessionBody(ctx context.Context, t *testing.T, cfg *config.Config, route *ModelRoute, upstreamURL string, initial io.ReadCloser) (*recordingWriter, error) {
+	t.Helper()
+	return runSessionRequest(ctx, t, cfg, route, upstreamURL, testRequest, initial)
+}
+
+// runSessionRequest runs a stream session for the client request body, starting with the stream
+// read from initial
+func runSessionRequest(ctx context.Context, t *testing.T, cfg *config.Config, route *ModelRoute, upstreamURL, body string, initial io.ReadCloser) (*recordingWriter, error) {
+	t.Helper()
+	return runSessionDetector(ctx, t, cfg, trustStopDetector{}, route, upstreamURL, body, initial)
+}
+
+// runSessionDetector runs a stream session for the client request body judged by detector,
+// starting with the stream read from initial
+func runSessionDetector(ctx context.Context, t *testing.T, cfg *config.Config, detector CompletionDetector, route *ModelRoute, upstreamURL, body string, initial io.ReadCloser) (*recordingWriter, error) {
+	t.Helper()
+	request, err := gemini.ParseRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &recordingWriter{}
+	err = ProcessStreamAndRetryInternally(ctx, cfg, detector, ResumeStrategy{Name: ResumeTwoTurn}, route, initial, writer, request, upstreamURL, http.Header{})
+	return writer, err
+}
+
+func TestFailedRetryRequestIsNotAnInterruption(t *testing.T) {
+	pauses := recordPauses(t)
+	upstream := newTestUpstream(t,
+		upstreamResponse{http.StatusServiceUnavailable, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`},
+		upstreamResponse{http.StatusOK, sseChunk(" two, three.", "STOP")},
+	)
+
+	cfg := testSessionConfig()
+	// Route failures are counted while the requested model has a fallback left
+	cfg.ModelFallbackChains = map[string][]string{"gemini-test": {"gemini-fallback"}}
+	cfg.ModelFallbackAfter = map[string]int{"DROP": 10, "503": 10}
+	route := NewModelRoute(cfg, "gemini-test")
+
+	writer, err := runSession(context.Background(), t, cfg, route, upstream.URL("gemini-test"), sseChunk("One,", ""))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+
+	if got := writer.text(); got != "One, two, three." {
+		t.Errorf("client received %q", got)
+	}
+	if got := len(upstream.Requests()); got != 2 {
+		t.Errorf("upstream received %d retry requests, want 2", got)
+	}
+	// One wait after the DROP, one after the 503, each a step further in the backoff
+	if want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}; fmt.Sprint(*pauses) != fmt.Sprint(want) {
+		t.Errorf("waits = %v, want %v", *pauses, want)
+	}
+	if got := route.failures["DROP"]; got != 1 {
+		t.Errorf("route recorded %d DROP failures, want 1", got)
+	}
+	if got := route.failures["503"]; got != 1 {
+		t.Errorf("route recorded %d 503 failures, want 1", got)
+	}
+}
+
+func TestFailedRetryRequestIgnoresInterruptionRules(t *testing.T) {
+	recordPauses(t)
+	upstream := newTestUpstream(t,
+		upstreamResponse{http.StatusServiceUnavailable, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`},
+		upstreamResponse{http.StatusOK, sseChunk(" two, three.", "STOP")},
+	)
+
+	cfg := testSessionConfig()
+	cfg.RetryPolicy.Interruption = map[string]config.RetryRule{"DROP": {Action: "abort"}}
+	route := NewModelRoute(cfg, "gemini-test")
+
+	// The first attempt is blocked, so the DROP rule only applies to streams that break off
+	blocked := `data: {"promptFeedback": {"blockReason": "OTHER"}}` + "\n\n"
+	writer, err := runSession(context.Background(), t, cfg, route, upstream.URL("gemini-test"), blocked)
+	if err != nil {
+		t.Fatalf("session failed: %v (errors sent: %v)", err, writer.errors)
+	}
+	if got := writer.text(); got != " two, three." {
+		t.Errorf("client received %q", got)
+	}
+}
+
+func TestFailedRetryRequestsCountTowardsTheLimit(t *testing.T) {
+	pauses := recordPauses(t)
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusServiceUnavailable, `{"error": {"code": 503, "status": "UNAVAILABLE"}}`})
+
+	cfg := testSessionConfig()
+	cfg.MaxConsecutiveRetries = 3
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), sseChunk("One,", ""))
+	if err == nil {
+		t.Fatal("session succeeded")
+	}
+
+	if got := len(upstream.Requests()); got != 3 {
+		t.Errorf("upstream received %d retry requests, want 3", got)
+	}
+	if want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}; fmt.Sprint(*pauses) != fmt.Sprint(want) {
+		t.Errorf("waits = %v, want %v", *pauses, want)
+	}
+	if len(writer.errors) != 1 || !strings.Contains(writer.errors[0], "Last reason: 503") {
+		t.Errorf("errors sent = %v, want the retry limit error after a 503", writer.errors)
+	}
+}
@@ -0,0 +1,117 @@
+package streaming
+
+import (
+	"strings"
+	"unicode"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+// DefaultSentinelToken is the completion token used when none is configured
+const DefaultSentinelToken = "[done]"
+
+// sentinelTokenPlaceholder is replaced by the configured token in instruction templates
+const sentinelTokenPlaceholder = "{token}"
+
+// builtinSentinelInstructions are the instruction templates used when no custom template is configured
+var builtinSentinelInstructions = map[string]string{
+	"en": "IMPORTANT: At the very end of your entire response, you must write the token {token} to signal completion. This is a mandatory technical requirement.",
+	"zh": "重要：在你整个回答的最末尾，必须写上标记 {token} 以表示回答已经结束。这是一项强制性的技术要求。",
+	"ja": "重要：回答全体の一番最後に、完了を示すためにトークン {token} を必ず書いてください。これは必須の技術的要件です。",
+	"ko": "중요: 전체 응답의 맨 마지막에 완료를 나타내기 위해 반드시 토큰 {token} 을(를) 작성해야 합니다. 이는 필수 기술 요구 사항입니다.",
+}
+
+// Sentinel is the in-band completion token and the instruction that asks the model to emit it
+type Sentinel struct {
+	Token       string
+	Instruction string
+}
+
+// ResolveSentinel picks the sentinel token and instruction text for a request.
+// The token comes from the per-model override or COMPLETION_TOKEN. The instruction is, in order:
+// the per-model instruction, the configured template for the language, COMPLETION_INSTRUCTION,
+// the built-in template for the language, and the built-in English template.
+func ResolveSentinel(cfg *config.Config, model, language string) Sentinel {
+	token := strings.TrimSpace(cfg.CompletionToken)
+	if token == "" {
+		token = DefaultSentinelToken
+	}
+
+	modelOverride, hasModelOverride := cfg.CompletionSentinelModels[model]
+	if hasModelOverride && strings.TrimSpace(modelOverride.Token) != "" {
+		token = strings.TrimSpace(modelOverride.Token)
+	}
+
+	template := ""
+	switch {
+	case hasModelOverride && modelOverride.Instruction != "":
+		template = modelOverride.Instruction
+	case cfg.CompletionTemplates[language] != "":
+		template = cfg.CompletionTemplates[language]
+	case cfg.CompletionInstruction != "":
+		template = cfg.CompletionInstruction
+	case builtinSentinelInstructions[language] != "":
+		template = builtinSentinelInstructions[language]
+	default:
+		template = builtinSentinelInstructions["en"]
+	}
+
+	instruction := strings.ReplaceAll(template, sentinelTokenPlaceholder, token)
+	if !strings.Contains(instruction, token) {
+		// A template without the placeholder would never produce the token; spell it out.
+		instruction += " " + token
+	}
+
+	return Sentinel{Token: token, Instruction: instruction}
+}
+
+// DetectLanguage guesses the language of the conversation from the last user message.
+// It only distinguishes the scripts that have built-in templates: "zh", "ja", "ko" and "en" (the fallback).
+func DetectLanguage(request *gemini.GenerateContentRequest) string {
+	text := lastUserText(request)
+
+	var han, kana, hangul, letters int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.IsLetter(r):
+			letters++
+		}
+	}
+
+	switch {
+	case kana > 0 && kana+han >= letters:
+		return "ja"
+	case hangul > 0 && hangul >= letters:
+		return "ko"
+	case han > 0 && han >= letters/4:
+		return "zh"
+	default:
+		return "en"
+	}
+}
+
+// lastUserText concatenates the text parts of the last user message
+func lastUserText(request *gemini.GenerateContentRequest) string {
+	for i := len(request.Contents) - 1; i >= 0; i-- {
+		content := request.Contents[i]
+		if content == nil || (content.Role != "" && content.Role != "user") {
+			continue
+		}
+
+		var builder strings.Builder
+		for _, part := range content.Parts {
+			if part != nil {
+				builder.WriteString(part.TextValue())
+			}
+		}
+		return builder.String()
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package streaming
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/gemini"
+)
+
+func TestResolveSentinel(t *testing.T) {
+	models := map[string]config.SentinelConfig{
+		"gemini-token":       {Token: " <<END>> "},
+		"gemini-instruction": {Instruction: "Finish with {token}."},
+		"gemini-both":        {Token: "<<END>>", Instruction: "Finish with {token}."},
+	}
+	templates := map[string]string{"zh": "最后写 {token}。"}
+
+	tests := []struct {
+		name            string
+		cfg             config.Config
+		model, language string
+		wantToken       string
+		wantInstruction string
+	}{
+		{
+			name:            "defaults",
+			language:        "en",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["en"], "{token}", DefaultSentinelToken),
+		},
+		{
+			name:            "configured token",
+			cfg:             config.Config{CompletionToken: " [fin] "},
+			language:        "en",
+			wantToken:       "[fin]",
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["en"], "{token}", "[fin]"),
+		},
+		{
+			name:            "built-in template of the language",
+			cfg:             config.Config{CompletionToken: "[fin]"},
+			language:        "ja",
+			wantToken:       "[fin]",
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["ja"], "{token}", "[fin]"),
+		},
+		{
+			name:            "unknown language",
+			language:        "fr",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["en"], "{token}", DefaultSentinelToken),
+		},
+		{
+			name:            "configured instruction",
+			cfg:             config.Config{CompletionInstruction: "End with {token}."},
+			language:        "ja",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: "End with [done].",
+		},
+		{
+			name:            "configured template of the language",
+			cfg:             config.Config{CompletionInstruction: "End with {token}.", CompletionTemplates: templates},
+			language:        "zh",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: "最后写 [done]。",
+		},
+		{
+			name:            "configured template of another language",
+			cfg:             config.Config{CompletionInstruction: "End with {token}.", CompletionTemplates: templates},
+			language:        "en",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: "End with [done].",
+		},
+		{
+			name:            "template without the placeholder",
+			cfg:             config.Config{CompletionToken: "[fin]", CompletionInstruction: "Always write the end marker:"},
+			language:        "en",
+			wantToken:       "[fin]",
+			wantInstruction: "Always write the end marker: [fin]",
+		},
+		{
+			name:            "per-model token",
+			cfg:             config.Config{CompletionToken: "[fin]", CompletionSentinelModels: models},
+			model:           "gemini-token",
+			language:        "zh",
+			wantToken:       "<<END>>",
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["zh"], "{token}", "<<END>>"),
+		},
+		{
+			name:            "per-model instruction over the language template",
+			cfg:             config.Config{CompletionToken: "[fin]", CompletionTemplates: templates, CompletionSentinelModels: models},
+			model:           "gemini-instruction",
+			language:        "zh",
+			wantToken:       "[fin]",
+			wantInstruction: "Finish with [fin].",
+		},
+		{
+			name:            "per-model token and instruction",
+			cfg:             config.Config{CompletionSentinelModels: models},
+			model:           "gemini-both",
+			language:        "en",
+			wantToken:       "<<END>>",
+			wantInstruction: "Finish with <<END>>.",
+		},
+		{
+			name:            "other model",
+			cfg:             config.Config{CompletionSentinelModels: models},
+			model:           "gemini-pro",
+			language:        "en",
+			wantToken:       DefaultSentinelToken,
+			wantInstruction: strings.ReplaceAll(builtinSentinelInstructions["en"], "{token}", DefaultSentinelToken),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentinel := ResolveSentinel(&tt.cfg, tt.model, tt.language)
+			if sentinel.Token != tt.wantToken {
+				t.Errorf("token = %q, want %q", sentinel.Token, tt.wantToken)
+			}
+			if sentinel.Instruction != tt.wantInstruction {
+				t.Errorf("instruction = %q, want %q", sentinel.Instruction, tt.wantInstruction)
+			}
+		})
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"english", `[{"role": "user", "parts": [{"text": "Write a haiku about the sea."}]}]`, "en"},
+		{"chinese", `[{"role": "user", "parts": [{"text": "用三句话介绍长城。"}]}]`, "zh"},
+		{"japanese", `[{"role": "user", "parts": [{"text": "日本の首都はどこですか？"}]}]`, "ja"},
+		{"korean", `[{"role": "user", "parts": [{"text": "한국의 수도는 어디입니까?"}]}]`, "ko"},
+		{"a few characters in english", `[{"role": "user", "parts": [{"text": "Please translate the word 长城 into English."}]}]`, "en"},
+		{"text over several parts", `[{"role": "user", "parts": [{"text": "用三句话"}, {"text": "介绍长城。"}]}]`, "zh"},
+		{"last user message", `[{"role": "user", "parts": [{"text": "用三句话介绍长城。"}]}, {"role": "model", "parts": [{"text": "长城是……"}]}, {"role": "user", "parts": [{"text": "Now in English, please."}]}]`, "en"},
+		{"model turn ignored", `[{"role": "user", "parts": [{"text": "Say hello in Chinese."}]}, {"role": "model", "parts": [{"text": "你好"}]}]`, "en"},
+		{"no text", `[{"role": "user", "parts": [{"inlineData": {"mimeType": "image/png", "data": ""}}]}]`, "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := gemini.ParseRequest([]byte(`{"contents": ` + tt.contents + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := DetectLanguage(request); got != tt.want {
+				t.Errorf("DetectLanguage = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveDoneTokenFromChunk(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		text   string
+		remove bool
+		want   string
+	}{
+		{"default token", DefaultSentinelToken, "Three. [done]", true, "Three. "},
+		{"trailing whitespace", DefaultSentinelToken, "Three. [done] \n", true, "Three. "},
+		{"end of a token split over chunks", DefaultSentinelToken, "ne]", true, ""},
+		{"configured token", "<<END>>", "Three. <<END>>", true, "Three. "},
+		{"end of a configured token split over chunks", "<<END>>", "ND>>", true, ""},
+		{"default token with a configured one", "<<END>>", "Three. [done]", true, "Three. [done]"},
+		{"multibyte token", "【完】", "三。【完】", true, "三。"},
+		{"end of a multibyte token split over chunks", "【完】", "完】", true, ""},
+		{"start of a token", "【完】", "三。【完", true, "三。【完"},
+		{"no token", DefaultSentinelToken, "Three.", true, "Three."},
+		{"not the last chunk", DefaultSentinelToken, "Three. [done]", false, "Three. [done]"},
+		{"no token configured", "", "Three. [done]", true, "Three. [done]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := ParseChunk(jsonChunk(tt.text, "STOP"))
+			RemoveDoneTokenFromChunk(chunk, tt.token, tt.remove)
+			if got := ParseChunkContent(ParseChunk(chunk.Data())).Text; got != tt.want {
+				t.Errorf("chunk text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionConfiguredSentinel(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  string
+		want    string
+		retries int
+	}{
+		{"configured token", "One, two, three. <<END>>", "One, two, three. ", 0},
+		// The default token is text like any other once another one is configured
+		{"default token", "One, two, three. [done]", "One, two, three. ", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk("One, two, three. <<END>>", "STOP")})
+			cfg := testSessionConfig()
+			cfg.CompletionToken = "<<END>>"
+			request, _ := gemini.ParseRequest([]byte(testRequest))
+			detector, err := ResolveCompletionDetector(cfg, "gemini-test", DetectorSentinel, "en", request)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writer, err := runSessionDetector(context.Background(), t, cfg, detector, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), testRequest, io.NopCloser(strings.NewReader(sseChunk(tt.answer, "STOP"))))
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := writer.text(); got != tt.want {
+				t.Errorf("client received %q, want %q", got, tt.want)
+			}
+			if got := len(upstream.Requests()); got != tt.retries {
+				t.Errorf("upstream received %d retry requests, want %d", got, tt.retries)
+			}
+		})
+	}
+}
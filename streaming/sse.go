@@ -2,229 +2,398 @@ package streaming
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"gemini-antiblock/gemini"
 	"gemini-antiblock/logger"
 )
 
-// SSELineIterator reads SSE lines from a reader
-func SSELineIterator(reader io.Reader, ch chan<- string) {
-	defer close(ch)
+// DefaultMaxSSEEventBytes is the default limit for the size of a single SSE event. Chunks with
+// inline images easily exceed the 64 KiB line limit of a plain bufio.Scanner.
+const DefaultMaxSSEEventBytes = 16 << 20
+
+// ErrSSEEventTooLarge is returned when an event exceeds the configured maximum size
+var ErrSSEEventTooLarge = errors.New("SSE event exceeds the maximum size")
+
+// SSEEvent is one server-sent event as defined by the HTML Living Standard
+type SSEEvent struct {
+	// Event is the event type; "" means the default type "message"
+	Event string
+	// Data is the event payload; several data fields are joined with "\n"
+	Data string
+	// ID is the last event ID seen so far in the stream
+	ID string
+	// Retry is the reconnection time in milliseconds, or 0 when the event carries none
+	Retry int
+}
 
-	scanner := bufio.NewScanner(reader)
-	lineCount := 0
+// IsMessage reports whether the event has the default type and therefore carries a response chunk
+func (e SSEEvent) IsMessage() bool {
+	return e.Event == "" || e.Event == "message"
+}
 
-	logger.LogDebug("Starting SSE line iteration")
+// SSEDecoder reads server-sent events from a stream. It accepts CRLF, LF and CR line endings,
+// multi-line data fields, comments and the event, id and retry fields.
+type SSEDecoder struct {
+	scanner      *bufio.Scanner
+	maxEventSize int
+	lastID       string
+	firstLine    bool
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.TrimSpace(line) != "" {
-			lineCount++
-			logger.LogDebug(fmt.Sprintf("SSE Line %d: %s", lineCount,
-				func() string {
-					if len(line) > 200 {
-						return line[:200] + "..."
-					}
-					return line
-				}()))
-			ch <- line
-		}
+// NewSSEDecoder creates a decoder reading from r. maxEventSize limits the size of one event
+// (DefaultMaxSSEEventBytes when <= 0).
+func NewSSEDecoder(r io.Reader, maxEventSize int) *SSEDecoder {
+	if maxEventSize <= 0 {
+		maxEventSize = DefaultMaxSSEEventBytes
 	}
 
-	if err := scanner.Err(); err != nil {
-		logger.LogError("Error reading SSE stream:", err)
-	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize+2)
+	scanner.Split(scanSSELines)
 
-	logger.LogDebug(fmt.Sprintf("SSE stream ended. Total lines processed: %d", lineCount))
+	return &SSEDecoder{scanner: scanner, maxEventSize: maxEventSize, firstLine: true}
 }
 
-// IsDataLine checks if a line is a data line
-func IsDataLine(line string) bool {
-	return strings.HasPrefix(line, "data: ")
-}
+// Next returns the next event. It returns io.EOF at the end of the stream; an event that is not
+// terminated by a blank line before the stream ends is discarded, as the specification requires.
+func (d *SSEDecoder) Next() (SSEEvent, error) {
+	var event SSEEvent
+	var data strings.Builder
+	hasData := false
+	size := 0
+
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+		if d.firstLine {
+			line = strings.TrimPrefix(line, "\uFEFF")
+			d.firstLine = false
+		}
 
-// IsBlockedLine checks if a line contains blocking information
-func IsBlockedLine(line string) bool {
-	return strings.Contains(line, "blockReason")
-}
+		if line == "" {
+			if !hasData {
+				// An event without data is not dispatched
+				event = SSEEvent{}
+				size = 0
+				continue
+			}
+			event.Data = data.String()
+			event.ID = d.lastID
+			return event, nil
+		}
 
-// ExtractFinishReason extracts finish reason from a line
-func ExtractFinishReason(line string) string {
-	if !strings.Contains(line, "finishReason") {
-		return ""
-	}
+		size += len(line) + 1
+		if size > d.maxEventSize {
+			return SSEEvent{}, fmt.Errorf("%w (%d bytes)", ErrSSEEventTooLarge, d.maxEventSize)
+		}
 
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return ""
-	}
+		if strings.HasPrefix(line, ":") {
+			continue // comment
+		}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to extract finishReason from line:", err)
-		return ""
-	}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
 
-	if candidates, ok := data["candidates"].([]interface{}); ok && len(candidates) > 0 {
-		if candidate, ok := candidates[0].(map[string]interface{}); ok {
-			if finishReason, ok := candidate["finishReason"].(string); ok {
-				logger.LogDebug("Extracted finishReason:", finishReason)
-				return finishReason
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil && retry >= 0 {
+				event.Retry = retry
 			}
 		}
 	}
 
-	return ""
-}
-
-// LineContent represents parsed content from a data line
-type LineContent struct {
-	Text      string
-	IsThought bool
-}
-
-// ParseLineContent parses a data line to extract text content and thought status
-func ParseLineContent(line string) LineContent {
-	if !IsDataLine(line) {
-		return LineContent{}
+	if err := d.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return SSEEvent{}, fmt.Errorf("%w (%d bytes)", ErrSSEEventTooLarge, d.maxEventSize)
+		}
+		return SSEEvent{}, err
 	}
-
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return LineContent{}
+	if hasData {
+		logger.LogDebug("Discarding unterminated SSE event at end of stream")
 	}
+	return SSEEvent{}, io.EOF
+}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to parse content from data line:", err)
-		return LineContent{}
+// scanSSELines is a bufio.SplitFunc for SSE lines, which may end with CRLF, LF or a lone CR
+func scanSSELines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
 	}
 
-	candidates, ok := data["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		return LineContent{}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		// A trailing CR may be followed by LF in the next read
+		return 0, nil, nil
 	}
 
-	candidate, ok := candidates[0].(map[string]interface{})
-	if !ok {
-		return LineContent{}
+	if atEOF {
+		return len(data), data, nil
 	}
+	return 0, nil, nil
+}
 
-	content, ok := candidate["content"].(map[string]interface{})
-	if !ok {
-		return LineContent{}
-	}
+// SSEEventIterator decodes SSE events from a reader. It returns (closing ch) when the
+// reader is exhausted, an event is too large or ctx is done, so an abandoned attempt never
+// leaks the goroutine.
+func SSEEventIterator(ctx context.Context, reader io.Reader, maxEventSize int, ch chan<- SSEEvent) {
+	defer close(ch)
 
-	parts, ok := content["parts"].([]interface{})
-	if !ok || len(parts) == 0 {
-		return LineContent{}
-	}
+	decoder := NewSSEDecoder(reader, maxEventSize)
+	eventCount := 0
 
-	part, ok := parts[0].(map[string]interface{})
-	if !ok {
-		return LineContent{}
-	}
+	logger.LogDebug("Starting SSE event iteration")
 
-	text, _ := part["text"].(string)
-	thought, _ := part["thought"].(bool)
+	for {
+		event, err := decoder.Next()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				// A cancelled attempt closes its body under the decoder
+				logger.LogError("Error reading SSE stream:", err)
+			}
+			break
+		}
 
-	if thought {
-		logger.LogDebug("Extracted thought chunk. This will be tracked.")
-	} else if text != "" {
-		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars): %s", len(text),
+		eventCount++
+		logger.LogDebug(fmt.Sprintf("SSE Event %d: %s", eventCount,
 			func() string {
-				if len(text) > 100 {
-					return text[:100] + "..."
+				if len(event.Data) > 200 {
+					return event.Data[:200] + "..."
 				}
-				return text
+				return event.Data
 			}()))
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			logger.LogDebug("SSE event iteration cancelled")
+			return
+		}
 	}
 
-	return LineContent{
-		Text:      text,
-		IsThought: thought,
-	}
+	logger.LogDebug(fmt.Sprintf("SSE stream ended. Total events processed: %d", eventCount))
 }
 
-// RemoveDoneTokenFromLine removes [done] token from SSE data line if present
-func RemoveDoneTokenFromLine(line string, shouldRemove bool) string {
-	if !IsDataLine(line) || !shouldRemove {
-		return line
-	}
+// IsBlockedChunk checks if a chunk reports a blocked prompt
+func IsBlockedChunk(chunk *Chunk) bool {
+	return chunk.Response != nil && chunk.Response.Blocked()
+}
 
-	idx := strings.Index(line, "{")
-	if idx == -1 {
-		return line
+// ExtractFinishReason extracts finish reason from a chunk
+func ExtractFinishReason(chunk *Chunk) string {
+	if chunk.Response == nil {
+		return ""
 	}
 
-	var data map[string]interface{}
-	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to process line for [done] token removal:", err)
-		return line
+	finishReason := chunk.Response.FinishReason()
+	if finishReason != "" {
+		logger.LogDebug("Extracted finishReason:", finishReason)
 	}
+	return finishReason
+}
 
-	candidates, ok := data["candidates"].([]interface{})
-	if !ok || len(candidates) == 0 {
-		return line
+// ChunkPart is one part of the first candidate's content in a chunk
+type ChunkPart struct {
+	Text      string
+	HasText   bool
+	IsThought bool
+	// Signature is the thoughtSignature attached to the part, if any
+	Signature string
+	// Part is the part exactly as the model emitted it
+	Part *gemini.Part
+}
+
+// IsFormal reports whether the part belongs to the answer itself rather than the model's thinking
+func (p ChunkPart) IsFormal() bool {
+	return !p.IsThought
+}
+
+// ChunkContent represents the parsed content of a chunk
+type ChunkContent struct {
+	// Parts lists every part of the chunk in order
+	Parts []ChunkPart
+	// Text is the formal (non-thought) text of all parts, concatenated
+	Text string
+	// IsThought is true when the chunk carries thought parts and no formal output
+	IsThought bool
+	// HasThought is true when at least one part is a thought
+	HasThought bool
+	// DataParts holds the non-text, non-thought parts of the chunk (functionCall,
+	// executableCode, codeExecutionResult, ...) exactly as the model emitted them
+	DataParts []*gemini.Part
+}
+
+// ParseChunkContent classifies the parts of a chunk as thought or formal output
+func ParseChunkContent(chunk *Chunk) ChunkContent {
+	candidate := chunk.FirstCandidate()
+	if candidate == nil {
+		return ChunkContent{}
 	}
 
-	candidate, ok := candidates[0].(map[string]interface{})
-	if !ok {
-		return line
+	var result ChunkContent
+	var text strings.Builder
+	hasFormal := false
+
+	for _, rawPart := range candidate.Parts() {
+		if rawPart == nil {
+			continue
+		}
+
+		part := ChunkPart{
+			Text:      rawPart.TextValue(),
+			HasText:   rawPart.HasText(),
+			IsThought: rawPart.Thought,
+			Signature: rawPart.ThoughtSignature,
+			Part:      rawPart,
+		}
+		result.Parts = append(result.Parts, part)
+
+		switch {
+		case part.IsThought:
+			result.HasThought = true
+		case part.HasText:
+			hasFormal = true
+			text.WriteString(part.Text)
+		default:
+			hasFormal = true
+			result.DataParts = append(result.DataParts, rawPart)
+		}
 	}
 
-	content, ok := candidate["content"].(map[string]interface{})
-	if !ok {
-		return line
+	result.Text = text.String()
+	result.IsThought = result.HasThought && !hasFormal
+
+	if len(result.DataParts) > 0 {
+		logger.LogDebug(fmt.Sprintf("Extracted %d non-text part(s) from chunk", len(result.DataParts)))
 	}
 
-	parts, ok := content["parts"].([]interface{})
-	if !ok || len(parts) == 0 {
-		return line
+	if result.IsThought {
+		logger.LogDebug("Extracted thought chunk. This will be tracked.")
+	} else if result.Text != "" {
+		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars across %d part(s)): %s", len(result.Text), len(result.Parts),
+			func() string {
+				if len(result.Text) > 100 {
+					return result.Text[:100] + "..."
+				}
+				return result.Text
+			}()))
 	}
 
-	part, ok := parts[0].(map[string]interface{})
-	if !ok {
-		return line
+	return result
+}
+
+// RemoveDoneTokenFromChunk removes the sentinel token (e.g. [done]) from a chunk if present.
+// The token is matched against the formal text of all parts, so it is also removed when the
+// model split it over several parts of the chunk.
+func RemoveDoneTokenFromChunk(chunk *Chunk, token string, shouldRemove bool) {
+	if !shouldRemove || token == "" {
+		return
 	}
 
-	text, hasText := part["text"].(string)
-	thought, _ := part["thought"].(bool)
+	candidate := chunk.FirstCandidate()
+	if candidate == nil {
+		return
+	}
 
-	if !hasText || thought {
-		return line
+	var textParts []*gemini.Part
+	var combined strings.Builder
+	for _, part := range candidate.Parts() {
+		if part == nil || !part.HasText() || part.Thought {
+			continue
+		}
+		textParts = append(textParts, part)
+		combined.WriteString(part.TextValue())
+	}
+	if len(textParts) == 0 {
+		return
 	}
 
-	// Remove the longest suffix of "[done]" from the text
-	// This handles cases where [done] is split across chunks
-	originalText := strings.TrimSpace(text)
-	modifiedText := originalText
+	// Remove the longest suffix of the token from the text
+	// This handles cases where the token is split across chunks
+	originalText := strings.TrimRightFunc(combined.String(), unicode.IsSpace)
+	removed := ""
 
-	// Try to remove each possible suffix of "[done]"
-	doneToken := "[done]"
-	for i := len(doneToken); i > 0; i-- {
-		suffix := doneToken[len(doneToken)-i:]
+	// Try to remove each possible suffix of the token, starting at rune boundaries
+	for i := 0; i < len(token); i++ {
+		if !utf8.RuneStart(token[i]) {
+			continue
+		}
+		suffix := token[i:]
 		if strings.HasSuffix(originalText, suffix) {
-			modifiedText = strings.TrimSuffix(originalText, suffix)
-			logger.LogDebug(fmt.Sprintf("Removed [done] token suffix '%s' from text content. Original length: %d, Modified length: %d", suffix, len(originalText), len(modifiedText)))
+			removed = suffix
 			break
 		}
 	}
 
-	if originalText != modifiedText {
-		part["text"] = modifiedText
+	if removed == "" {
+		return
+	}
 
-		modifiedData, err := json.Marshal(data)
-		if err != nil {
-			logger.LogDebug("Failed to marshal modified data:", err)
-			return line
+	// Cut the trailing whitespace and the token suffix, walking the text parts backwards
+	cut := combined.Len() - len(originalText) + len(removed)
+	for i := len(textParts) - 1; i >= 0 && cut > 0; i-- {
+		text := textParts[i].TextValue()
+		n := cut
+		if n > len(text) {
+			n = len(text)
 		}
+		textParts[i].SetText(text[:len(text)-n])
+		cut -= n
+	}
+	logger.LogDebug(fmt.Sprintf("Removed %s token suffix '%s' from text content across %d part(s)", token, removed, len(textParts)))
+	chunk.MarkModified()
+}
+
+// RemoveThoughtParts drops the thought parts from a chunk that also carries formal output
+func RemoveThoughtParts(chunk *Chunk) {
+	candidate := chunk.FirstCandidate()
+	if candidate == nil || candidate.Content == nil {
+		return
+	}
 
-		return line[:idx] + string(modifiedData)
+	parts := candidate.Content.Parts
+	kept := make([]*gemini.Part, 0, len(parts))
+	for _, part := range parts {
+		if part != nil && part.Thought {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if len(kept) == len(parts) {
+		return
 	}
 
-	return line
+	candidate.Content.Parts = kept
+	chunk.MarkModified()
 }
@@ -0,0 +1,471 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// decodeAll reads every event of a stream, and the error that ended it unless it is io.EOF
+func decodeAll(r io.Reader, maxEventSize int) ([]SSEEvent, error) {
+	decoder := NewSSEDecoder(r, maxEventSize)
+	var events []SSEEvent
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+func TestSSEDecoderFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []SSEEvent
+	}{
+		{
+			"event type",
+			"event: error\ndata: {}\n\ndata: next\n\n",
+			[]SSEEvent{{Event: "error", Data: "{}"}, {Data: "next"}},
+		},
+		{
+			"last event ID carries over",
+			"id: 1\ndata: a\n\ndata: b\n\nid: 2\ndata: c\n\n",
+			[]SSEEvent{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}, {ID: "2", Data: "c"}},
+		},
+		{
+			"empty id resets the last event ID",
+			"id: 1\ndata: a\n\nid\ndata: b\n\n",
+			[]SSEEvent{{ID: "1", Data: "a"}, {Data: "b"}},
+		},
+		{
+			"id with NUL is ignored",
+			"id: 1\ndata: a\n\nid: 2\x003\ndata: b\n\n",
+			[]SSEEvent{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}},
+		},
+		{
+			"id without data is kept for the next event",
+			"id: 7\n\ndata: a\n\n",
+			[]SSEEvent{{ID: "7", Data: "a"}},
+		},
+		{
+			"retry",
+			"retry: 1500\ndata: a\n\ndata: b\n\n",
+			[]SSEEvent{{Retry: 1500, Data: "a"}, {Data: "b"}},
+		},
+		{
+			"invalid retry is ignored",
+			"retry: soon\ndata: a\n\nretry: -5\ndata: b\n\nretry: 1.5\ndata: c\n\n",
+			[]SSEEvent{{Data: "a"}, {Data: "b"}, {Data: "c"}},
+		},
+		{
+			"event and retry without data are dropped",
+			"event: ping\nretry: 10\n\ndata: a\n\n",
+			[]SSEEvent{{Data: "a"}},
+		},
+		{
+			"only the first space after the colon is removed",
+			"event:  spaced\ndata:  a\ndata:b\n\n",
+			[]SSEEvent{{Event: " spaced", Data: " a\nb"}},
+		},
+		{
+			"data field without a colon",
+			"data\ndata\n\n",
+			[]SSEEvent{{Data: "\n"}},
+		},
+		{
+			"comments and unknown fields are ignored",
+			": keep-alive\nfoo: bar\ndata: a\n\n",
+			[]SSEEvent{{Data: "a"}},
+		},
+		{
+			"unterminated event is discarded",
+			"data: a\n\ndata: b",
+			[]SSEEvent{{Data: "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAll(strings.NewReader(tt.stream), 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSEDecoderEventTooLarge(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"long line", "data: ok\n\ndata: " + strings.Repeat("x", 100) + "\n\n"},
+		{"many lines", "data: ok\n\n" + strings.Repeat("data: xxxxxxxxxx\n", 10) + "\n"},
+		{"long comment", "data: ok\n\n: " + strings.Repeat("x", 100) + "\ndata: a\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAll(strings.NewReader(tt.stream), 64)
+			if !errors.Is(err, ErrSSEEventTooLarge) {
+				t.Fatalf("error = %v, want ErrSSEEventTooLarge", err)
+			}
+			if want := []SSEEvent{{Data: "ok"}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("events before the error = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// splitReader returns the stream in reads of the given sizes, taking turns
+type splitReader struct {
+	data  []byte
+	sizes []int
+	turn  int
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.sizes[r.turn%len(r.sizes)]
+	r.turn++
+	n = min(n, len(p), len(r.data))
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// referenceSSE decodes a stream held in memory following the specification step by step: the
+// BOM is dropped, lines are split on CRLF, LF and CR, and a blank line dispatches the event
+func referenceSSE(stream string, maxEventSize int) ([]SSEEvent, error) {
+	stream = strings.TrimPrefix(stream, "\uFEFF")
+	stream = strings.ReplaceAll(stream, "\r\n", "\n")
+	stream = strings.ReplaceAll(stream, "\r", "\n")
+	lines := strings.Split(stream, "\n")
+	if lines[len(lines)-1] == "" {
+		// The stream ends with a line ending
+		lines = lines[:len(lines)-1]
+	}
+
+	var events []SSEEvent
+	var event SSEEvent
+	var data []string
+	lastID := ""
+	size := 0
+	for _, line := range lines {
+		if line == "" {
+			if data != nil {
+				event.Data = strings.Join(data, "\n")
+				event.ID = lastID
+				events = append(events, event)
+			}
+			event, data, size = SSEEvent{}, nil, 0
+			continue
+		}
+		if size += len(line) + 1; size > maxEventSize {
+			return events, ErrSSEEventTooLarge
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				lastID = value
+			}
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil && retry >= 0 {
+				event.Retry = retry
+			}
+		}
+	}
+	return events, nil
+}
+
+func FuzzSSEDecoder(f *testing.F) {
+	seeds := []string{
+		"data: a\n\n",
+		"data: a\r\n\r\n",
+		"data: a\r\rdata: b\r\r",
+		"data: a\r\n\ndata: b\n\r\n",
+		"data: line 1\ndata: line 2\r\ndata: line 3\r\n\r\n",
+		"\uFEFFdata: bom\n\n",
+		"\uFEFF\uFEFFdata: bom twice\n\n",
+		"data: \uFEFF\n\n",
+		"event: error\nid: 1\nretry: 2000\ndata: {}\n\n",
+		": comment\r\nid: 2\x00\rdata\r\n\r\n",
+		"data: " + strings.Repeat("x", 300) + "\n\n",
+		"data: ok\n\n" + strings.Repeat("data: 0123456789\n", 20) + "\n",
+		"data: unterminated",
+		"data: a\r",
+	}
+	for _, seed := range seeds {
+		for _, split := range []uint8{0, 1, 2, 7} {
+			f.Add([]byte(seed), split, uint16(128))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, stream []byte, split uint8, maxEventSize uint16) {
+		limit := int(maxEventSize)%512 + 16
+
+		want, wantErr := referenceSSE(string(stream), limit)
+
+		// Reads of one to eight bytes split CRLF pairs, field names and multi-byte characters
+		sizes := []int{int(split%8) + 1, int(split/8%8) + 1, int(split/64) + 1}
+		readers := map[string]io.Reader{
+			"whole":    strings.NewReader(string(stream)),
+			"one byte": iotest.OneByteReader(strings.NewReader(string(stream))),
+			"split":    &splitReader{data: stream, sizes: sizes},
+		}
+		for name, r := range readers {
+			got, err := decodeAll(r, limit)
+			if (err != nil) != (wantErr != nil) || (err != nil && !errors.Is(err, ErrSSEEventTooLarge)) {
+				t.Fatalf("%s: error = %v, want %v", name, err, wantErr)
+			}
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("%s: events = %q, want %q", name, got, want)
+			}
+			for _, event := range got {
+				if strings.ContainsAny(event.Data, "\r") || len(event.Data) > limit {
+					t.Fatalf("%s: malformed event %q", name, event)
+				}
+			}
+		}
+	})
+}
+
+func TestParseChunkContent(t *testing.T) {
+	tests := []struct {
+		name           string
+		parts          string
+		wantText       string
+		wantFormal     []bool
+		wantIsThought  bool
+		wantHasThought bool
+		wantDataParts  int
+	}{
+		{
+			name:       "text",
+			parts:      `[{"text": "One, "}]`,
+			wantText:   "One, ",
+			wantFormal: []bool{true},
+		},
+		{
+			name:       "several text parts",
+			parts:      `[{"text": "One, "}, {"text": "two, "}, {"text": "three."}]`,
+			wantText:   "One, two, three.",
+			wantFormal: []bool{true, true, true},
+		},
+		{
+			name:           "thought and text",
+			parts:          `[{"text": "Counting.", "thought": true}, {"text": "One."}]`,
+			wantText:       "One.",
+			wantFormal:     []bool{false, true},
+			wantHasThought: true,
+		},
+		{
+			name:           "thoughts only",
+			parts:          `[{"text": "Counting.", "thought": true}, {"text": "Up to three.", "thought": true}]`,
+			wantFormal:     []bool{false, false},
+			wantIsThought:  true,
+			wantHasThought: true,
+		},
+		{
+			name:          "text and function call",
+			parts:         `[{"text": "Checking Rome."}, ` + weatherCallPart + `]`,
+			wantText:      "Checking Rome.",
+			wantFormal:    []bool{true, true},
+			wantDataParts: 1,
+		},
+		{
+			name:           "thought and function call",
+			parts:          `[{"text": "Rome needs a call.", "thought": true}, ` + weatherCallPart + `]`,
+			wantFormal:     []bool{false, true},
+			wantHasThought: true,
+			wantDataParts:  1,
+		},
+		{
+			name:          "code execution",
+			parts:         codeExecution,
+			wantFormal:    []bool{true, true},
+			wantDataParts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := ParseChunkContent(ParseChunk(jsonParts(tt.parts, "")))
+			if content.Text != tt.wantText {
+				t.Errorf("Text = %q, want %q", content.Text, tt.wantText)
+			}
+			var formal []bool
+			for _, part := range content.Parts {
+				formal = append(formal, part.IsFormal())
+			}
+			if !reflect.DeepEqual(formal, tt.wantFormal) {
+				t.Errorf("formal parts = %v, want %v", formal, tt.wantFormal)
+			}
+			if content.IsThought != tt.wantIsThought || content.HasThought != tt.wantHasThought {
+				t.Errorf("IsThought, HasThought = %t, %t, want %t, %t", content.IsThought, content.HasThought, tt.wantIsThought, tt.wantHasThought)
+			}
+			if len(content.DataParts) != tt.wantDataParts {
+				t.Errorf("%d data parts, want %d", len(content.DataParts), tt.wantDataParts)
+			}
+		})
+	}
+
+	t.Run("signatures", func(t *testing.T) {
+		content := ParseChunkContent(ParseChunk(jsonParts(`[{"text": "Counting.", "thought": true, "thoughtSignature": "dGhvdWdodA=="}, {"text": "One."}]`, "")))
+		if content.Parts[0].Signature != "dGhvdWdodA==" || content.Parts[1].Signature != "" {
+			t.Errorf("signatures = %q, %q", content.Parts[0].Signature, content.Parts[1].Signature)
+		}
+	})
+
+	t.Run("no candidates", func(t *testing.T) {
+		content := ParseChunkContent(ParseChunk(`{"usageMetadata": {"totalTokenCount": 5}}`))
+		if len(content.Parts) != 0 || content.Text != "" || content.IsThought {
+			t.Errorf("ParseChunkContent = %+v", content)
+		}
+	})
+}
+
+func TestRemoveDoneTokenAcrossParts(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts string
+		want  string
+	}{
+		{
+			name:  "token split over parts",
+			parts: `[{"text": "Three. [do"}, {"text": "ne]"}]`,
+			want:  `[{"text": "Three. "}, {"text": ""}]`,
+		},
+		{
+			name:  "whitespace after the token",
+			parts: `[{"text": "Three. [done]"}, {"text": " \n"}]`,
+			want:  `[{"text": "Three. "}, {"text": ""}]`,
+		},
+		{
+			name:  "thought after the token",
+			parts: `[{"text": "Three. [done]"}, {"text": "I wrote [done]", "thought": true}]`,
+			want:  `[{"text": "Three. "}, {"text": "I wrote [done]", "thought": true}]`,
+		},
+		{
+			name:  "token in an earlier part",
+			parts: `[{"text": "[done]"}, {"text": " Four."}]`,
+			want:  `[{"text": "[done]"}, {"text": " Four."}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := ParseChunk(jsonParts(tt.parts, "STOP"))
+			RemoveDoneTokenFromChunk(chunk, DefaultSentinelToken, true)
+			parts, err := json.Marshal(ParseChunk(chunk.Data()).FirstCandidate().Parts())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, parts, []byte(tt.want))
+		})
+	}
+}
+
+func TestRemoveThoughtParts(t *testing.T) {
+	chunk := ParseChunk(jsonParts(`[{"text": "Counting.", "thought": true}, {"text": "One."}, {"text": "Next.", "thought": true}]`, ""))
+	RemoveThoughtParts(chunk)
+	parts, err := json.Marshal(ParseChunk(chunk.Data()).FirstCandidate().Parts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONEqual(t, parts, []byte(`[{"text": "One."}]`))
+
+	// A chunk without thoughts is forwarded as upstream sent it
+	data := jsonParts(`[{"text": "One."}]`, "")
+	chunk = ParseChunk(data)
+	RemoveThoughtParts(chunk)
+	if chunk.Data() != data {
+		t.Errorf("chunk without thoughts re-encoded as %s", chunk.Data())
+	}
+}
+
+func TestSessionSentinelAcrossParts(t *testing.T) {
+	recordPauses(t)
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk("One, two, three. [done]", "STOP")})
+	cfg := testSessionConfig()
+	initial := sseChunk("One, ", "") + sseParts(`[{"text": "two, "}, {"text": "three. [do"}, {"text": "ne]"}]`, "STOP")
+
+	writer, err := runSessionDetector(context.Background(), t, cfg, newTestDetector(t, DetectorSentinel, cfg), NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), testRequest, io.NopCloser(strings.NewReader(initial)))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := len(upstream.Requests()); got != 0 {
+		t.Errorf("upstream received %d retry requests for a finished answer", got)
+	}
+	if got := writer.text(); got != "One, two, three. " {
+		t.Errorf("client received %q", got)
+	}
+}
+
+func TestSessionAccumulatesAllParts(t *testing.T) {
+	recordPauses(t)
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK, sseChunk(" four.", "STOP")})
+	initial := sseParts(`[{"text": "Counting.", "thought": true}, {"text": "One, "}]`, "") +
+		sseParts(`[{"text": "two, "}, {"text": "three,"}]`, "")
+
+	cfg := testSessionConfig()
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), initial)
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := writer.text(); got != "One, two, three, four." {
+		t.Errorf("client received %q", got)
+	}
+	requests := upstream.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("upstream received %d retry requests, want 1", len(requests))
+	}
+	// Every formal part is resumed, the thought is not
+	assertJSONEqual(t, resumedModelTurn(t, requests[0]), []byte(`[{"text": "One, two, three,"}]`))
+}
+
+func TestSessionSwallowsThoughtsSharingAChunk(t *testing.T) {
+	recordPauses(t)
+	upstream := newTestUpstream(t, upstreamResponse{http.StatusOK,
+		sseThought("Where was I?") + sseParts(`[{"text": "Counting on.", "thought": true}, {"text": " two, three."}]`, "STOP")})
+	cfg := testSessionConfig()
+	cfg.SwallowThoughtsAfterRetry = true
+
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), sseChunk("One,", ""))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	if got := writer.text(); got != "One, two, three." {
+		t.Errorf("client received %q", got)
+	}
+	for _, event := range writer.events {
+		if content := ParseChunkContent(ParseChunk(event.Data)); content.HasThought {
+			t.Errorf("client received a thought after the retry: %s", event.Data)
+		}
+	}
+}
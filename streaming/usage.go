@@ -0,0 +1,60 @@
+package streaming
+
+import (
+	"encoding/json"
+
+	"gemini-antiblock/gemini"
+	"gemini-antiblock/logger"
+)
+
+// recordUsage remembers the usageMetadata of a chunk. Every chunk reports the running total of
+// its attempt, so the latest one counts.
+func (s *streamSession) recordUsage(chunk *Chunk) {
+	if chunk.Response != nil && chunk.Response.UsageMetadata != nil {
+		s.attemptUsage = chunk.Response.UsageMetadata
+	}
+}
+
+// closeAttemptUsage files the usage of the attempt that just ended before the next one starts
+func (s *streamSession) closeAttemptUsage() {
+	if s.attemptUsage != nil {
+		s.usageHistory = append(s.usageHistory, s.attemptUsage)
+		s.attemptUsage = nil
+	}
+}
+
+// retried reports whether an earlier attempt of the session reported usage
+func (s *streamSession) retried() bool {
+	return len(s.usageHistory) > 0
+}
+
+// sessionUsage returns the usage of the finished attempts plus current, the running usage of
+// the current attempt. Upstream bills every attempt in full, prompt included, so this is what
+// the session costs. With UsageAttemptBreakdown it also lists the usage of each attempt.
+func (s *streamSession) sessionUsage(current *gemini.UsageMetadata) *gemini.UsageMetadata {
+	reports := s.usageHistory
+	if current != nil {
+		reports = append(reports[:len(reports):len(reports)], current)
+	}
+
+	total := gemini.SumUsage(reports...)
+	if total != nil && s.cfg.UsageAttemptBreakdown {
+		if attempts, err := json.Marshal(reports); err == nil {
+			total.Extra["attempts"] = attempts
+		} else {
+			logger.LogDebug("Failed to encode the per-attempt usage:", err)
+		}
+	}
+	return total
+}
+
+// applySessionUsage replaces the usageMetadata of a chunk forwarded after a retry with the
+// usage of the whole session, so the final chunk reports what all attempts cost together.
+// Chunks of a session that was not retried are left as upstream sent them.
+func (s *streamSession) applySessionUsage(chunk *Chunk) {
+	if !s.retried() || chunk.Response == nil || chunk.Response.UsageMetadata == nil {
+		return
+	}
+	chunk.Response.UsageMetadata = s.sessionUsage(chunk.Response.UsageMetadata)
+	chunk.MarkModified()
+}
@@ -0,0 +1,159 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"gemini-antiblock/gemini"
+)
+
+// lastUsage returns the usageMetadata of the last chunk the client received that reported any
+func lastUsage(t *testing.T, writer *recordingWriter) []byte {
+	t.Helper()
+	for i := len(writer.events) - 1; i >= 0; i-- {
+		chunk := ParseChunk(writer.events[i].Data)
+		if chunk.Response != nil && chunk.Response.UsageMetadata != nil {
+			usage, err := chunk.Response.UsageMetadata.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return usage
+		}
+	}
+	t.Fatal("the client received no usageMetadata")
+	return nil
+}
+
+func TestApplySessionUsage(t *testing.T) {
+	first := &gemini.UsageMetadata{PromptTokenCount: 10, CandidatesTokenCount: 5, TotalTokenCount: 15}
+	tests := []struct {
+		name      string
+		history   []*gemini.UsageMetadata
+		breakdown bool
+		want      string
+	}{
+		{
+			name: "not retried",
+			want: `{"promptTokenCount": 20, "candidatesTokenCount": 7, "totalTokenCount": 27}`,
+		},
+		{
+			name:    "retried",
+			history: []*gemini.UsageMetadata{first},
+			want:    `{"promptTokenCount": 30, "candidatesTokenCount": 12, "totalTokenCount": 42}`,
+		},
+		{
+			name:      "retried with breakdown",
+			history:   []*gemini.UsageMetadata{first},
+			breakdown: true,
+			want: `{"promptTokenCount": 30, "candidatesTokenCount": 12, "totalTokenCount": 42, "attempts": [
+				{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15},
+				{"promptTokenCount": 20, "candidatesTokenCount": 7, "totalTokenCount": 27}
+			]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testSessionConfig()
+			cfg.UsageAttemptBreakdown = tt.breakdown
+			s := &streamSession{cfg: cfg, usageHistory: tt.history}
+
+			chunk := ParseChunk(`{"candidates": [{"content": {"parts": [{"text": "Done."}]}, "finishReason": "STOP"}], "usageMetadata": {"promptTokenCount": 20, "candidatesTokenCount": 7, "totalTokenCount": 27}}`)
+			s.applySessionUsage(chunk)
+			var got struct {
+				UsageMetadata json.RawMessage `json:"usageMetadata"`
+			}
+			if err := json.Unmarshal([]byte(chunk.Data()), &got); err != nil {
+				t.Fatal(err)
+			}
+			assertJSONEqual(t, got.UsageMetadata, []byte(tt.want))
+			if len(s.usageHistory) != len(tt.history) {
+				t.Errorf("applying the session usage changed the history")
+			}
+		})
+	}
+}
+
+func TestCloseAttemptUsage(t *testing.T) {
+	s := &streamSession{cfg: testSessionConfig()}
+	s.closeAttemptUsage()
+	if s.retried() {
+		t.Fatal("an attempt without usage was filed")
+	}
+
+	// Every chunk reports the running total of its attempt, so the latest one is filed
+	for _, total := range []int{3, 8} {
+		s.recordUsage(ParseChunk(`{"usageMetadata": {"totalTokenCount": ` + strconv.Itoa(total) + `}}`))
+	}
+	s.recordUsage(ParseChunk(`{"candidates": [{"content": {"parts": [{"text": "no usage"}]}}]}`))
+	s.closeAttemptUsage()
+	if !s.retried() || len(s.usageHistory) != 1 || s.usageHistory[0].TotalTokenCount != 8 {
+		t.Errorf("history = %+v, want the last report of the attempt", s.usageHistory)
+	}
+	if s.attemptUsage != nil {
+		t.Error("the next attempt starts with the usage of the last one")
+	}
+}
+
+func TestSessionUsageAcrossAttempts(t *testing.T) {
+	tests := []struct {
+		name      string
+		breakdown bool
+		want      string
+	}{
+		{
+			name: "totals",
+			want: `{"promptTokenCount": 60, "candidatesTokenCount": 18, "totalTokenCount": 78,
+				"promptTokensDetails": [{"modality": "TEXT", "tokenCount": 60}]}`,
+		},
+		{
+			name:      "with breakdown",
+			breakdown: true,
+			want: `{"promptTokenCount": 60, "candidatesTokenCount": 18, "totalTokenCount": 78,
+				"promptTokensDetails": [{"modality": "TEXT", "tokenCount": 60}],
+				"attempts": [
+					{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 10}]},
+					{"promptTokenCount": 20, "candidatesTokenCount": 6, "totalTokenCount": 26, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 20}]},
+					{"promptTokenCount": 30, "candidatesTokenCount": 7, "totalTokenCount": 37, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 30}]}
+				]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordPauses(t)
+			// Every retry sends the whole conversation again, so the prompt grows
+			upstream := newTestUpstream(t,
+				upstreamResponse{http.StatusOK, sseUsageChunk(" two,", "", `{"promptTokenCount": 20, "candidatesTokenCount": 6, "totalTokenCount": 26, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 20}]}`)},
+				upstreamResponse{http.StatusOK, sseUsageChunk(" three.", "STOP", `{"promptTokenCount": 30, "candidatesTokenCount": 7, "totalTokenCount": 37, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 30}]}`)},
+			)
+			cfg := testSessionConfig()
+			cfg.UsageAttemptBreakdown = tt.breakdown
+			initial := sseUsageChunk("One,", "", `{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15, "promptTokensDetails": [{"modality": "TEXT", "tokenCount": 10}]}`)
+
+			writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), upstream.URL("gemini-test"), initial)
+			if err != nil {
+				t.Fatalf("session failed: %v", err)
+			}
+			if got := writer.text(); got != "One, two, three." {
+				t.Errorf("client received %q", got)
+			}
+			assertJSONEqual(t, lastUsage(t, writer), []byte(tt.want))
+		})
+	}
+}
+
+func TestSessionUsageWithoutRetry(t *testing.T) {
+	cfg := testSessionConfig()
+	cfg.UsageAttemptBreakdown = true
+	usage := `{"promptTokenCount": 10, "candidatesTokenCount": 5, "totalTokenCount": 15}`
+	writer, err := runSession(context.Background(), t, cfg, NewModelRoute(cfg, "gemini-test"), "http://upstream.invalid", sseUsageChunk("One, two, three.", "STOP", usage))
+	if err != nil {
+		t.Fatalf("session failed: %v", err)
+	}
+	// A session that was not retried reports the usage as upstream sent it
+	assertJSONEqual(t, lastUsage(t, writer), []byte(usage))
+}
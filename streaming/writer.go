@@ -0,0 +1,72 @@
+package streaming
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// StreamWriter receives the output of a stream session
+type StreamWriter interface {
+	// BeginAttempt is called before the events of every upstream attempt, including the first
+	BeginAttempt()
+	// WriteEvent forwards one event of the upstream stream
+	WriteEvent(event SSEEvent) error
+	// WriteError reports a terminal error with a Google API error payload; no events follow it
+	WriteError(payload []byte)
+}
+
+// SSEWriter writes the session output to the client as server-sent events, flushing every event
+type SSEWriter struct {
+	w io.Writer
+}
+
+// NewSSEWriter creates a writer emitting server-sent events to w
+func NewSSEWriter(w io.Writer) *SSEWriter {
+	return &SSEWriter{w: w}
+}
+
+// BeginAttempt is a no-op: attempts are stitched into one event stream
+func (s *SSEWriter) BeginAttempt() {}
+
+// WriteEvent encodes an event and flushes it to the client immediately
+func (s *SSEWriter) WriteEvent(event SSEEvent) error {
+	if _, err := s.w.Write([]byte(EncodeSSEEvent(event))); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// WriteError writes an SSE error event and flushes it to the client immediately
+func (s *SSEWriter) WriteError(payload []byte) {
+	s.w.Write([]byte(EncodeSSEEvent(SSEEvent{Event: "error", Data: string(payload)})))
+	s.flush()
+}
+
+func (s *SSEWriter) flush() {
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// EncodeSSEEvent serializes an event in the SSE wire format, splitting multi-line data over
+// several data fields
+func EncodeSSEEvent(event SSEEvent) string {
+	var b strings.Builder
+	if event.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event.Event)
+	}
+	if event.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", event.ID)
+	}
+	if event.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", event.Retry)
+	}
+	for _, line := range strings.Split(event.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return b.String()
+}